@@ -0,0 +1,331 @@
+package dtunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var ErrorDenied = errors.New("Denied")
+var ErrorUncheckedTransport = errors.New("UncheckedTransport")
+
+// ACL decides which destinations the server connects to for its clients.
+// A rule is an ip, a CIDR, a host name, or *.domain for the names under it.
+// Deny rules win, and once there are allow rules a destination has to
+// match one of them. A nil ACL allows all. Where the server listens for
+// clients which expose services is up to ExposeACL
+type ACL struct {
+	allow []aclRule
+	deny  []aclRule
+}
+
+type aclRule struct {
+	ipnet *net.IPNet
+	name  string
+	//name is a suffix like .example.com
+	suffix bool
+}
+
+func NewACL(allow []string, deny []string) (*ACL, error) {
+	a := &ACL{}
+	for _, rule := range allow {
+		r, err := parseACLRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		a.allow = append(a.allow, r)
+	}
+	for _, rule := range deny {
+		r, err := parseACLRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		a.deny = append(a.deny, r)
+	}
+	return a, nil
+}
+
+func parseACLRule(rule string) (aclRule, error) {
+	rule = strings.ToLower(strings.TrimSpace(rule))
+	if _, ipnet, err := net.ParseCIDR(rule); err == nil {
+		return aclRule{ipnet: ipnet}, nil
+	}
+	if ip := net.ParseIP(rule); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return aclRule{ipnet: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}}, nil
+	}
+	name, suffix := rule, false
+	if strings.HasPrefix(rule, "*.") {
+		name, suffix = rule[1:], true
+	}
+	if strings.Trim(name, ".") == "" || strings.ContainsAny(name, "*/: ") {
+		return aclRule{}, fmt.Errorf("invalid acl rule %q", rule)
+	}
+	return aclRule{name: name, suffix: suffix}, nil
+}
+
+func (r aclRule) matchName(host string) bool {
+	if r.ipnet != nil {
+		return false
+	}
+	if r.suffix {
+		return strings.HasSuffix(host, r.name)
+	}
+	return host == r.name
+}
+
+func (r aclRule) matchIP(ip net.IP) bool {
+	return r.ipnet != nil && ip != nil && r.ipnet.Contains(ip)
+}
+
+// checkName checks host before it's resolved, returns true if an allow rule
+// takes the name. Otherwise the ip it resolves to has to be allowed
+func (a *ACL) checkName(host string) (bool, error) {
+	if a == nil {
+		return true, nil
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if ip := net.ParseIP(host); ip != nil {
+		return true, a.checkIP(ip, false)
+	}
+	for _, r := range a.deny {
+		if r.matchName(host) {
+			return false, ErrorDenied
+		}
+	}
+	if len(a.allow) == 0 {
+		return true, nil
+	}
+	for _, r := range a.allow {
+		if r.matchName(host) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkIP checks the ip a destination resolved to, byName tells if its
+// name is allowed already
+func (a *ACL) checkIP(ip net.IP, byName bool) error {
+	if a == nil {
+		return nil
+	}
+	for _, r := range a.deny {
+		if r.matchIP(ip) {
+			return ErrorDenied
+		}
+	}
+	if byName || len(a.allow) == 0 {
+		return nil
+	}
+	for _, r := range a.allow {
+		if r.matchIP(ip) {
+			return nil
+		}
+	}
+	return ErrorDenied
+}
+
+// Check a destination by its name, and the ip it resolved to
+func (a *ACL) Check(host string, ip net.IP) error {
+	byName, err := a.checkName(host)
+	if err != nil {
+		return err
+	}
+	return a.checkIP(ip, byName)
+}
+
+// DialContext dials address if it's allowed. The ip is checked once the
+// name is resolved, so a name can't lead to a denied ip
+func (a *ACL) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	byName, err := a.checkName(host)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: fmt.Errorf("%s %s", address, err)}
+	}
+	d := &net.Dialer{Control: func(network string, address string, c syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		return a.checkIP(net.ParseIP(host), byName)
+	}}
+	return d.DialContext(ctx, network, address)
+}
+
+// wrapDial checks the destinations of dial, the default dialer if nil.
+// The ip a dial of its own connects to is checked once it's connected
+func (a *ACL) wrapDial(dial dialFunc) dialFunc {
+	if a == nil {
+		return dial
+	}
+	if dial == nil {
+		return a.DialContext
+	}
+	return func(ctx context.Context, network string, address string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		byName, err := a.checkName(host)
+		if err != nil {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: fmt.Errorf("%s %s", address, err)}
+		}
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		remote, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		if err := a.checkIP(net.ParseIP(remote), byName); err != nil {
+			conn.Close()
+			return nil, &net.OpError{Op: "dial", Net: network, Err: fmt.Errorf("%s %s", address, err)}
+		}
+		return conn, nil
+	}
+}
+
+// wrapTransport makes the transport the http requests of clients are sent
+// with, a nil ht is ours and dials with dial. An *http.Transport which dials
+// the destinations itself is copied with its dialer wrapped. Any other one
+// is only wrapped by aclTransport if bestEffort
+func (a *ACL) wrapTransport(ht http.RoundTripper, dial dialFunc, bestEffort bool) (http.RoundTripper, error) {
+	if ht == nil {
+		return &http.Transport{DialContext: a.wrapDial(dial)}, nil
+	}
+	if a == nil {
+		return ht, nil
+	}
+	if t, ok := ht.(*http.Transport); ok && t.Proxy == nil && t.DialTLSContext == nil && t.DialTLS == nil &&
+		(t.DialContext != nil || t.Dial == nil) {
+		t = t.Clone()
+		t.DialContext = a.wrapDial(t.DialContext)
+		return t, nil
+	}
+	if !bestEffort {
+		return nil, ErrorUncheckedTransport
+	}
+	return &aclTransport{acl: a, next: ht}, nil
+}
+
+// checkHost checks a destination by its name, and all the ips it resolves to
+func (a *ACL) checkHost(ctx context.Context, host string) error {
+	byName, err := a.checkName(host)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if err := a.checkIP(addr.IP, byName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// aclTransport checks the host of a request before a RoundTripper whose
+// dialer is out of our reach sends it. It's best effort, next resolves the
+// name again and may get another ip, see WithBestEffortACL
+type aclTransport struct {
+	acl  *ACL
+	next http.RoundTripper
+}
+
+func (t *aclTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Hostname()
+	if err := t.acl.checkHost(req.Context(), host); err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: fmt.Errorf("%s %s", host, err)}
+	}
+	return t.next.RoundTrip(req)
+}
+
+// ExposeACL decides where clients may make the server listen for the
+// services they expose. A rule is host:port or host:low-high, the host "*"
+// matches any host and an empty one is all interfaces, like ":9000". Port 0
+// lets the server pick a port, it's only allowed by a range from 0
+type ExposeACL struct {
+	rules []exposeRule
+}
+
+type exposeRule struct {
+	host string
+	low  int
+	high int
+}
+
+func NewExposeACL(allow []string) (*ExposeACL, error) {
+	a := &ExposeACL{}
+	for _, rule := range allow {
+		r, err := parseExposeRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		a.rules = append(a.rules, r)
+	}
+	return a, nil
+}
+
+func parseExposeRule(rule string) (exposeRule, error) {
+	host, ports, err := net.SplitHostPort(strings.ToLower(strings.TrimSpace(rule)))
+	if err != nil {
+		return exposeRule{}, fmt.Errorf("invalid expose rule %q: %s", rule, err)
+	}
+	low, high := ports, ports
+	if i := strings.Index(ports, "-"); i >= 0 {
+		low, high = ports[:i], ports[i+1:]
+	}
+	r := exposeRule{host: unspecifiedHost(host)}
+	if r.low, err = strconv.Atoi(low); err == nil {
+		r.high, err = strconv.Atoi(high)
+	}
+	if err != nil || r.low < 0 || r.high > 65535 || r.low > r.high {
+		return exposeRule{}, fmt.Errorf("invalid expose rule %q: bad port range", rule)
+	}
+	return r, nil
+}
+
+// Check an address a client asks to listen on, a nil ExposeACL denies all
+func (a *ExposeACL) Check(addr string) error {
+	if a == nil {
+		return ErrorDenied
+	}
+	host, ports, err := net.SplitHostPort(strings.ToLower(addr))
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(ports)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", ports)
+	}
+	host = unspecifiedHost(host)
+	for _, r := range a.rules {
+		if (r.host == "*" || r.host == host) && port >= r.low && port <= r.high {
+			return nil
+		}
+	}
+	return ErrorDenied
+}
+
+// unspecifiedHost makes 0.0.0.0 and :: the empty host, they are all interfaces
+func unspecifiedHost(host string) string {
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		return ""
+	}
+	return host
+}
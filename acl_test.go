@@ -0,0 +1,209 @@
+package dtunnel
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestACLCheck(t *testing.T) {
+	acl, err := NewACL([]string{"*.example.com", "10.0.0.0/8", "localhost"}, []string{"secret.example.com", "10.1.0.0/16"})
+	if err != nil {
+		t.Fatalf("NewACL fail %v", err)
+	}
+	cases := []struct {
+		host  string
+		ip    string
+		allow bool
+	}{
+		{"www.example.com", "93.184.216.34", true},
+		{"WWW.Example.com.", "93.184.216.34", true},
+		{"secret.example.com", "93.184.216.34", false},
+		{"example.org", "93.184.216.34", false},
+		{"example.org", "10.2.3.4", true},
+		{"10.2.3.4", "10.2.3.4", true},
+		{"10.1.3.4", "10.1.3.4", false},
+		//an allowed name can't reach a denied ip
+		{"www.example.com", "10.1.0.1", false},
+		{"localhost", "127.0.0.1", true},
+	}
+	for _, c := range cases {
+		err := acl.Check(c.host, net.ParseIP(c.ip))
+		if (err == nil) != c.allow {
+			t.Errorf("%s(%s) allow should be %v, got %v", c.host, c.ip, c.allow, err)
+		}
+	}
+
+	var none *ACL
+	if err := none.Check("www.example.com", net.ParseIP("127.0.0.1")); err != nil {
+		t.Errorf("nil acl should allow all, got %v", err)
+	}
+	for _, rule := range []string{"", "*", "a/b", "*.", "host:80"} {
+		if _, err := NewACL([]string{rule}, nil); err == nil {
+			t.Errorf("rule %q should be invalid", rule)
+		}
+	}
+}
+
+func TestACLDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen fail %v", err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	acl, _ := NewACL(nil, []string{"127.0.0.0/8"})
+	//the name is fine, the ip it resolves to is not
+	if _, err := acl.DialContext(context.Background(), "tcp", net.JoinHostPort("localhost", port)); err == nil {
+		t.Error("dial localhost should be denied")
+	}
+
+	server, _ := NewTunnelServer("inproc://test-acl")
+	server.SetACL(acl)
+	go server.Run()
+	defer server.Close()
+	tc, _ := NewTunnelClient("inproc://test-acl")
+	go tc.Run()
+	defer tc.Close()
+	if conn, err := tc.ConnectTcp(ln.Addr().String()); err == nil {
+		conn.Close()
+		t.Error("connect through the tunnel should be denied")
+	}
+	workers := server.tcpWorker.(*MultiStreamWorker)
+	for wait := 0; wait < 100 && workers.Len() > 0; wait++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if workers.Len() != 0 {
+		t.Errorf("denied stream should end its worker, got %d", workers.Len())
+	}
+}
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestACLWrapsDialer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen fail %v", err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	dials := 0
+	dial := func(ctx context.Context, network string, address string) (net.Conn, error) {
+		dials += 1
+		return new(net.Dialer).DialContext(ctx, network, address)
+	}
+	transport := new(http.Transport)
+	server, _ := NewServer("inproc://test-acl-dialer", WithDialer(dial), WithTransport(transport))
+	defer server.Close()
+
+	//the name is fine, the ip the dialer connected to is not
+	acl, _ := NewACL(nil, []string{"127.0.0.0/8"})
+	if err := server.SetACL(acl); err != nil {
+		t.Fatalf("SetACL fail %v", err)
+	}
+	if _, err := server.tcpFactory.dial(context.Background(), "tcp", net.JoinHostPort("localhost", port)); err == nil {
+		t.Error("dial localhost should be denied")
+	}
+	if dials != 1 {
+		t.Errorf("the dialer of WithDialer should be used, got %d dials", dials)
+	}
+	if ht, ok := server.httpFactory.ht.(*http.Transport); !ok || ht == transport || ht.DialContext == nil {
+		t.Error("the transport should be copied with its dialer checked")
+	}
+	if transport.DialContext != nil {
+		t.Error("the transport of WithTransport should be left as it is")
+	}
+
+	server.SetACL(nil)
+	conn, err := server.tcpFactory.dial(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial without acl fail %v", err)
+	}
+	conn.Close()
+	if dials != 2 || server.httpFactory.ht != transport {
+		t.Error("SetACL(nil) should go back to what the options set")
+	}
+}
+
+func TestACLTransport(t *testing.T) {
+	var sent []string
+	transport := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		sent = append(sent, req.URL.Host)
+		return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+	})
+	acl, _ := NewACL(nil, []string{"127.0.0.0/8"})
+	server, _ := NewServer("inproc://test-acl-unchecked", WithTransport(transport))
+	defer server.Close()
+	if err := server.SetACL(acl); err != ErrorUncheckedTransport {
+		t.Errorf("a transport we can't check should be refused, got %v", err)
+	}
+
+	server, _ = NewServer("inproc://test-acl-transport", WithTransport(transport), WithBestEffortACL())
+	defer server.Close()
+	server.SetACL(acl)
+	//set again, it's not wrapped twice
+	server.SetACL(acl)
+	if ht, ok := server.httpFactory.ht.(*aclTransport); !ok || ht.next == nil {
+		t.Fatal("a transport of WithTransport should be wrapped by SetACL")
+	}
+
+	for url, allowed := range map[string]bool{
+		"http://localhost/":   false,
+		"http://127.0.0.1/":   false,
+		"http://10.0.0.1:80/": true,
+	} {
+		req, _ := http.NewRequest("GET", url, nil)
+		_, err := server.httpFactory.ht.RoundTrip(req)
+		if (err == nil) != allowed {
+			t.Errorf("request %s expect allowed %v, got %v", url, allowed, err)
+		}
+	}
+	if len(sent) != 1 || sent[0] != "10.0.0.1:80" {
+		t.Errorf("only the allowed request should be sent, got %v", sent)
+	}
+
+	server.SetACL(nil)
+	if _, ok := server.httpFactory.ht.(roundTripFunc); !ok {
+		t.Error("SetACL(nil) should unwrap the transport")
+	}
+}
+
+func TestExposeACLCheck(t *testing.T) {
+	acl, err := NewExposeACL([]string{":9000", "127.0.0.1:10000-10010", "*:0-0"})
+	if err != nil {
+		t.Fatalf("NewExposeACL fail %v", err)
+	}
+	for addr, allowed := range map[string]bool{
+		":9000":           true,
+		"0.0.0.0:9000":    true,
+		"[::]:9000":       true,
+		"127.0.0.1:9000":  false,
+		"127.0.0.1:10005": true,
+		"127.0.0.1:10011": false,
+		"localhost:10005": false,
+		"10.0.0.1:0":      true,
+		":22":             false,
+		"bad":             false,
+	} {
+		if err := acl.Check(addr); (err == nil) != allowed {
+			t.Errorf("check %s expect allowed %v, got %v", addr, allowed, err)
+		}
+	}
+	var none *ExposeACL
+	if none.Check(":9000") == nil {
+		t.Error("nil expose acl should deny all")
+	}
+	for _, rule := range []string{"9000", ":http", ":10-5", ":70000", "host:1-x"} {
+		if _, err := NewExposeACL([]string{rule}); err == nil {
+			t.Errorf("rule %q should be invalid", rule)
+		}
+	}
+}
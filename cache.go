@@ -4,9 +4,11 @@ import (
 	"crypto/md5"
 	"fmt"
 	"github.com/vmihailenco/msgpack"
-	"log"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Cache interface {
@@ -17,24 +19,29 @@ type Cache interface {
 	Digest(data []byte) []byte
 }
 
+// SharableCache can list what it holds, so we can announce them to the peer
+type SharableCache interface {
+	Items() []CacheItem
+}
+
 type LocalCache struct {
-	store map[string][]byte
+	store *shardedStore
 }
 
 func (c *LocalCache) Set(key []byte, value []byte) error {
-	log.Printf("set local cache %x data len %d digest %x", key, len(value), c.Digest(value))
-	c.store[string(key)] = value
+	logger.Printf("set local cache %x data len %d digest %x", key, len(value), c.Digest(value))
+	c.store.set(string(key), value)
 	return nil
 }
 
 func (c *LocalCache) Get(key []byte) (value []byte, ok bool) {
-	value, ok = c.store[string(key)]
+	value, ok = c.store.get(string(key))
 	return
 }
 
 func (c *LocalCache) GetDigest(key []byte) (digest []byte, ok bool) {
 	var value []byte
-	value, ok = c.store[string(key)]
+	value, ok = c.store.get(string(key))
 	if ok {
 		digest = c.Digest(value)
 	}
@@ -42,12 +49,14 @@ func (c *LocalCache) GetDigest(key []byte) (digest []byte, ok bool) {
 }
 
 func (c *LocalCache) Del(key []byte) bool {
-	_, ok := c.store[string(key)]
-	delete(c.store, string(key))
-	return ok
+	return c.store.del(string(key))
 }
 
 func (c *LocalCache) Digest(data []byte) []byte {
+	return md5Digest(data)
+}
+
+func md5Digest(data []byte) []byte {
 	h := md5.New()
 	h.Write(data)
 	digest := h.Sum(nil)
@@ -60,24 +69,126 @@ func makeCacheKey(req *http.Request) []byte {
 }
 
 func makeCache() Cache {
-	return &LocalCache{make(map[string][]byte)}
+	return NewLRUCache(DEFAULT_CACHE_BYTES, DEFAULT_CACHE_ENTRIES)
+}
+
+func newLocalCache() *LocalCache {
+	return &LocalCache{newShardedStore()}
 }
 
 //handle cache update
 type PeerCache struct {
-	store map[string][]byte
+	store *shardedStore
+	//unix nano, read and written atomically
+	lastSeen int64
+	//guards the fields below, what the peer agreed on in the handshake
+	mu    sync.RWMutex
+	diffs []uint16
+	//payload compression the peer agreed on
+	compression  uint16
+	maxFrameSize int
+	clientId     string
+	//per stream flow control window, zero if the peer doesn't do it
+	window        int
+	joinFragments bool
+}
+
+// SetHello keeps what the peer agreed on in the handshake
+func (rc *PeerCache) SetHello(agreed *HelloData) {
+	rc.mu.Lock()
+	rc.diffs = agreed.Diffs
+	rc.compression = preferCompression(agreed.Compressions)
+	rc.maxFrameSize = agreed.MaxFrameSize
+	rc.clientId = agreed.ClientId
+	rc.window = agreed.Window
+	rc.joinFragments = agreed.JoinFragments
+	rc.mu.Unlock()
+}
+
+func (rc *PeerCache) MaxFrameSize() int {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	if rc.maxFrameSize <= 0 {
+		return MAX_FRAME_SIZE
+	}
+	return rc.maxFrameSize
+}
+
+func (rc *PeerCache) Window() int {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	return rc.window
+}
+
+func (rc *PeerCache) JoinFragments() bool {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	return rc.joinFragments
+}
+
+func (rc *PeerCache) ClientId() string {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	return rc.clientId
+}
+
+func (rc *PeerCache) SetDiffs(diffs []uint16) {
+	rc.mu.Lock()
+	rc.diffs = diffs
+	rc.mu.Unlock()
+}
+
+// Diffs returns the diff encodings the peer can decode,
+// peers which never said hello only know bsdiff
+func (rc *PeerCache) Diffs() []uint16 {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	if rc.diffs == nil {
+		return []uint16{CT_CACHE_DIFF}
+	}
+	return rc.diffs
+}
+
+func (rc *PeerCache) SetCompression(ct uint16) {
+	rc.mu.Lock()
+	rc.compression = ct
+	rc.mu.Unlock()
+}
+
+func (rc *PeerCache) Compression() uint16 {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	return rc.compression
+}
+
+func (rc *PeerCache) touch() {
+	atomic.StoreInt64(&rc.lastSeen, time.Now().UnixNano())
+}
+
+func (rc *PeerCache) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&rc.lastSeen)))
 }
 
 func (rc *PeerCache) Set(key []byte, digest []byte) error {
-	rc.store[fmt.Sprintf("%x", key)] = digest
+	rc.store.set(fmt.Sprintf("%x", key), digest)
 	return nil
 }
 
 func (rc *PeerCache) Get(key []byte) (digest []byte, ok bool) {
-	digest, ok = rc.store[fmt.Sprintf("%x", key)]
+	digest, ok = rc.store.get(fmt.Sprintf("%x", key))
 	return
 }
 
+func (rc *PeerCache) Del(key []byte) {
+	rc.store.del(fmt.Sprintf("%x", key))
+}
+
+func newPeerCache() *PeerCache {
+	pc := &PeerCache{store: newShardedStore()}
+	pc.touch()
+	return pc
+}
+
 type CacheShareData struct {
 	Payload []CacheItem
 }
@@ -106,18 +217,38 @@ type CacheItem struct {
 }
 
 type CacheManager struct {
-	local Cache
-	peers map[string]*PeerCache
+	local   Cache
+	peersMu sync.RWMutex
+	peers   map[string]*PeerCache
+	//called when local cache drop a key, so we can tell the peer
+	OnEvict func(key []byte)
+	//called when a peer is expired for being idle too long
+	OnExpire func(pid string)
+}
+
+func (cm *CacheManager) SetLocal(local Cache) {
+	cm.local = local
+	if n, ok := local.(EvictNotifier); ok {
+		n.NotifyEvict(cm.evicted)
+	}
+}
+
+func (cm *CacheManager) evicted(key []byte) {
+	if cm.OnEvict != nil {
+		cm.OnEvict(key)
+	}
 }
 
 func (cm *CacheManager) GetPeer(pid string) (peer *PeerCache, ok bool) {
+	cm.peersMu.RLock()
 	peer, ok = cm.peers[pid]
+	cm.peersMu.RUnlock()
 	return
 }
 
 func (cm *CacheManager) GetPeerDigest(pid string, key []byte) (digest []byte, ok bool) {
 	var peer *PeerCache
-	peer, ok = cm.peers[pid]
+	peer, ok = cm.GetPeer(pid)
 	if !ok {
 		return
 	}
@@ -125,18 +256,116 @@ func (cm *CacheManager) GetPeerDigest(pid string, key []byte) (digest []byte, ok
 	return
 }
 
-func (cm *CacheManager) UpdatePeer(pid string, item *CacheItem) error {
-	pc, ok := cm.peers[pid]
+func (cm *CacheManager) getOrAddPeer(pid string) *PeerCache {
+	pc, ok := cm.GetPeer(pid)
+	if ok {
+		return pc
+	}
+	cm.peersMu.Lock()
+	defer cm.peersMu.Unlock()
+	pc, ok = cm.peers[pid]
 	if !ok {
-		pc = &PeerCache{make(map[string][]byte)}
+		pc = newPeerCache()
 		cm.peers[pid] = pc
 	}
+	return pc
+}
+
+func (cm *CacheManager) SetPeerDiffs(pid string, diffs []uint16) {
+	cm.getOrAddPeer(pid).SetDiffs(diffs)
+}
+
+func (cm *CacheManager) GetPeerDiffs(pid string) []uint16 {
+	if pc, ok := cm.GetPeer(pid); ok {
+		return pc.Diffs()
+	}
+	return []uint16{CT_CACHE_DIFF}
+}
+
+func (cm *CacheManager) SetPeerHello(pid string, agreed *HelloData) {
+	cm.getOrAddPeer(pid).SetHello(agreed)
+}
+
+func (cm *CacheManager) GetPeerMaxFrameSize(pid string) int {
+	if pc, ok := cm.GetPeer(pid); ok {
+		return pc.MaxFrameSize()
+	}
+	return MAX_FRAME_SIZE
+}
+
+// GetPeerWindow returns 0 for peers without flow control
+func (cm *CacheManager) GetPeerWindow(pid string) int {
+	if pc, ok := cm.GetPeer(pid); ok {
+		return pc.Window()
+	}
+	return 0
+}
+
+// GetPeerJoinFragments tells if the peer can join FLAG_MORE fragments
+func (cm *CacheManager) GetPeerJoinFragments(pid string) bool {
+	if pc, ok := cm.GetPeer(pid); ok {
+		return pc.JoinFragments()
+	}
+	return false
+}
+
+func (cm *CacheManager) SetPeerCompression(pid string, ct uint16) {
+	cm.getOrAddPeer(pid).SetCompression(ct)
+}
+
+// GetPeerCompression returns CT_RAW for peers which never said hello
+func (cm *CacheManager) GetPeerCompression(pid string) uint16 {
+	if pc, ok := cm.GetPeer(pid); ok {
+		return pc.Compression()
+	}
+	return CT_RAW
+}
+
+// TouchPeer mark the peer as alive, so its state won't expire
+func (cm *CacheManager) TouchPeer(pid string) {
+	if pc, ok := cm.GetPeer(pid); ok {
+		pc.touch()
+	}
+}
+
+func (cm *CacheManager) RemovePeer(pid string) {
+	cm.peersMu.Lock()
+	delete(cm.peers, pid)
+	cm.peersMu.Unlock()
+}
+
+// ExpirePeers drop state of peers not seen for idle, returns the removed peer ids
+func (cm *CacheManager) ExpirePeers(idle time.Duration) (expired []string) {
+	cm.peersMu.Lock()
+	defer cm.peersMu.Unlock()
+	for pid, pc := range cm.peers {
+		if pc.idle() > idle {
+			delete(cm.peers, pid)
+			expired = append(expired, pid)
+		}
+	}
+	return
+}
+
+func (cm *CacheManager) UpdatePeer(pid string, item *CacheItem) error {
+	pc := cm.getOrAddPeer(pid)
+	pc.touch()
+	//empty digest means the peer has dropped the key
+	if len(item.Digest) == 0 {
+		pc.Del(item.CacheKey)
+		return nil
+	}
 	return pc.Set(item.CacheKey, item.Digest)
 }
 
+const (
+	PEER_IDLE_TIMEOUT = 10 * time.Minute
+)
+
 type CacheWorker struct {
-	cm      *CacheManager
-	reqChan chan *Msg
+	cm          *CacheManager
+	reqChan     chan *Msg
+	idleTimeout time.Duration
 }
 
 func (w *CacheWorker) GetReqChannel() chan *Msg {
@@ -144,16 +373,30 @@ func (w *CacheWorker) GetReqChannel() chan *Msg {
 }
 
 func (w *CacheWorker) Run(repChan chan *Msg) error {
-	for msg := range w.reqChan {
-		w.updatePeer(msg)
+	ticker := time.NewTicker(w.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg, ok := <-w.reqChan:
+			if !ok {
+				return nil
+			}
+			w.updatePeer(msg)
+		case <-ticker.C:
+			for _, pid := range w.cm.ExpirePeers(w.idleTimeout) {
+				logger.Printf("expire idle peer cache %s", pid)
+				if w.cm.OnExpire != nil {
+					w.cm.OnExpire(pid)
+				}
+			}
+		}
 	}
-	return nil
 }
 
 func (w *CacheWorker) updatePeer(msg *Msg) error {
-	id := "global"
+	id := msg.GetPeerId()
 	cd := msg.Body.(*CacheShareData)
-	log.Printf("update peer cache:%v", cd)
+	logger.Printf("update peer %s cache:%v", id, cd)
 	for _, item := range cd.Payload {
 		err := w.cm.UpdatePeer(id, &item)
 		if err != nil {
@@ -164,12 +407,15 @@ func (w *CacheWorker) updatePeer(msg *Msg) error {
 }
 
 func makeCacheManager() *CacheManager {
-	return &CacheManager{
-		local: &LocalCache{make(map[string][]byte)},
-		peers: make(map[string]*PeerCache),
-	}
+	return NewCacheManager(makeCache())
+}
+
+func NewCacheManager(local Cache) *CacheManager {
+	cm := &CacheManager{peers: make(map[string]*PeerCache)}
+	cm.SetLocal(local)
+	return cm
 }
 
 func NewCacheWorker(cm *CacheManager) *CacheWorker {
-	return &CacheWorker{cm, make(chan *Msg)}
+	return &CacheWorker{cm, make(chan *Msg), PEER_IDLE_TIMEOUT}
 }
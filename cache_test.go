@@ -1,7 +1,11 @@
 package dtunnel
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
 	"reflect"
+	"sync"
 	"testing"
 )
 
@@ -29,3 +33,71 @@ func TestEncodeDecode(t *testing.T) {
 		t.Error("old msg & new msg should be equal")
 	}
 }
+
+//run with -race
+func hammerCache(t *testing.T, cache Cache) {
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				key := []byte(fmt.Sprintf("http://example.com/%d", j%10))
+				cache.Set(key, []byte(fmt.Sprintf("%d-%d", i, j)))
+				cache.Get(key)
+				cache.GetDigest(key)
+				if j%50 == 0 {
+					cache.Del(key)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestLocalCacheConcurrent(t *testing.T) {
+	hammerCache(t, newLocalCache())
+}
+
+func TestLRUCacheConcurrent(t *testing.T) {
+	hammerCache(t, NewLRUCache(100, 5))
+}
+
+func TestDiskCacheConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dtunnel-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache, _ := NewDiskCache(dir, 0, 5)
+	hammerCache(t, cache)
+}
+
+func TestCacheManagerConcurrent(t *testing.T) {
+	cm := makeCacheManager()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			pid := fmt.Sprintf("peer-%d", i%4)
+			for j := 0; j < 200; j++ {
+				key := []byte(fmt.Sprintf("http://example.com/%d", j%10))
+				cm.UpdatePeer(pid, &CacheItem{key, []byte(fmt.Sprintf("%d", j))})
+				cm.GetPeerDigest(pid, key)
+				cm.local.Set(key, []byte("hello"))
+				cm.local.GetDigest(key)
+				if j%50 == 0 {
+					cm.UpdatePeer(pid, &CacheItem{key, nil})
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 4; i++ {
+		if _, ok := cm.GetPeer(fmt.Sprintf("peer-%d", i)); !ok {
+			t.Errorf("peer-%d should exists", i)
+		}
+	}
+}
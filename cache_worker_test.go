@@ -6,10 +6,17 @@ import (
 	"time"
 )
 
+func makeCacheShareFrom(peer string, items []CacheItem) *Msg {
+	return &Msg{
+		Envelope: [][]byte{[]byte(peer), []byte("")},
+		Header:   &Header{Version: VERSION_1, MsgType: CACHE_SHARE},
+		Body:     &CacheShareData{Payload: items},
+	}
+}
+
 func TestCacheWorker(t *testing.T) {
 	repChan := make(chan *Msg)
 
-	id := "global"
 	cm := makeCacheManager()
 	worker := NewCacheWorker(cm)
 
@@ -18,10 +25,8 @@ func TestCacheWorker(t *testing.T) {
 		CacheItem{[]byte("http://httpbin.org"), []byte("456")},
 	}
 
-	msg := &Msg{
-		Header: &Header{Version: VERSION_1, MsgType: CACHE_SHARE},
-		Body:   &CacheShareData{Payload: cacheItems},
-	}
+	msg := makeCacheShareFrom("client-1", cacheItems)
+	id := msg.GetPeerId()
 
 	go worker.Run(repChan)
 
@@ -35,7 +40,35 @@ func TestCacheWorker(t *testing.T) {
 	for _, item := range cacheItems {
 		v, ok := peer.Get(item.CacheKey)
 		if !ok || !bytes.Equal(v, item.Digest) {
-			t.Errorf("cache digest not match ok %b , got %x  expected %x", ok, v, item.Digest)
+			t.Errorf("cache digest not match ok %t , got %x  expected %x", ok, v, item.Digest)
 		}
 	}
 }
+
+func TestCacheWorkerPeerIsolation(t *testing.T) {
+	cm := makeCacheManager()
+	worker := &CacheWorker{cm, make(chan *Msg), 100 * time.Millisecond}
+	go worker.Run(nil)
+
+	key := []byte("http://example.com")
+	msg1 := makeCacheShareFrom("client-1", []CacheItem{CacheItem{key, []byte("123")}})
+	msg2 := makeCacheShareFrom("client-2", []CacheItem{CacheItem{key, []byte("456")}})
+	worker.GetReqChannel() <- msg1
+	worker.GetReqChannel() <- msg2
+	//client-2 drop the key
+	worker.GetReqChannel() <- makeCacheShareFrom("client-2", []CacheItem{CacheItem{key, nil}})
+	time.Sleep(10 * time.Millisecond)
+
+	if v, ok := cm.GetPeerDigest(msg1.GetPeerId(), key); !ok || !bytes.Equal(v, []byte("123")) {
+		t.Errorf("client-1 digest not match, got %x", v)
+	}
+	if v, ok := cm.GetPeerDigest(msg2.GetPeerId(), key); ok {
+		t.Errorf("client-2 digest should be removed, got %x", v)
+	}
+
+	//both peers go idle
+	time.Sleep(300 * time.Millisecond)
+	if _, ok := cm.GetPeer(msg1.GetPeerId()); ok {
+		t.Error("idle peer should expire")
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	dtunnel "github.com/ftao/diff-tunnel"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config of the client and the server, the flags fill it in and a
+// --config file overrides them
+type config struct {
+	Http  string `json:"http"`
+	Socks string `json:"socks"`
+	//user to password, no auth if empty
+	SocksAuth map[string]string `json:"socks_auth"`
+	Tunnel    string            `json:"tunnel"`
+	Backends  []string          `json:"backends"`
+	Balance   string            `json:"balance"`
+	ClientId  string            `json:"client_id"`
+	//public address on the server to the local service
+	Expose map[string]string `json:"expose"`
+	//where the server lets clients expose services, see dtunnel.ExposeACL
+	ExposeAllow []string `json:"expose_allow"`
+	//local address to the remote one
+	Forward        map[string]string `json:"forward"`
+	Keys           keysConfig        `json:"keys"`
+	Cache          cacheConfig       `json:"cache"`
+	Timeout        duration          `json:"timeout"`
+	UdpIdleTimeout duration          `json:"udp_idle_timeout"`
+	GracePeriod    duration          `json:"grace_period"`
+	HttpStream     httpStreamConfig  `json:"http_stream"`
+	ACL            aclConfig         `json:"acl"`
+	Log            logConfig         `json:"log"`
+	//listen address of the metrics endpoint, none if empty
+	Metrics string `json:"metrics"`
+}
+
+// keysConfig names the key pairs made by genkey, NAME.pub and NAME.key
+type keysConfig struct {
+	Client string `json:"client"`
+	Server string `json:"server"`
+	//set in the config file, so the keys have to exist
+	required bool
+}
+
+type cacheConfig struct {
+	Type       string `json:"type"`
+	Dir        string `json:"dir"`
+	MaxBytes   int    `json:"max_bytes"`
+	MaxEntries int    `json:"max_entries"`
+}
+
+// httpStreamConfig is dtunnel.HttpConfig, zero takes the default
+type httpStreamConfig struct {
+	MaxCacheSize int      `json:"max_cache_size"`
+	MaxBuffSize  int      `json:"max_buff_size"`
+	MaxDelay     duration `json:"max_delay"`
+	FlushDelay   duration `json:"flush_delay"`
+}
+
+// aclConfig lists the destinations the server connects to for clients,
+// see dtunnel.ACL. Exposed services are not covered, see ExposeAllow
+type aclConfig struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+type logConfig struct {
+	//append to it instead of stderr
+	File string `json:"file"`
+}
+
+// duration is "1m30s" or a number of seconds
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var seconds float64
+	if err := json.Unmarshal(data, &seconds); err == nil {
+		*d = duration(seconds * float64(time.Second))
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration should be a string like \"30s\" or seconds, got %s", data)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) value() time.Duration {
+	return time.Duration(d)
+}
+
+// configFromArgs fills a config from the flags, their defaults included
+func configFromArgs(args map[string]interface{}) (*config, error) {
+	c := &config{
+		Http:     args["--http"].(string),
+		Tunnel:   args["--tunnel"].(string),
+		Backends: strings.Split(args["--backend"].(string), ","),
+		Balance:  args["--balance"].(string),
+		Keys:     keysConfig{Client: "client", Server: "server"},
+		Cache: cacheConfig{
+			Type: args["--cache"].(string),
+			Dir:  args["--cache-dir"].(string),
+		},
+		UdpIdleTimeout: duration(dtunnel.UDP_IDLE_TIMEOUT),
+	}
+	if socks, ok := args["--socks"].(string); ok {
+		c.Socks = socks
+	}
+	if auth, ok := args["--socks-auth"].(string); ok {
+		c.SocksAuth = make(map[string]string)
+		for _, user := range strings.Split(auth, ",") {
+			parts := strings.SplitN(strings.TrimSpace(user), ":", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid --socks-auth: %s", user)
+			}
+			c.SocksAuth[parts[0]] = parts[1]
+		}
+	}
+	if metrics, ok := args["--metrics"].(string); ok {
+		c.Metrics = metrics
+	}
+	if id, ok := args["--client-id"].(string); ok {
+		c.ClientId = id
+	}
+	if expose, ok := args["--expose"].(string); ok {
+		c.Expose = make(map[string]string)
+		for _, service := range strings.Split(expose, ",") {
+			parts := strings.SplitN(strings.TrimSpace(service), "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid --expose: %s", service)
+			}
+			c.Expose[parts[0]] = parts[1]
+		}
+	}
+	if allow, ok := args["--expose-allow"].(string); ok {
+		c.ExposeAllow = strings.Split(allow, ",")
+	}
+	if forwards, ok := args["FORWARD"].([]string); ok && len(forwards) > 0 {
+		c.Forward = make(map[string]string)
+		for _, f := range forwards {
+			parts := strings.SplitN(f, "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid forward: %s", f)
+			}
+			c.Forward[parts[0]] = parts[1]
+		}
+	}
+	var err error
+	if c.Cache.MaxBytes, err = strconv.Atoi(args["--cache-size"].(string)); err != nil {
+		return nil, fmt.Errorf("invalid --cache-size: %s", err)
+	}
+	if c.Cache.MaxEntries, err = strconv.Atoi(args["--cache-entries"].(string)); err != nil {
+		return nil, fmt.Errorf("invalid --cache-entries: %s", err)
+	}
+	seconds, err := strconv.Atoi(args["--timeout"].(string))
+	if err != nil {
+		return nil, fmt.Errorf("invalid --timeout: %s", args["--timeout"])
+	}
+	c.Timeout = duration(time.Duration(seconds) * time.Second)
+	seconds, err = strconv.Atoi(args["--grace-period"].(string))
+	if err != nil {
+		return nil, fmt.Errorf("invalid --grace-period: %s", args["--grace-period"])
+	}
+	c.GracePeriod = duration(time.Duration(seconds) * time.Second)
+	return c, nil
+}
+
+// loadFile overrides the config with what the file sets
+func (c *config) loadFile(name string) error {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	keys := c.Keys
+	c.Keys = keysConfig{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	c.Keys.required = c.Keys.Client != "" || c.Keys.Server != ""
+	if c.Keys.Client == "" {
+		c.Keys.Client = keys.Client
+	}
+	if c.Keys.Server == "" {
+		c.Keys.Server = keys.Server
+	}
+	return nil
+}
+
+// validate checks the config before anything starts
+func (c *config) validate() error {
+	backends := c.Backends[:0]
+	for _, addr := range c.Backends {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			backends = append(backends, addr)
+		}
+	}
+	c.Backends = backends
+	switch {
+	case c.Http == "":
+		return fmt.Errorf("http: listen address is empty")
+	case c.Tunnel == "":
+		return fmt.Errorf("tunnel: listen address is empty")
+	case len(c.Backends) == 0:
+		return fmt.Errorf("backends: no backend")
+	case c.Timeout <= 0:
+		return fmt.Errorf("timeout: should be positive, got %s", c.Timeout.value())
+	case c.UdpIdleTimeout <= 0:
+		return fmt.Errorf("udp_idle_timeout: should be positive, got %s", c.UdpIdleTimeout.value())
+	case c.GracePeriod < 0:
+		return fmt.Errorf("grace_period: should not be negative, got %s", c.GracePeriod.value())
+	case c.Cache.MaxBytes < 0:
+		return fmt.Errorf("cache.max_bytes: should not be negative, got %d", c.Cache.MaxBytes)
+	case c.Cache.MaxEntries < 0:
+		return fmt.Errorf("cache.max_entries: should not be negative, got %d", c.Cache.MaxEntries)
+	case c.HttpStream.MaxCacheSize < 0:
+		return fmt.Errorf("http_stream.max_cache_size: should not be negative, got %d", c.HttpStream.MaxCacheSize)
+	case c.HttpStream.MaxBuffSize < 0:
+		return fmt.Errorf("http_stream.max_buff_size: should not be negative, got %d", c.HttpStream.MaxBuffSize)
+	case c.HttpStream.MaxDelay < 0:
+		return fmt.Errorf("http_stream.max_delay: should not be negative, got %s", c.HttpStream.MaxDelay.value())
+	case c.HttpStream.FlushDelay < 0:
+		return fmt.Errorf("http_stream.flush_delay: should not be negative, got %s", c.HttpStream.FlushDelay.value())
+	}
+	switch c.Balance {
+	case dtunnel.BALANCE_CACHE_KEY, dtunnel.BALANCE_ROUND_ROBIN, dtunnel.BALANCE_LEAST_STREAMS:
+	default:
+		return fmt.Errorf("balance: unknown policy %q", c.Balance)
+	}
+	switch c.Cache.Type {
+	case "", "lru", "memory":
+	case "disk":
+		if c.Cache.Dir == "" {
+			return fmt.Errorf("cache.dir: disk cache needs a directory")
+		}
+	default:
+		return fmt.Errorf("cache.type: unknown cache %q", c.Cache.Type)
+	}
+	for user := range c.SocksAuth {
+		if user == "" {
+			return fmt.Errorf("socks_auth: user name is empty")
+		}
+	}
+	for public, local := range c.Expose {
+		if public == "" || local == "" {
+			return fmt.Errorf("expose: invalid %q=%q", public, local)
+		}
+	}
+	for local, remote := range c.Forward {
+		if local == "" || remote == "" {
+			return fmt.Errorf("forward: invalid %q=%q", local, remote)
+		}
+	}
+	if _, err := c.acl(); err != nil {
+		return fmt.Errorf("acl: %s", err)
+	}
+	if _, err := c.exposeACL(); err != nil {
+		return fmt.Errorf("expose_allow: %s", err)
+	}
+	return nil
+}
+
+// loadConfig makes the config from the flags and the --config file,
+// exits if it's not valid
+func loadConfig(args map[string]interface{}) *config {
+	c, err := configFromArgs(args)
+	if err == nil {
+		if name, ok := args["--config"].(string); ok {
+			err = c.loadFile(name)
+		}
+	}
+	if err == nil {
+		err = c.validate()
+	}
+	if err != nil {
+		log.Fatalf("invalid config: %s", err)
+	}
+	if c.Log.File != "" {
+		f, err := os.OpenFile(c.Log.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatalf("invalid config: log.file: %s", err)
+		}
+		log.SetOutput(f)
+	}
+	return c
+}
+
+// keyPair loads NAME.pub and NAME.key of a peer, we only need the secret of
+// our own. Without keys the tunnel is not encrypted, unless the config file
+// names them
+func (c *config) keyPair(name string, own bool) (string, string) {
+	pub, secret, err := loadKeyPair(name)
+	if err != nil && c.Keys.required && (own || pub == "") {
+		log.Fatalf("invalid config: keys: %s", err)
+	}
+	return pub, secret
+}
+
+func (c *config) backends() []string {
+	backends := make([]string, 0, len(c.Backends))
+	for _, addr := range c.Backends {
+		backends = append(backends, makeZmqStyleAddr(addr))
+	}
+	return backends
+}
+
+func (c *config) httpConfig() dtunnel.HttpConfig {
+	return dtunnel.HttpConfig{
+		MaxCacheSize: c.HttpStream.MaxCacheSize,
+		MaxBuffSize:  c.HttpStream.MaxBuffSize,
+		MaxDelay:     c.HttpStream.MaxDelay.value(),
+		FlushDelay:   c.HttpStream.FlushDelay.value(),
+	}
+}
+
+// acl is nil if there are no rules
+func (c *config) acl() (*dtunnel.ACL, error) {
+	if len(c.ACL.Allow) == 0 && len(c.ACL.Deny) == 0 {
+		return nil, nil
+	}
+	return dtunnel.NewACL(c.ACL.Allow, c.ACL.Deny)
+}
+
+// exposeACL is nil if there are no rules, reverse mode is off then
+func (c *config) exposeACL() (*dtunnel.ExposeACL, error) {
+	if len(c.ExposeAllow) == 0 {
+		return nil, nil
+	}
+	return dtunnel.NewExposeACL(c.ExposeAllow)
+}
+
+func (c *config) makeCache(name string) dtunnel.Cache {
+	cache, err := dtunnel.NewCache(&dtunnel.CacheConfig{
+		Type:       c.Cache.Type,
+		Dir:        filepath.Join(c.Cache.Dir, name),
+		MaxBytes:   c.Cache.MaxBytes,
+		MaxEntries: c.Cache.MaxEntries,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return cache
+}
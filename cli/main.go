@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
 	"github.com/docopt/docopt-go"
 	dtunnel "github.com/ftao/diff-tunnel"
 	zmq "github.com/pebbe/zmq4"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 )
 
 func makeZmqStyleAddr(addr string) string {
@@ -21,6 +25,56 @@ func makeZmqStyleAddr(addr string) string {
 	}
 }
 
+// exposeServices exposes local services by the public address on the server
+func exposeServices(tc *dtunnel.TunnelPool, services map[string]string) {
+	for public, local := range services {
+		addrs, err := tc.Expose(public, local)
+		if err != nil {
+			log.Fatalf("fail to expose %s: %s", local, err)
+		}
+		log.Printf("%s is exposed on %s", local, strings.Join(addrs, ", "))
+	}
+}
+
+// serveSocks runs a SOCKS5 proxy, no auth if users is empty
+func serveSocks(tc *dtunnel.TunnelPool, listen string, users map[string]string) *dtunnel.SocksProxyServer {
+	s := dtunnel.NewSocksProxyServer(tc)
+	for user, password := range users {
+		s.SetAuth(user, password)
+	}
+	go func() {
+		if err := s.ListenAndServe(listen); err != nil {
+			log.Fatal(err)
+		}
+	}()
+	return s
+}
+
+// serveMetrics serves the metrics on /metrics of listen, if it's set
+func serveMetrics(listen string) {
+	if listen == "" {
+		return
+	}
+	go func() {
+		if err := dtunnel.ListenAndServeMetrics(listen); err != nil {
+			log.Fatalf("fail to serve metrics on %s: %s", listen, err)
+		}
+	}()
+}
+
+// signalContext is done on SIGINT or SIGTERM, a second one exits at once
+func signalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		log.Printf("got %s, shutting down", <-sigs)
+		cancel()
+		log.Fatalf("got %s again, exit", <-sigs)
+	}()
+	return ctx
+}
+
 func loadKeyPair(name string) (pub string, secret string, err error) {
 	var data []byte
 	data, err = ioutil.ReadFile(name + ".pub")
@@ -36,33 +90,147 @@ func loadKeyPair(name string) (pub string, secret string, err error) {
 	return
 }
 
-func serverMain(bind string, pub string, secret string) {
-	ts, _ := dtunnel.NewTunnelServerKeyPair(bind, pub, secret)
-	log.Fatal(ts.Run())
+// serverMain runs the server till ctx is done and its streams are drained
+func serverMain(ctx context.Context, bind string, pub string, secret string, cache dtunnel.Cache, c *config) {
+	ts, err := dtunnel.NewTunnelServerKeyPair(bind, pub, secret)
+	if err != nil {
+		log.Fatalf("fail to listen on %s: %s", bind, err)
+	}
+	ts.SetCache(cache)
+	ts.SetPeerTimeout(c.Timeout.value())
+	ts.SetUdpIdleTimeout(c.UdpIdleTimeout.value())
+	ts.SetHttpConfig(c.httpConfig())
+	acl, _ := c.acl()
+	if err := ts.SetACL(acl); err != nil {
+		log.Fatalf("fail to set acl: %s", err)
+	}
+	exposeACL, _ := c.exposeACL()
+	ts.SetExposeACL(exposeACL)
+	ts.SetGracePeriod(c.GracePeriod.value())
+	if err := ts.RunContext(ctx); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// startPool runs a pool of clients of the backends till ctx is done,
+// stopped is closed once their streams are drained
+func startPool(ctx context.Context, backends []string, balance string, serverPub string, pub string, secret string, cache dtunnel.Cache, c *config) (tc *dtunnel.TunnelPool, stopped chan struct{}) {
+	tc, err := dtunnel.NewTunnelPoolKeyPair(backends, serverPub, pub, secret)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := tc.SetBalance(balance); err != nil {
+		log.Fatal(err)
+	}
+	if cache != nil {
+		tc.SetCache(cache)
+	}
+	tc.SetHeartbeat(c.Timeout.value()/3, c.Timeout.value())
+	tc.SetGracePeriod(c.GracePeriod.value())
+	if c.ClientId != "" {
+		tc.SetClientId(c.ClientId)
+	}
+	stopped = make(chan struct{})
+	go func() {
+		if err := tc.RunContext(ctx); err != nil {
+			log.Fatal(err)
+		}
+		close(stopped)
+	}()
+	return tc, stopped
 }
 
-func clientMain(listen string, backend string, serverPub string, pub string, secret string) {
-	tc, _ := dtunnel.NewTunnelClientKeyPair(backend, serverPub, pub, secret)
-	go tc.Run()
+// startClientPool runs a pool of clients of the backend servers
+func startClientPool(ctx context.Context, c *config, cache dtunnel.Cache) (*dtunnel.TunnelPool, chan struct{}) {
+	pub, secret := c.keyPair(c.Keys.Client, true)
+	serverPub, _ := c.keyPair(c.Keys.Server, false)
+	return startPool(ctx, c.backends(), c.Balance, serverPub, pub, secret, cache, c)
+}
+
+// clientMain runs the proxies till ctx is done, then waits for the
+// requests in flight for the grace period
+func clientMain(ctx context.Context, tc *dtunnel.TunnelPool, c *config) {
+	if len(c.Expose) > 0 {
+		go exposeServices(tc, c.Expose)
+	}
+	var socks *dtunnel.SocksProxyServer
+	if c.Socks != "" {
+		socks = serveSocks(tc, c.Socks, c.SocksAuth)
+	}
 	s := dtunnel.NewHttpProxyServer(tc)
-	log.Fatal(s.ListenAndServe(listen))
+	go func() {
+		if err := s.ListenAndServe(c.Http); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	grace, cancel := context.WithTimeout(context.Background(), c.GracePeriod.value())
+	defer cancel()
+	s.Shutdown(grace)
+	if socks != nil {
+		socks.Shutdown(grace)
+	}
+}
+
+// forwardMain forwards local addresses to remote ones till ctx is done
+func forwardMain(ctx context.Context, tc *dtunnel.TunnelPool, forwards map[string]string) {
+	listeners := make([]net.Listener, 0, len(forwards))
+	for local, remote := range forwards {
+		ln, err := tc.Forward(local, remote)
+		if err != nil {
+			log.Fatalf("fail to forward %s: %s", local, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	<-ctx.Done()
+	for _, ln := range listeners {
+		ln.Close()
+	}
 }
 
 func main() {
 	usage := `diff-tunnel
 
 Usage:
-  diff-tunnel client [--http <HTTP_LISTEN>] [--backend <BACKEND>]
-  diff-tunnel server [--tunnel <LISTEN>]
-  diff-tunnel proxy  [--http <HTTP_LISTEN>]
+  diff-tunnel client [--http <HTTP_LISTEN>] [--socks <SOCKS_LISTEN>] [--backend <BACKEND>] [options]
+  diff-tunnel forward [--backend <BACKEND>] [options] [FORWARD...]
+  diff-tunnel server [--tunnel <LISTEN>] [options]
+  diff-tunnel proxy  [--http <HTTP_LISTEN>] [--socks <SOCKS_LISTEN>] [options]
   diff-tunnel genkey NAME
   diff-tunnel -h | --help
   diff-tunnel --version
 
+Each FORWARD is LOCAL=REMOTE, e.g. 127.0.0.1:5432=db.internal:5432, conns to
+LOCAL go to REMOTE through the tunnel.
+
+The --config file is JSON, what it sets overrides the flags, e.g.
+  {"backends": ["10.0.0.1:8081"], "timeout": "30s",
+   "keys": {"client": "/etc/diff-tunnel/client", "server": "/etc/diff-tunnel/server"},
+   "cache": {"type": "disk", "dir": "/var/cache/diff-tunnel"},
+   "http_stream": {"max_cache_size": 5242880, "max_delay": "2s"},
+   "acl": {"deny": ["127.0.0.0/8", "*.internal"]}, "expose_allow": [":9000-9100"],
+   "log": {"file": "diff-tunnel.log"}}
+Keys named there have to exist, otherwise client.pub, server.pub etc are used if present.
+
 Options:
-  --backend=<BACKEND>        Backend Tunnel Server Endpoint [default: 127.0.0.1:8081].
+  --config=<FILE>            JSON Config File.
+  --backend=<BACKEND>        Backend Tunnel Server Endpoints, Comma Separated [default: 127.0.0.1:8081].
+  --balance=<POLICY>         Spread Streams Over Backends, cache-key, round-robin or least-streams [default: cache-key].
   --http=<HTTP_LISTEN>       HTTP Proxy Listen Address [default: :8080].
+  --socks=<SOCKS_LISTEN>     SOCKS5 Proxy Listen Address, e.g. :1080.
+  --socks-auth=<USERS>       SOCKS5 Users, Comma Separated USER:PASSWORD, No Auth If Not Set.
   --tunnel=<TUNNEL_LISTEN>   Tunnel Listen Address [default: *:8081].
+  --cache=<TYPE>             Cache Store, lru, disk or memory [default: lru].
+  --cache-dir=<DIR>          Directory Of Disk Cache [default: cache].
+  --cache-size=<BYTES>       Max Bytes Of Cached Responses [default: 268435456].
+  --cache-entries=<N>        Max Number Of Cached Responses [default: 10000].
+  --expose=<SERVICES>        Expose Local Services On The Server, Comma Separated PUBLIC=LOCAL, e.g. :9000=localhost:3000.
+  --expose-allow=<ADDRS>     Where Clients May Expose Services On The Server, Comma Separated HOST:PORT Or HOST:LOW-HIGH, e.g. :9000-9100.
+  --client-id=<ID>           Client Identity Sent To Server, Hostname And Pid If Not Set.
+  --timeout=<SECONDS>        Seconds Without Hearing From The Peer Before It Is Dead [default: 30].
+  --grace-period=<SECONDS>   Seconds For Streams In Flight To Finish On SIGINT Or SIGTERM [default: 10].
+  --metrics=<LISTEN>         Serve Metrics On http://LISTEN/metrics, e.g. 127.0.0.1:9090.
   -h --help                  Show this screen.
   --version                  Show version.`
 
@@ -79,25 +247,41 @@ Options:
 		ioutil.WriteFile(args["NAME"].(string)+".key", []byte(secret), os.ModePerm)
 		ioutil.WriteFile(args["NAME"].(string)+".pub", []byte(public), os.ModePerm)
 	case args["proxy"].(bool):
+		c := loadConfig(args)
+		serveMetrics(c.Metrics)
+		ctx := signalContext()
 		inprocAddr := "inproc://diff-tunnel"
-		go serverMain(inprocAddr, "", "")
-		clientMain(args["--http"].(string), inprocAddr, "", "", "")
+		served := make(chan struct{})
+		go func() {
+			serverMain(ctx, inprocAddr, "", "", c.makeCache("server"), c)
+			close(served)
+		}()
+		tc, stopped := startPool(ctx, []string{inprocAddr}, dtunnel.BALANCE_ROUND_ROBIN, "", "", "", c.makeCache("client"), c)
+		clientMain(ctx, tc, c)
+		<-stopped
+		<-served
 	case args["client"].(bool):
-		pub, secret, _ := loadKeyPair("client")
-		serverPub, _, _ := loadKeyPair("server")
-		clientMain(
-			args["--http"].(string),
-			makeZmqStyleAddr(args["--backend"].(string)),
-			serverPub,
-			pub,
-			secret,
-		)
+		c := loadConfig(args)
+		serveMetrics(c.Metrics)
+		ctx := signalContext()
+		tc, stopped := startClientPool(ctx, c, c.makeCache("client"))
+		clientMain(ctx, tc, c)
+		<-stopped
+	case args["forward"].(bool):
+		c := loadConfig(args)
+		serveMetrics(c.Metrics)
+		if len(c.Forward) == 0 {
+			log.Fatal("nothing to forward")
+		}
+		ctx := signalContext()
+		//plain tcp, nothing to cache
+		tc, stopped := startClientPool(ctx, c, nil)
+		forwardMain(ctx, tc, c.Forward)
+		<-stopped
 	case args["server"].(bool):
-		pub, secret, _ := loadKeyPair("server")
-		serverMain(
-			makeZmqStyleAddr(args["--tunnel"].(string)),
-			pub,
-			secret,
-		)
+		c := loadConfig(args)
+		serveMetrics(c.Metrics)
+		pub, secret := c.keyPair(c.Keys.Server, true)
+		serverMain(signalContext(), makeZmqStyleAddr(c.Tunnel), pub, secret, c.makeCache("server"), c)
 	}
 }
@@ -2,11 +2,12 @@ package dtunnel
 
 import (
 	"bufio"
+	"context"
 	"io"
-	"log"
 	"net"
 	"net/http"
 	"regexp"
+	"sync"
 )
 
 func copyHeaders(dst, src http.Header) {
@@ -28,13 +29,54 @@ type HttpTransport interface {
 	RoundTrip(r *http.Request) (io.ReadCloser, error)
 }
 
+// UdpTransport relays datagrams, each PacketConn is an association of its own.
+// Addrs it reads and writes are *net.UDPAddr, or host:port to be resolved
+type UdpTransport interface {
+	ListenUdp() (net.PacketConn, error)
+}
+
+// Transport is a TunnelClient, or a TunnelPool of them
+type Transport interface {
+	TcpTransport
+	HttpTransport
+}
+
 type HttpProxyServer struct {
 	ht HttpTransport
 	tt TcpTransport
+	//set by ListenAndServe, for Shutdown
+	mu     sync.Mutex
+	server *http.Server
+	closed bool
 }
 
+// ListenAndServe serves till Shutdown, then it returns nil
 func (s *HttpProxyServer) ListenAndServe(bind string) error {
-	return http.ListenAndServe(bind, s)
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.server = &http.Server{Addr: bind, Handler: s}
+	server := s.server
+	s.mu.Unlock()
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops listening and waits for the requests in flight till ctx
+// is done, tunnels of CONNECT are not waited for
+func (s *HttpProxyServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	server := s.server
+	s.mu.Unlock()
+	if server == nil {
+		return nil
+	}
+	return server.Shutdown(ctx)
 }
 
 func (s *HttpProxyServer) hijack(w http.ResponseWriter, r *http.Request) (net.Conn, string) {
@@ -59,24 +101,49 @@ func (s *HttpProxyServer) hijack(w http.ResponseWriter, r *http.Request) (net.Co
 func (s *HttpProxyServer) handleHttp(w http.ResponseWriter, r *http.Request) {
 	reader, err := s.ht.RoundTrip(r)
 	if err != nil {
-		log.Printf("error got response %v", err)
+		logger.Printf("error got response %v", err)
 		return
 	}
+	defer reader.Close()
+	stop := resetOnDone(r, reader)
+	defer stop()
 	resp, err := http.ReadResponse(bufio.NewReader(reader), r)
 	if err != nil {
-		log.Printf("error got response %v", err)
+		logger.Printf("error got response %v", err)
 		return
 	}
-	defer reader.Close()
 
 	copyHeaders(w.Header(), resp.Header)
 	w.WriteHeader(resp.StatusCode)
 	_, err = io.Copy(w, resp.Body)
 	if err != nil {
-		log.Printf("error copy to client %v", err)
+		logger.Printf("error copy to client %v", err)
+		if rs, ok := reader.(resetter); ok {
+			rs.Reset()
+		}
 	}
 	if err := resp.Body.Close(); err != nil {
-		log.Printf("Can't close response body %v", err)
+		logger.Printf("Can't close response body %v", err)
+	}
+}
+
+// abort the tunnel stream if the client goes away before we finish
+func resetOnDone(r *http.Request, reader io.Reader) (stop func()) {
+	rs, ok := reader.(resetter)
+	if !ok {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-r.Context().Done():
+			logger.Printf("client of %s is gone", r.URL)
+			rs.Reset()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
 	}
 }
 
@@ -99,6 +166,6 @@ func (s *HttpProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func NewHttpProxyServer(tc *TunnelClient) *HttpProxyServer {
-	return &HttpProxyServer{tc, tc}
+func NewHttpProxyServer(tc Transport) *HttpProxyServer {
+	return &HttpProxyServer{ht: tc, tt: tc}
 }
@@ -5,7 +5,7 @@ import (
 	"errors"
 	"github.com/vmihailenco/msgpack"
 	"io"
-	"log"
+	"time"
 )
 
 var ErrorCompressFail = errors.New("CompressFail")
@@ -17,10 +17,21 @@ type CompressorWriter interface {
 
 type Compressor interface {
 	CompressorWriter
+	Hit() bool
+	ContentType() uint16
 	Bytes() []byte
 	WriteTo(w io.Writer) (int64, error)
 }
 
+// StreamCompressor can encode data as it arrives, used when the body
+// is too large or too slow to be compressed at once
+type StreamCompressor interface {
+	//nil if the peer has no base version we can diff against
+	StreamEncoder() *StreamDiffEncoder
+	//save the streamed body as the new base version
+	Store(body []byte)
+}
+
 type CacheCompressorWriter struct {
 	cache       Cache
 	cacheKey    []byte
@@ -28,6 +39,8 @@ type CacheCompressorWriter struct {
 	buff        *bytes.Buffer
 	writer      io.Writer
 	update      bool
+	hit         bool
+	differ      Differ
 }
 
 func (c *CacheCompressorWriter) Write(b []byte) (n int, err error) {
@@ -40,8 +53,18 @@ func (c *CacheCompressorWriter) Flush() error {
 	return nil
 }
 
+func (c *CacheCompressorWriter) ContentType() uint16 {
+	return c.differ.ContentType()
+}
+
+// Hit reports whether the body was sent as a diff against the peer's cache
+func (c *CacheCompressorWriter) Hit() bool {
+	return c.hit
+}
+
 func (c *CacheCompressorWriter) Close() error {
-	_, compressed := c.compress(c.buff.Bytes())
+	var compressed []byte
+	c.hit, compressed = c.compress(c.buff.Bytes())
 	//TODO: make sure all is written
 	c.writer.Write(compressed)
 
@@ -51,19 +74,45 @@ func (c *CacheCompressorWriter) Close() error {
 	return nil
 }
 
+func (c *CacheCompressorWriter) StreamEncoder() *StreamDiffEncoder {
+	cacheBody, ok := c.cache.Get(c.cacheKey)
+	if !ok || !bytes.Equal(c.cache.Digest(cacheBody), c.cacheDigest) {
+		metricCacheLookups.add(1, "miss")
+		return nil
+	}
+	metricCacheLookups.add(1, "hit")
+	c.hit = true
+	logger.Printf("stream diff key %x base len %d", c.cacheKey, len(cacheBody))
+	return NewStreamDiffEncoder(c.cacheKey, c.cacheDigest, cacheBody, STREAM_BLOCK_SIZE)
+}
+
+func (c *CacheCompressorWriter) Store(body []byte) {
+	if c.update {
+		c.cache.Set(c.cacheKey, body)
+	}
+}
+
 func (c *CacheCompressorWriter) compress(body []byte) (hit bool, data []byte) {
 	cacheDigest, ok := c.cache.GetDigest(c.cacheKey)
 	hit = ok && bytes.Equal(cacheDigest, c.cacheDigest)
-	log.Printf("compress hit %t key %x remote %x local %x", hit, c.cacheKey, c.cacheDigest, cacheDigest)
+	logger.Printf("compress %s hit %t key %x remote %x local %x", CT_NAMES[c.ContentType()], hit, c.cacheKey, c.cacheDigest, cacheDigest)
+	ct := CT_RAW
 	if hit {
+		ct = c.ContentType()
+		metricCacheLookups.add(1, "hit")
 		cacheBody, _ := c.cache.Get(c.cacheKey)
-		data = MakeDiff(cacheBody, body)
-		diff := &DiffContent{c.cacheKey, cacheDigest, data}
+		start := time.Now()
+		data = c.differ.Diff(cacheBody, body)
+		metricDiffSeconds.observeSince(start, CT_NAMES[ct])
+		diff := &DiffContent{c.cacheKey, cacheDigest, data, c.cache.Digest(body)}
 		data, _ = msgpack.Marshal(diff)
 	} else {
-		diff := &DiffContent{[]byte(""), []byte(""), body}
+		metricCacheLookups.add(1, "miss")
+		diff := &DiffContent{[]byte(""), []byte(""), body, nil}
 		data, _ = msgpack.Marshal(diff)
 	}
+	metricCompressBytes.add(len(body), CT_NAMES[ct], "body")
+	metricCompressBytes.add(len(data), CT_NAMES[ct], "sent")
 	return
 }
 
@@ -75,6 +124,7 @@ func NewCacheCompressorWriter(writer io.Writer, cache Cache, cacheKey []byte, ca
 		buff:        new(bytes.Buffer),
 		writer:      writer,
 		update:      update,
+		differ:      DIFFERS[CT_CACHE_DIFF],
 	}
 }
 
@@ -92,6 +142,10 @@ func (c *CacheCompressor) WriteTo(w io.Writer) (n int64, err error) {
 }
 
 func NewCacheCompressor(cache Cache, cacheKey []byte, cacheDigest []byte, update bool) Compressor {
+	return NewCacheCompressorDiffer(cache, cacheKey, cacheDigest, update, DIFFERS[CT_CACHE_DIFF])
+}
+
+func NewCacheCompressorDiffer(cache Cache, cacheKey []byte, cacheDigest []byte, update bool, differ Differ) Compressor {
 	buff := new(bytes.Buffer)
 	cwriter := &CacheCompressorWriter{
 		cache:       cache,
@@ -100,21 +154,27 @@ func NewCacheCompressor(cache Cache, cacheKey []byte, cacheDigest []byte, update
 		buff:        new(bytes.Buffer),
 		writer:      buff,
 		update:      update,
+		differ:      differ,
 	}
 	return &CacheCompressor{cwriter, buff}
 }
 
 //TODO: should pass in []byte
-func decompress(cache Cache, dc *DiffContent) (data []byte, err error) {
+func decompress(cache Cache, differ Differ, dc *DiffContent) (data []byte, err error) {
 	cacheDigest, ok := cache.GetDigest(dc.CacheKey)
 	hit := ok && bytes.Equal(cacheDigest, dc.PatchTo)
-	if hit {
-		cacheBody, _ := cache.Get(dc.CacheKey)
-		data = Patch(cacheBody, dc.Diff)
-		cache.Set(dc.CacheKey, data)
-	} else {
-		log.Printf("decompress fail , cache digest %s not match", dc.PatchTo)
-		err = ErrorDecompressFail
+	if !hit {
+		logger.Printf("decompress fail , cache digest %x not match", dc.PatchTo)
+		metricDecompressFailures.add(1)
+		return nil, ErrorDecompressFail
+	}
+	cacheBody, _ := cache.Get(dc.CacheKey)
+	data, err = differ.Patch(cacheBody, dc.Diff)
+	if err != nil || (len(dc.Digest) > 0 && !bytes.Equal(cache.Digest(data), dc.Digest)) {
+		logger.Printf("decompress fail , patch %x result not match", dc.CacheKey)
+		metricDecompressFailures.add(1)
+		return nil, ErrorDecompressFail
 	}
+	cache.Set(dc.CacheKey, data)
 	return
 }
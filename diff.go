@@ -2,9 +2,73 @@ package dtunnel
 
 import (
 	"bytes"
+	"encoding/binary"
 	"github.com/kr/binarydist"
+	"hash/fnv"
+	"io"
+	"sort"
+	"strings"
 )
 
+// Differ is a delta algorithm, identified on the wire by its content type
+type Differ interface {
+	ContentType() uint16
+	Diff(old []byte, new_ []byte) []byte
+	Patch(old []byte, patch []byte) ([]byte, error)
+}
+
+var DIFFERS map[uint16]Differ = map[uint16]Differ{
+	CT_CACHE_DIFF: bsDiffer{},
+	CT_DELTA_DIFF: deltaDiffer{},
+	CT_LINE_DIFF:  lineDiffer{},
+}
+
+const (
+	//bsdiff is too slow above this size
+	MAX_BSDIFF_SIZE int = 512 * 1024
+	DELTA_WINDOW    int = 16
+)
+
+// SupportedDiffs returns content types of all diff encodings we can decode
+func SupportedDiffs() []uint16 {
+	cts := []uint16{CT_STREAM_DIFF}
+	for ct := range DIFFERS {
+		cts = append(cts, ct)
+	}
+	sort.Slice(cts, func(i, j int) bool { return cts[i] < cts[j] })
+	return cts
+}
+
+func hasContentType(cts []uint16, ct uint16) bool {
+	for _, c := range cts {
+		if c == ct {
+			return true
+		}
+	}
+	return false
+}
+
+func isTextContent(contentType string) bool {
+	for _, t := range []string{"text/", "json", "javascript", "xml"} {
+		if strings.Contains(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// chooseDiffer pick the algorithm for a response by its Content-Type and size,
+// only algorithms the peer supports are considered, bsdiff is always supported
+func chooseDiffer(contentType string, size int64, supported []uint16) Differ {
+	if isTextContent(contentType) && hasContentType(supported, CT_LINE_DIFF) {
+		return DIFFERS[CT_LINE_DIFF]
+	}
+	if (size < 0 || size > int64(MAX_BSDIFF_SIZE)) && hasContentType(supported, CT_DELTA_DIFF) {
+		return DIFFERS[CT_DELTA_DIFF]
+	}
+	return DIFFERS[CT_CACHE_DIFF]
+}
+
 func MakeDiff(old []byte, new_ []byte) []byte {
 	oldR := bytes.NewBuffer(old)
 	newR := bytes.NewBuffer(new_)
@@ -13,16 +77,220 @@ func MakeDiff(old []byte, new_ []byte) []byte {
 	return patch.Bytes()
 }
 
-func Patch(old []byte, patch []byte) []byte {
+func Patch(old []byte, patch []byte) ([]byte, error) {
 	oldR := bytes.NewBuffer(old)
 	patchR := bytes.NewBuffer(patch)
 	newR := new(bytes.Buffer)
-	binarydist.Patch(oldR, newR, patchR)
-	return newR.Bytes()
+	err := binarydist.Patch(oldR, newR, patchR)
+	return newR.Bytes(), err
+}
+
+type bsDiffer struct{}
+
+func (d bsDiffer) ContentType() uint16 {
+	return CT_CACHE_DIFF
+}
+
+func (d bsDiffer) Diff(old []byte, new_ []byte) []byte {
+	return MakeDiff(old, new_)
+}
+
+func (d bsDiffer) Patch(old []byte, patch []byte) ([]byte, error) {
+	return Patch(old, patch)
+}
+
+// copy/add ops shared by delta and line diff,
+// a copy is (offset, length) in units of bytes or lines
+type opWriter struct {
+	bytes.Buffer
+}
+
+func (w *opWriter) uvarint(x int) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(x))
+	w.Write(buf[:n])
+}
+
+func (w *opWriter) copyOp(offset int, length int) {
+	w.WriteByte(OP_COPY)
+	w.uvarint(offset)
+	w.uvarint(length)
+}
+
+func (w *opWriter) literalOp(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	w.WriteByte(OP_LITERAL)
+	w.uvarint(len(data))
+	w.Write(data)
+}
+
+// apply copy/add ops, copy ranges are resolved by units
+func applyOps(patch []byte, units func(offset int, length int) ([]byte, bool)) ([]byte, error) {
+	out := new(bytes.Buffer)
+	r := bytes.NewReader(patch)
+	for r.Len() > 0 {
+		op, _ := r.ReadByte()
+		switch op {
+		case OP_COPY:
+			offset, err1 := binary.ReadUvarint(r)
+			length, err2 := binary.ReadUvarint(r)
+			if err1 != nil || err2 != nil {
+				return nil, ErrorInvalidOps
+			}
+			data, ok := units(int(offset), int(length))
+			if !ok {
+				return nil, ErrorInvalidOps
+			}
+			out.Write(data)
+		case OP_LITERAL:
+			n, err := binary.ReadUvarint(r)
+			if err != nil || n > uint64(r.Len()) {
+				return nil, ErrorInvalidOps
+			}
+			out.Write(patch[len(patch)-r.Len() : len(patch)-r.Len()+int(n)])
+			r.Seek(int64(n), io.SeekCurrent)
+		default:
+			return nil, ErrorInvalidOps
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// validRange tells if [offset, offset+length) is within n units, the
+// values of a malformed patch may be negative or overflow
+func validRange(offset int, length int, n int) bool {
+	return offset >= 0 && length >= 0 && offset <= n-length
+}
+
+// deltaDiffer is a xdelta/vcdiff style greedy matcher: old is indexed by
+// fingerprints of DELTA_WINDOW sized windows, new is scanned byte by byte
+// and every match is extended as far as possible in both directions.
+// Much faster than bsdiff on large bodies.
+type deltaDiffer struct{}
+
+func (d deltaDiffer) ContentType() uint16 {
+	return CT_DELTA_DIFF
+}
+
+func fingerprint(data []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(data)
+	return h.Sum64()
+}
+
+func (d deltaDiffer) Diff(old []byte, new_ []byte) []byte {
+	w := DELTA_WINDOW
+	index := make(map[uint64]int)
+	for i := 0; i+w <= len(old); i += w {
+		fp := fingerprint(old[i : i+w])
+		if _, ok := index[fp]; !ok {
+			index[fp] = i
+		}
+	}
+
+	ops := new(opWriter)
+	lit := 0
+	for pos := 0; pos+w <= len(new_); {
+		start, ok := index[fingerprint(new_[pos:pos+w])]
+		if !ok || !bytes.Equal(old[start:start+w], new_[pos:pos+w]) {
+			pos++
+			continue
+		}
+		//extend backward into the pending literal, then forward
+		for start > 0 && pos > lit && old[start-1] == new_[pos-1] {
+			start--
+			pos--
+		}
+		length := 0
+		for start+length < len(old) && pos+length < len(new_) && old[start+length] == new_[pos+length] {
+			length++
+		}
+		ops.literalOp(new_[lit:pos])
+		ops.copyOp(start, length)
+		pos += length
+		lit = pos
+	}
+	ops.literalOp(new_[lit:])
+	return ops.Bytes()
+}
+
+func (d deltaDiffer) Patch(old []byte, patch []byte) ([]byte, error) {
+	return applyOps(patch, func(offset int, length int) ([]byte, bool) {
+		if !validRange(offset, length, len(old)) {
+			return nil, false
+		}
+		return old[offset : offset+length], true
+	})
+}
+
+// lineDiffer works on whole lines, fast and good enough for textual content
+type lineDiffer struct{}
+
+func (d lineDiffer) ContentType() uint16 {
+	return CT_LINE_DIFF
+}
+
+func splitLines(data []byte) [][]byte {
+	return bytes.SplitAfter(data, []byte("\n"))
+}
+
+func (d lineDiffer) Diff(old []byte, new_ []byte) []byte {
+	oldLines := splitLines(old)
+	index := make(map[string][]int)
+	for i, line := range oldLines {
+		index[string(line)] = append(index[string(line)], i)
+	}
+
+	ops := new(opWriter)
+	literal := new(bytes.Buffer)
+	newLines := splitLines(new_)
+	next := 0
+	for i := 0; i < len(newLines); {
+		candidates, ok := index[string(newLines[i])]
+		if !ok || len(newLines[i]) == 0 {
+			literal.Write(newLines[i])
+			i++
+			continue
+		}
+		//prefer the line following the last copy, most edits are local
+		start := candidates[0]
+		for _, c := range candidates {
+			if c == next {
+				start = c
+				break
+			}
+		}
+		length := 0
+		for start+length < len(oldLines) && i+length < len(newLines) &&
+			bytes.Equal(oldLines[start+length], newLines[i+length]) {
+			length++
+		}
+		ops.literalOp(literal.Bytes())
+		literal.Reset()
+		ops.copyOp(start, length)
+		i += length
+		next = start + length
+	}
+	ops.literalOp(literal.Bytes())
+	return ops.Bytes()
+}
+
+func (d lineDiffer) Patch(old []byte, patch []byte) ([]byte, error) {
+	oldLines := splitLines(old)
+	return applyOps(patch, func(offset int, length int) ([]byte, bool) {
+		if !validRange(offset, length, len(oldLines)) {
+			return nil, false
+		}
+		return bytes.Join(oldLines[offset:offset+length], nil), true
+	})
 }
 
 type DiffContent struct {
 	CacheKey []byte
 	PatchTo  []byte
 	Diff     []byte
+	//digest of the patched result, empty for old peers
+	Digest []byte
 }
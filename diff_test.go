@@ -0,0 +1,114 @@
+package dtunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestDiffersRoundTrip(t *testing.T) {
+	lines := make([]string, 0)
+	for i := 0; i < 2000; i++ {
+		lines = append(lines, strings.Repeat("line of text ", i%7+1))
+	}
+	old := []byte(strings.Join(lines, "\n"))
+	lines[100] = "changed line"
+	lines = append(lines[:500], lines[520:]...)
+	new_ := []byte(strings.Join(lines, "\n") + "\ntrailing")
+
+	for ct, differ := range DIFFERS {
+		patch := differ.Diff(old, new_)
+		result, err := differ.Patch(old, patch)
+		if err != nil {
+			t.Errorf("%s fail to patch %v", CT_NAMES[ct], err)
+			continue
+		}
+		if !bytes.Equal(result, new_) {
+			t.Errorf("%s patch result not match", CT_NAMES[ct])
+		}
+		if ct != CT_CACHE_DIFF && len(patch) > len(new_)/10 {
+			t.Errorf("%s patch too large, %d bytes for %d", CT_NAMES[ct], len(patch), len(new_))
+		}
+	}
+}
+
+func TestDifferInvalidPatch(t *testing.T) {
+	old := []byte("hello world")
+	for _, ct := range []uint16{CT_DELTA_DIFF, CT_LINE_DIFF} {
+		patch := []byte{OP_COPY, 100, 5}
+		if _, err := DIFFERS[ct].Patch(old, patch); err != ErrorInvalidOps {
+			t.Errorf("%s expect ErrorInvalidOps, got %v", CT_NAMES[ct], err)
+		}
+	}
+}
+
+func TestDifferCorruptPatch(t *testing.T) {
+	huge := func(x uint64) []byte {
+		buf := make([]byte, binary.MaxVarintLen64)
+		return buf[:binary.PutUvarint(buf, x)]
+	}
+	cat := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	old := []byte("hello world\nsecond line\n")
+	patches := [][]byte{
+		//negative once converted to int
+		cat([]byte{OP_COPY}, huge(1<<63), huge(5)),
+		cat([]byte{OP_COPY}, huge(1), huge(1<<63)),
+		//offset+length overflows
+		cat([]byte{OP_COPY}, huge(1<<62), huge(1<<62)),
+		cat([]byte{OP_COPY}, huge(math.MaxInt64), huge(math.MaxInt64)),
+		cat([]byte{OP_LITERAL}, huge(1<<63), []byte("abc")),
+		{OP_COPY, 1},
+	}
+	for _, patch := range patches {
+		for _, ct := range []uint16{CT_DELTA_DIFF, CT_LINE_DIFF} {
+			if _, err := DIFFERS[ct].Patch(old, patch); err != ErrorInvalidOps {
+				t.Errorf("%s patch %x expect ErrorInvalidOps, got %v", CT_NAMES[ct], patch, err)
+			}
+		}
+		if _, err := applyStreamOps(old, 4, patch); err != ErrorInvalidOps {
+			t.Errorf("stream patch %x expect ErrorInvalidOps, got %v", patch, err)
+		}
+	}
+
+	//random damage to valid patches may fail, but should not panic
+	new_ := []byte(strings.Repeat("hello world\nchanged line\n", 50))
+	old = []byte(strings.Repeat("hello world\nsecond line\n", 50))
+	rnd := rand.New(rand.NewSource(1))
+	for _, ct := range []uint16{CT_DELTA_DIFF, CT_LINE_DIFF} {
+		patch := DIFFERS[ct].Diff(old, new_)
+		for i := 0; i < 2000; i++ {
+			damaged := append([]byte(nil), patch...)
+			for j := rnd.Intn(4); j >= 0; j-- {
+				damaged[rnd.Intn(len(damaged))] = byte(rnd.Intn(256))
+			}
+			DIFFERS[ct].Patch(old, damaged)
+			applyStreamOps(old, 1+rnd.Intn(16), damaged)
+		}
+	}
+}
+
+func TestChooseDiffer(t *testing.T) {
+	all := SupportedDiffs()
+	cases := []struct {
+		contentType string
+		size        int64
+		supported   []uint16
+		expect      uint16
+	}{
+		{"text/html; charset=utf-8", 1024, all, CT_LINE_DIFF},
+		{"application/json", 10 * 1024 * 1024, all, CT_LINE_DIFF},
+		{"image/png", 1024, all, CT_CACHE_DIFF},
+		{"image/png", int64(MAX_BSDIFF_SIZE) + 1, all, CT_DELTA_DIFF},
+		{"text/html", 1024, []uint16{CT_CACHE_DIFF}, CT_CACHE_DIFF},
+	}
+	for _, c := range cases {
+		if ct := chooseDiffer(c.contentType, c.size, c.supported).ContentType(); ct != c.expect {
+			t.Errorf("%s %d expect %s got %s", c.contentType, c.size, CT_NAMES[c.expect], CT_NAMES[ct])
+		}
+	}
+}
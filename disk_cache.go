@@ -0,0 +1,333 @@
+package dtunnel
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var diskCacheMagic = []byte("DTC1")
+
+var ErrorCacheFileCorrupt = errors.New("CacheFileCorrupt")
+
+type diskEntry struct {
+	key    string
+	size   int
+	digest []byte
+}
+
+// DiskCache store every value in its own file under dir, named by the md5 of the key.
+// A file is written to dir/tmp first and renamed into place, so a crash never
+// leaves a half written entry. The index is rebuilt from the files on open.
+//
+// file layout: magic(4) | key length(4) | key | md5 digest(16) | value
+type DiskCache struct {
+	mu         sync.Mutex
+	dir        string
+	ll         *list.List
+	items      map[string]*list.Element
+	size       int
+	maxBytes   int
+	maxEntries int
+	onEvict    func(key []byte)
+}
+
+func (c *DiskCache) Set(key []byte, value []byte) error {
+	if c.maxBytes > 0 && len(value) > c.maxBytes {
+		c.Del(key)
+		return ErrorCacheTooLarge
+	}
+	digest := c.Digest(value)
+	logger.Printf("set disk cache %x data len %d digest %x", key, len(value), digest)
+
+	tmp, err := c.writeTemp(key, digest, value)
+	if err != nil {
+		logger.Printf("fail to write disk cache %x: %s", key, err)
+		return err
+	}
+
+	c.mu.Lock()
+	path := c.path(key)
+	os.MkdirAll(filepath.Dir(path), 0700)
+	err = os.Rename(tmp, path)
+	if err != nil {
+		c.mu.Unlock()
+		os.Remove(tmp)
+		return err
+	}
+	c.add(&diskEntry{string(key), len(value), digest})
+	evicted := c.shrink()
+	c.mu.Unlock()
+
+	c.notify(evicted)
+	return nil
+}
+
+func (c *DiskCache) Get(key []byte) (value []byte, ok bool) {
+	c.mu.Lock()
+	el, ok := c.items[string(key)]
+	var entry *diskEntry
+	if ok {
+		entry = el.Value.(*diskEntry)
+		c.ll.MoveToFront(el)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	_, _, value, err := readCacheFile(c.path(key))
+	if err != nil {
+		logger.Printf("fail to read disk cache %x: %s", key, err)
+		c.delEntry(entry)
+		return nil, false
+	}
+	return value, true
+}
+
+// delEntry removes entry if it's still the one of its key, a Set or an
+// eviction may have replaced it since it was looked up
+func (c *DiskCache) delEntry(entry *diskEntry) {
+	c.mu.Lock()
+	el, ok := c.items[entry.key]
+	ok = ok && el.Value.(*diskEntry) == entry
+	if ok {
+		c.remove(el)
+	}
+	c.mu.Unlock()
+
+	if ok {
+		c.notify([]string{entry.key})
+	}
+}
+
+func (c *DiskCache) GetDigest(key []byte) (digest []byte, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[string(key)]
+	if ok {
+		digest = el.Value.(*diskEntry).digest
+	}
+	return
+}
+
+func (c *DiskCache) Del(key []byte) bool {
+	c.mu.Lock()
+	el, ok := c.items[string(key)]
+	if ok {
+		c.remove(el)
+	}
+	c.mu.Unlock()
+
+	if ok {
+		c.notify([]string{string(key)})
+	}
+	return ok
+}
+
+func (c *DiskCache) Digest(data []byte) []byte {
+	return md5Digest(data)
+}
+
+func (c *DiskCache) NotifyEvict(fn func(key []byte)) {
+	c.mu.Lock()
+	c.onEvict = fn
+	c.mu.Unlock()
+}
+
+func (c *DiskCache) Items() []CacheItem {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	items := make([]CacheItem, 0, c.ll.Len())
+	for el := c.ll.Front(); el != nil; el = el.Next() {
+		entry := el.Value.(*diskEntry)
+		items = append(items, CacheItem{[]byte(entry.key), entry.digest})
+	}
+	return items
+}
+
+// Flush saves the order entries were used in, as the mtime of their files,
+// Get only moves them in memory. The next load keeps the recently used ones
+func (c *DiskCache) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	i := 0
+	for el := c.ll.Front(); el != nil; el = el.Next() {
+		//the front is the most recently used
+		mtime := now.Add(-time.Duration(i) * time.Millisecond)
+		if err := os.Chtimes(c.path([]byte(el.Value.(*diskEntry).key)), mtime, mtime); err != nil {
+			return err
+		}
+		i++
+	}
+	return nil
+}
+
+// Len returns the number of entries and the total bytes of values
+func (c *DiskCache) Len() (entries int, bytes int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len(), c.size
+}
+
+func (c *DiskCache) path(key []byte) string {
+	name := hex.EncodeToString(md5Digest(key))
+	return filepath.Join(c.dir, name[:2], name)
+}
+
+func (c *DiskCache) writeTemp(key []byte, digest []byte, value []byte) (string, error) {
+	f, err := ioutil.TempFile(filepath.Join(c.dir, "tmp"), "entry")
+	if err != nil {
+		return "", err
+	}
+	buff := new(bytes.Buffer)
+	buff.Write(diskCacheMagic)
+	binary.Write(buff, binary.BigEndian, uint32(len(key)))
+	buff.Write(key)
+	buff.Write(digest)
+	buff.Write(value)
+	_, err = buff.WriteTo(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+//must hold c.mu
+func (c *DiskCache) add(entry *diskEntry) {
+	if el, ok := c.items[entry.key]; ok {
+		c.size -= el.Value.(*diskEntry).size
+		el.Value = entry
+		c.ll.MoveToFront(el)
+	} else {
+		c.items[entry.key] = c.ll.PushFront(entry)
+	}
+	c.size += entry.size
+}
+
+//must hold c.mu
+func (c *DiskCache) remove(el *list.Element) {
+	entry := c.ll.Remove(el).(*diskEntry)
+	delete(c.items, entry.key)
+	c.size -= entry.size
+	os.Remove(c.path([]byte(entry.key)))
+}
+
+//must hold c.mu
+func (c *DiskCache) shrink() (evicted []string) {
+	for c.ll.Len() > 0 &&
+		((c.maxEntries > 0 && c.ll.Len() > c.maxEntries) || (c.maxBytes > 0 && c.size > c.maxBytes)) {
+		el := c.ll.Back()
+		evicted = append(evicted, el.Value.(*diskEntry).key)
+		c.remove(el)
+	}
+	return
+}
+
+//call without c.mu, the callback may send msg to peer
+func (c *DiskCache) notify(keys []string) {
+	c.mu.Lock()
+	fn := c.onEvict
+	c.mu.Unlock()
+	for _, key := range keys {
+		logger.Printf("evict disk cache %x", key)
+		if fn != nil {
+			fn([]byte(key))
+		}
+	}
+}
+
+type diskFile struct {
+	entry *diskEntry
+	mtime int64
+}
+
+// rebuild the index from files on disk, the most recently written file
+// is treated as the most recently used
+func (c *DiskCache) load() error {
+	os.RemoveAll(filepath.Join(c.dir, "tmp"))
+	err := os.MkdirAll(filepath.Join(c.dir, "tmp"), 0700)
+	if err != nil {
+		return err
+	}
+
+	files := make([]diskFile, 0)
+	filepath.Walk(c.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		key, digest, value, err := readCacheFile(path)
+		if err != nil || path != c.path(key) {
+			logger.Printf("remove invalid disk cache file %s", path)
+			os.Remove(path)
+			return nil
+		}
+		entry := &diskEntry{string(key), len(value), digest}
+		files = append(files, diskFile{entry, info.ModTime().UnixNano()})
+		return nil
+	})
+
+	sort.Slice(files, func(i, j int) bool { return files[i].mtime < files[j].mtime })
+	for _, f := range files {
+		c.add(f.entry)
+	}
+	c.shrink()
+	logger.Printf("load %d entries %d bytes from disk cache %s", c.ll.Len(), c.size, c.dir)
+	return nil
+}
+
+func readCacheFile(path string) (key []byte, digest []byte, value []byte, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	if len(data) < 8 || !bytes.Equal(data[:4], diskCacheMagic) {
+		err = ErrorCacheFileCorrupt
+		return
+	}
+	keyLen := int(binary.BigEndian.Uint32(data[4:8]))
+	if len(data) < 8+keyLen+16 {
+		err = ErrorCacheFileCorrupt
+		return
+	}
+	key = data[8 : 8+keyLen]
+	digest = data[8+keyLen : 8+keyLen+16]
+	value = data[8+keyLen+16:]
+	if !bytes.Equal(digest, md5Digest(value)) {
+		err = ErrorCacheFileCorrupt
+	}
+	return
+}
+
+// NewDiskCache open or create a disk cache in dir,
+// bounded by maxBytes and maxEntries, zero means no limit
+func NewDiskCache(dir string, maxBytes int, maxEntries int) (*DiskCache, error) {
+	c := &DiskCache{
+		dir:        dir,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+		maxBytes:   maxBytes,
+		maxEntries: maxEntries,
+	}
+	err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,148 @@
+package dtunnel
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskCacheReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dtunnel-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewDiskCache(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("fail to open disk cache %v", err)
+	}
+	key := []byte("http://www.example.com")
+	value := []byte("hello world \n")
+	cache.Set(key, value)
+	cache.Set([]byte("http://httpbin.org"), []byte("456"))
+
+	cache, err = NewDiskCache(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("fail to reopen disk cache %v", err)
+	}
+	got, ok := cache.Get(key)
+	if !ok || !bytes.Equal(got, value) {
+		t.Errorf("value not match after reopen, got %s", got)
+	}
+	digest, ok := cache.GetDigest(key)
+	if !ok || !bytes.Equal(digest, cache.Digest(value)) {
+		t.Errorf("digest not match after reopen, got %x", digest)
+	}
+	if items := cache.Items(); len(items) != 2 {
+		t.Errorf("expect 2 items, got %d", len(items))
+	}
+}
+
+func TestDiskCacheCorruptFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dtunnel-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, _ := NewDiskCache(dir, 0, 0)
+	key := []byte("http://www.example.com")
+	cache.Set(key, []byte("hello world"))
+
+	//truncate the file, like a crash in the middle of a write
+	path := cache.path(key)
+	data, _ := ioutil.ReadFile(path)
+	ioutil.WriteFile(path, data[:len(data)-3], 0600)
+	ioutil.WriteFile(filepath.Join(dir, "tmp", "entry123"), data, 0600)
+
+	cache, _ = NewDiskCache(dir, 0, 0)
+	if _, ok := cache.Get(key); ok {
+		t.Error("corrupt entry should be dropped")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("corrupt file should be removed")
+	}
+	if entries, _ := cache.Len(); entries != 0 {
+		t.Errorf("expect empty cache, got %d entries", entries)
+	}
+}
+
+func TestDiskCacheGetRaceWithSet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dtunnel-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, _ := NewDiskCache(dir, 0, 0)
+	key := []byte("http://www.example.com")
+	cache.Set(key, []byte("version 1"))
+	cache.mu.Lock()
+	seen := cache.items[string(key)].Value.(*diskEntry)
+	cache.mu.Unlock()
+
+	//a Get which failed to read version 1 while version 2 was set
+	cache.Set(key, []byte("version 2"))
+	cache.delEntry(seen)
+	if got, ok := cache.Get(key); !ok || string(got) != "version 2" {
+		t.Errorf("entry set after the failed read should stay, got %q %v", got, ok)
+	}
+	cache.mu.Lock()
+	seen = cache.items[string(key)].Value.(*diskEntry)
+	cache.mu.Unlock()
+	cache.delEntry(seen)
+	if _, ok := cache.Get(key); ok {
+		t.Error("entry which failed to read should be dropped")
+	}
+}
+
+func TestDiskCacheEvict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dtunnel-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, _ := NewDiskCache(dir, 0, 1)
+	evicted := make([]string, 0)
+	cache.NotifyEvict(func(key []byte) {
+		evicted = append(evicted, string(key))
+	})
+	cache.Set([]byte("a"), []byte("1"))
+	cache.Set([]byte("b"), []byte("2"))
+
+	if len(evicted) != 1 || evicted[0] != "a" {
+		t.Errorf("evict callback not right, got %v", evicted)
+	}
+	if _, err := os.Stat(cache.path([]byte("a"))); !os.IsNotExist(err) {
+		t.Error("evicted file should be removed")
+	}
+}
+
+func TestDiskCacheFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dtunnel-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, _ := NewDiskCache(dir, 0, 0)
+	cache.Set([]byte("a"), []byte("1"))
+	cache.Set([]byte("b"), []byte("2"))
+	//a is used last, but only in memory till flushed
+	cache.Get([]byte("a"))
+	if err := cache.Flush(); err != nil {
+		t.Fatalf("Flush fail %v", err)
+	}
+
+	cache, _ = NewDiskCache(dir, 0, 1)
+	if _, ok := cache.Get([]byte("a")); !ok {
+		t.Error("the recently used entry should be kept")
+	}
+	if _, ok := cache.Get([]byte("b")); ok {
+		t.Error("the other should be evicted")
+	}
+}
@@ -0,0 +1,240 @@
+package dtunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"sync"
+)
+
+//bytes a peer may send on a stream before the receiver grants more
+const STREAM_WINDOW int = 1024 * 1024
+
+var ErrorWindowExceeded = errors.New("WindowExceeded")
+
+// sendWindow is the credit the peer granted us on a stream,
+// so a slow reader on the other side only slows down its own stream
+type sendWindow struct {
+	mu     sync.Mutex
+	credit int
+	closed bool
+	//closed and replaced whenever credit comes, wakes up waiting writers
+	wake chan struct{}
+}
+
+func newSendWindow() *sendWindow {
+	return &sendWindow{wake: make(chan struct{})}
+}
+
+// open grants the initial credit, returns nil if the peer doesn't do flow control
+func (w *sendWindow) open(credit int) *sendWindow {
+	if credit <= 0 {
+		return nil
+	}
+	w.grant(credit)
+	return w
+}
+
+// take waits for credit, then takes up to n bytes of it if partial,
+// or all n bytes even if that overdraws it. It fails once the window
+// is closed, or cancel is closed first
+func (w *sendWindow) take(n int, partial bool, cancel <-chan struct{}) (int, error) {
+	for {
+		w.mu.Lock()
+		if w.closed {
+			w.mu.Unlock()
+			return 0, ErrorStreamReset
+		}
+		if w.credit > 0 {
+			if partial && n > w.credit {
+				n = w.credit
+			}
+			w.credit -= n
+			w.mu.Unlock()
+			return n, nil
+		}
+		wake := w.wake
+		w.mu.Unlock()
+		select {
+		case <-wake:
+		case <-cancel:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (w *sendWindow) notify() {
+	close(w.wake)
+	w.wake = make(chan struct{})
+}
+
+func (w *sendWindow) grant(n int) {
+	w.mu.Lock()
+	w.credit += n
+	w.notify()
+	w.mu.Unlock()
+}
+
+// close wakes up writers waiting for credit once the stream is gone
+func (w *sendWindow) close() {
+	w.mu.Lock()
+	w.closed = true
+	w.notify()
+	w.mu.Unlock()
+}
+
+// recvQueue keeps the msgs of a stream until its reader takes them,
+// so the shared receive loop never waits for a slow reader
+type recvQueue struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	msgs []*Msg
+	size int
+	//max payload bytes queued, zero means no limit
+	limit int
+	//drop msgs over the limit instead of failing, for datagrams
+	lossy bool
+	//in or out, the direction the dropped datagrams are counted in
+	direction string
+	dropped   int
+	closed    bool
+}
+
+func newRecvQueue(limit int) *recvQueue {
+	q := &recvQueue{limit: limit}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// newLossyRecvQueue a queue which drops what doesn't fit in limit bytes,
+// direction is in for datagrams from the peer, out for those to it
+func newLossyRecvQueue(limit int, direction string) *recvQueue {
+	q := newRecvQueue(limit)
+	q.lossy, q.direction = true, direction
+	return q
+}
+
+func payloadSize(msg *Msg) int {
+	switch body := msg.Body.(type) {
+	case *TcpData:
+		if msg.GetMsgType() == TCP_DATA {
+			return len(body.GetPayload())
+		}
+	case *UdpData:
+		return len(body.Payload)
+	}
+	return 0
+}
+
+// push never blocks, it fails if the peer sent more than it was granted
+func (q *recvQueue) push(msg *Msg) error {
+	n := payloadSize(msg)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil
+	}
+	if q.limit > 0 && q.size+n > q.limit {
+		if q.lossy {
+			q.dropped += 1
+			metricUdpDropped.add(1, q.direction)
+			return nil
+		}
+		return ErrorWindowExceeded
+	}
+	q.msgs = append(q.msgs, msg)
+	q.size += n
+	q.cond.Signal()
+	return nil
+}
+
+// pop waits for the next msg, nil once the queue is closed
+func (q *recvQueue) pop() *Msg {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.msgs) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return nil
+	}
+	msg := q.msgs[0]
+	q.msgs[0] = nil
+	q.msgs = q.msgs[1:]
+	q.size -= payloadSize(msg)
+	return msg
+}
+
+func (q *recvQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
+
+// Dropped the msgs a lossy queue dropped so far
+func (q *recvQueue) Dropped() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.dropped
+}
+
+func (q *recvQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.msgs = nil
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+// pump hands msgs to out in order, credit is told the payload size of each.
+// Returns true after the end of the stream is handed over,
+// false if the queue is closed or done first
+func (q *recvQueue) pump(out chan *Msg, done <-chan struct{}, credit func(n int)) bool {
+	for {
+		msg := q.pop()
+		if msg == nil {
+			return false
+		}
+		select {
+		case out <- msg:
+		case <-done:
+			return false
+		}
+		if msg.IsEndOfStream() {
+			return true
+		}
+		if credit != nil {
+			credit(payloadSize(msg))
+		}
+	}
+}
+
+// windowUpdater batches credit given back to the peer, send is called
+// once half of the window has been taken by the reader
+func windowUpdater(window int, send func(n int)) func(n int) {
+	if window <= 0 {
+		return nil
+	}
+	pending := 0
+	return func(n int) {
+		pending += n
+		if pending >= window/2 {
+			send(pending)
+			pending = 0
+		}
+	}
+}
+
+func encodeWindowUpdate(n int) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(n))
+	return b
+}
+
+func windowIncrement(msg *Msg) int {
+	payload := msg.Body.(*TcpData).GetPayload()
+	if len(payload) != 4 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint32(payload))
+}
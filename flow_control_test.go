@@ -0,0 +1,166 @@
+package dtunnel
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTunnelWriterWindow(t *testing.T) {
+	sendChan := make(chan *Msg, 10)
+	writer := &TunnelWriter{
+		sendChan: sendChan,
+		msgMaker: &msgBuilder{defaultFlags: FLAG_TCP},
+		window:   newSendWindow().open(100),
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- writer.send(CT_RAW, makeTestBody(250, 1), FLAG_STREAM_END)
+	}()
+
+	msg := <-sendChan
+	if n := len(msg.Body.(*TcpData).GetPayload()); n != 100 || msg.IsEndOfStream() {
+		t.Fatalf("first frame should take the whole credit, got %d", n)
+	}
+	select {
+	case <-sendChan:
+		t.Fatal("should wait for credit")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	writer.window.grant(1000)
+	msg = <-sendChan
+	if n := len(msg.Body.(*TcpData).GetPayload()); n != 150 || !msg.IsEndOfStream() {
+		t.Errorf("rest should be sent once granted, got %d", n)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("send fail %v", err)
+	}
+
+	//a closed window fails the writer instead of blocking it
+	writer.window = newSendWindow().open(1)
+	writer.send(CT_RAW, []byte("x"), 0)
+	go writer.window.close()
+	if err := writer.send(CT_RAW, []byte("hello"), 0); err != ErrorStreamReset {
+		t.Errorf("expect StreamReset, got %v", err)
+	}
+}
+
+func TestStalledStreamDoesNotBlockOthers(t *testing.T) {
+	big := make([]byte, MAX_CACHE_SIZE+1024*1024)
+	rand.Read(big)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/big" {
+			w.Write(big)
+			return
+		}
+		fmt.Fprintf(w, "hello %s", r.URL.Path)
+	}))
+	defer ts.Close()
+
+	_, tc := startTunnel(t, "inproc://test-flow-control")
+	defer tc.Close()
+	proxy := NewHttpProxyServer(tc)
+	for tc.getAgreed() == nil {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	//nobody reads the big body
+	req, _ := http.NewRequest("GET", ts.URL+"/big", nil)
+	stalled, err := tc.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip fail %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	for i := 0; i < 10; i++ {
+		done := make(chan string, 1)
+		go func() {
+			req, _ := http.NewRequest("GET", fmt.Sprintf("%s/%d", ts.URL, i), nil)
+			rec := httptest.NewRecorder()
+			proxy.ServeHTTP(rec, req)
+			done <- rec.Body.String()
+		}()
+		select {
+		case body := <-done:
+			if body != fmt.Sprintf("hello /%d", i) {
+				t.Errorf("response not right, got %s", body)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("other streams are blocked by the stalled one")
+		}
+	}
+
+	tc.streams.mu.Lock()
+	for _, st := range tc.streams.streams {
+		if n := st.queue.Len(); n > STREAM_WINDOW {
+			t.Errorf("stalled stream buffers %d bytes, more than the window", n)
+		}
+	}
+	tc.streams.mu.Unlock()
+
+	resp, err := http.ReadResponse(bufio.NewReader(stalled), req)
+	if err != nil {
+		t.Fatalf("read stalled response fail %v", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read stalled body fail %v", err)
+	}
+	if !bytes.Equal(body, big) {
+		t.Errorf("stalled body not right, got len %d", len(body))
+	}
+	stalled.Close()
+}
+
+func TestStreamOpenedBeforeHandshake(t *testing.T) {
+	service := startEcho(t)
+	defer service.Close()
+	big := make([]byte, 3*STREAM_WINDOW)
+	rand.Read(big)
+
+	addr := "inproc://test-flow-control-early"
+	server, _ := NewTunnelServer(addr)
+	go server.Run()
+	defer server.Close()
+	tc, _ := NewTunnelClient(addr)
+	defer tc.Close()
+
+	done := make(chan []byte, 1)
+	go func() {
+		conn, err := tc.ConnectTcp(service.Addr().String())
+		if err != nil {
+			t.Errorf("ConnectTcp fail %v", err)
+			done <- nil
+			return
+		}
+		defer conn.Close()
+		go conn.Write(big)
+		//pull more than the window from the server
+		got := make([]byte, len(big))
+		io.ReadFull(conn, got)
+		done <- got
+	}()
+	//the stream is opened before HELLO_REP
+	time.Sleep(50 * time.Millisecond)
+	if tc.getAgreed() != nil {
+		t.Fatal("should not be handshaken yet")
+	}
+	go tc.Run()
+
+	select {
+	case got := <-done:
+		if !bytes.Equal(got, big) {
+			t.Error("echo not right")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream opened before the handshake stalls")
+	}
+}
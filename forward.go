@@ -0,0 +1,45 @@
+package dtunnel
+
+import (
+	"net"
+)
+
+// Forward listens on local, each conn it accepts is piped to remote through
+// the tunnel, like ssh -L. Close the listener to stop
+func (c *TunnelClient) Forward(local string, remote string) (net.Listener, error) {
+	return forward(c, local, remote)
+}
+
+// Forward see TunnelClient.Forward, each conn goes to a healthy server
+func (p *TunnelPool) Forward(local string, remote string) (net.Listener, error) {
+	return forward(p, local, remote)
+}
+
+func forward(tt TcpTransport, local string, remote string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", local)
+	if err != nil {
+		return nil, err
+	}
+	logger.Printf("[forward]%s to %s", ln.Addr(), remote)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				logger.Printf("[forward]stop listening on %s: %s", ln.Addr(), err)
+				return
+			}
+			go forwardConn(tt, conn, remote)
+		}
+	}()
+	return ln, nil
+}
+
+func forwardConn(tt TcpTransport, conn net.Conn, remote string) {
+	tunnel, err := tt.ConnectTcp(remote)
+	if err != nil {
+		logger.Printf("[forward]fail to connect %s: %s", remote, err)
+		conn.Close()
+		return
+	}
+	piping(conn, tunnel)
+}
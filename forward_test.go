@@ -0,0 +1,71 @@
+package dtunnel
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestForward(t *testing.T) {
+	service, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen fail %v", err)
+	}
+	defer service.Close()
+	go func() {
+		for {
+			conn, err := service.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	server, tc := startTunnel(t, "inproc://test-forward")
+	defer server.Close()
+	defer tc.Close()
+	ln, err := tc.Forward("127.0.0.1:0", service.Addr().String())
+	if err != nil {
+		t.Fatalf("Forward fail %v", err)
+	}
+
+	data := makeTestBody(2*STREAM_WINDOW, 1)
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("dial forwarded port fail %v", err)
+		}
+		go func() {
+			conn.Write(data)
+			conn.(*net.TCPConn).CloseWrite()
+		}()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		got, err := ioutil.ReadAll(conn)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("echo not right, got len %d %v", len(got), err)
+		}
+		conn.Close()
+	}
+
+	//a remote which can't be reached closes the conn
+	bad, _ := tc.Forward("127.0.0.1:0", "127.0.0.1:1")
+	defer bad.Close()
+	conn, _ := net.Dial("tcp", bad.Addr().String())
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expect EOF, got %v", err)
+	}
+	conn.Close()
+
+	ln.Close()
+	if _, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		t.Error("closed forward should not accept")
+	}
+}
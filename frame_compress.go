@@ -0,0 +1,158 @@
+package dtunnel
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// A payload compression is kept in the high byte of TcpData.ContentType,
+// so it combines with any diff encoding in the low byte.
+const (
+	CT_COMPRESS_MASK uint16 = 0xff00
+	CT_FLATE         uint16 = 0x0100
+	CT_GZIP          uint16 = 0x0200
+)
+
+const (
+	//smaller payloads are not worth compressing
+	MIN_COMPRESS_SIZE int = 256
+	//give up compressing a stream after this many frames which don't shrink
+	MAX_COMPRESS_MISS int = 3
+)
+
+type payloadCodec struct {
+	compress   func(w io.Writer) io.WriteCloser
+	uncompress func(r io.Reader) (io.ReadCloser, error)
+}
+
+var COMPRESSIONS map[uint16]*payloadCodec = map[uint16]*payloadCodec{
+	CT_FLATE: &payloadCodec{
+		func(w io.Writer) io.WriteCloser {
+			fw, _ := flate.NewWriter(w, flate.BestSpeed)
+			return fw
+		},
+		func(r io.Reader) (io.ReadCloser, error) {
+			return flate.NewReader(r), nil
+		},
+	},
+	CT_GZIP: &payloadCodec{
+		func(w io.Writer) io.WriteCloser {
+			gw, _ := gzip.NewWriterLevel(w, gzip.BestSpeed)
+			return gw
+		},
+		func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+}
+
+// in order of preference
+func SupportedCompressions() []uint16 {
+	return []uint16{CT_FLATE, CT_GZIP}
+}
+
+// preferCompression returns the first of our compressions the peer supports, CT_RAW if none
+func preferCompression(supported []uint16) uint16 {
+	for _, ct := range SupportedCompressions() {
+		if hasContentType(supported, ct) {
+			return ct
+		}
+	}
+	return CT_RAW
+}
+
+func baseContentType(ct uint16) uint16 {
+	return ct &^ CT_COMPRESS_MASK
+}
+
+func ctName(ct uint16) string {
+	name := CT_NAMES[baseContentType(ct)]
+	if method := ct & CT_COMPRESS_MASK; method != 0 {
+		name += "+" + CT_NAMES[method]
+	}
+	return name
+}
+
+var compressedMagics [][]byte = [][]byte{
+	[]byte("\x1f\x8b"),         //gzip
+	[]byte("PK\x03\x04"),       //zip
+	[]byte("\x89PNG"),          //png
+	[]byte("\xff\xd8\xff"),     //jpeg
+	[]byte("GIF8"),             //gif
+	[]byte("\x28\xb5\x2f\xfd"), //zstd
+	[]byte("RIFF"),             //webp
+	[]byte("7z\xbc\xaf"),       //7z
+}
+
+func looksCompressed(data []byte) bool {
+	for _, magic := range compressedMagics {
+		if bytes.HasPrefix(data, magic) {
+			return true
+		}
+	}
+	return false
+}
+
+// isCompressedContent tells by http headers whether a body is already compressed
+func isCompressedContent(header map[string][]string) bool {
+	get := func(k string) string {
+		if v, ok := header[k]; ok && len(v) > 0 {
+			return strings.ToLower(v[0])
+		}
+		return ""
+	}
+	if enc := get("Content-Encoding"); enc != "" && enc != "identity" {
+		return true
+	}
+	ct := get("Content-Type")
+	for _, t := range []string{"image/", "video/", "audio/", "zip", "gzip", "compressed"} {
+		if strings.Contains(ct, t) && !strings.Contains(ct, "svg") {
+			return true
+		}
+	}
+	return false
+}
+
+// compressPayload returns the compressed data, ok is false if it's not worth it
+func compressPayload(method uint16, data []byte) (compressed []byte, ok bool) {
+	codec, found := COMPRESSIONS[method]
+	if !found || len(data) < MIN_COMPRESS_SIZE || looksCompressed(data) {
+		return data, false
+	}
+	buff := new(bytes.Buffer)
+	w := codec.compress(buff)
+	w.Write(data)
+	w.Close()
+	//not worth it unless we save at least 1/10
+	if buff.Len() > len(data)-len(data)/10 {
+		return data, false
+	}
+	return buff.Bytes(), true
+}
+
+// uncompressPayload inflates data, a payload larger than limit bytes once
+// inflated fails with ErrorDecompressFail, the peer never sends one
+func uncompressPayload(ct uint16, data []byte, limit int) ([]byte, error) {
+	method := ct & CT_COMPRESS_MASK
+	if method == 0 {
+		return data, nil
+	}
+	codec, ok := COMPRESSIONS[method]
+	if !ok {
+		return nil, ErrorDecompressFail
+	}
+	r, err := codec.uncompress(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	payload, err := ioutil.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err == nil && len(payload) > limit {
+		return nil, ErrorDecompressFail
+	}
+	return payload, err
+}
@@ -0,0 +1,131 @@
+package dtunnel
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompressPayloadRoundTrip(t *testing.T) {
+	data := []byte(strings.Repeat("hello world, hello tunnel\n", 100))
+	for _, method := range SupportedCompressions() {
+		compressed, ok := compressPayload(method, data)
+		if !ok || len(compressed) >= len(data) {
+			t.Errorf("%s should compress, got len %d", CT_NAMES[method], len(compressed))
+			continue
+		}
+		got, err := uncompressPayload(CT_CACHE_DIFF|method, compressed, len(data))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s round trip failed: %v", CT_NAMES[method], err)
+		}
+	}
+
+	if _, err := uncompressPayload(CT_RAW|0x7f00, data, MAX_FRAME_SIZE); err == nil {
+		t.Error("unknown compression should fail")
+	}
+	//a small frame which inflates past the limit
+	for _, method := range SupportedCompressions() {
+		bomb, _ := compressPayload(method, make([]byte, 2*MAX_FRAME_SIZE))
+		if _, err := uncompressPayload(CT_RAW|method, bomb, MAX_FRAME_SIZE); err != ErrorDecompressFail {
+			t.Errorf("%s payload larger than the limit should fail, got %v", CT_NAMES[method], err)
+		}
+	}
+	if baseContentType(CT_LINE_DIFF|CT_GZIP) != CT_LINE_DIFF {
+		t.Error("base content type not right")
+	}
+}
+
+func TestCompressPayloadSkip(t *testing.T) {
+	small := []byte("hello world")
+	if _, ok := compressPayload(CT_FLATE, small); ok {
+		t.Error("small payload should not be compressed")
+	}
+	random := makeTestBody(4096, 3)
+	if _, ok := compressPayload(CT_FLATE, random); ok {
+		t.Error("random payload should not be compressed")
+	}
+	gz, _ := compressPayload(CT_GZIP, bytes.Repeat([]byte("a"), 1024))
+	if _, ok := compressPayload(CT_FLATE, gz); ok {
+		t.Error("gzip payload should not be compressed again")
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "image/png")
+	if !isCompressedContent(header) {
+		t.Error("png should be treated as compressed")
+	}
+	header.Set("Content-Type", "text/html")
+	if isCompressedContent(header) {
+		t.Error("html should not be treated as compressed")
+	}
+	header.Set("Content-Encoding", "gzip")
+	if !isCompressedContent(header) {
+		t.Error("gzip encoding should be treated as compressed")
+	}
+}
+
+func TestTunnelWriterGiveUpCompress(t *testing.T) {
+	sendChan := make(chan *Msg, 10)
+	writer := &TunnelWriter{
+		sendChan:    sendChan,
+		msgMaker:    &msgBuilder{defaultFlags: FLAG_TCP},
+		compression: CT_FLATE,
+	}
+	for i := 0; i < MAX_COMPRESS_MISS; i++ {
+		writer.Write(makeTestBody(1024, int64(i)))
+		<-sendChan
+	}
+	text := []byte(strings.Repeat("hello world\n", 100))
+	writer.Write(text)
+	msg := <-sendChan
+	if ct := msg.Body.(*TcpData).ContentType; ct != CT_RAW {
+		t.Errorf("should give up compressing after %d misses, got %s", MAX_COMPRESS_MISS, ctName(ct))
+	}
+}
+
+func TestHttpWorkerCompressDiff(t *testing.T) {
+	var count int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count += 1
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "version %d\n", count)
+		for i := 0; i < 2000; i++ {
+			fmt.Fprintf(w, "line %d of the page\n", i)
+		}
+	}))
+	defer ts.Close()
+
+	pid := fmt.Sprintf("%x", bytes.Join(testEnvelope, nil))
+	cm := makeCacheManager()
+	cm.SetPeerDiffs(pid, SupportedDiffs())
+	factory := &HttpWorkerFactory{cm: cm, retained: newRetainStore(MAX_RETAIN_SIZE, MAX_RETAIN_PEER_SIZE, RETAIN_TTL)}
+	clientCache := makeCache()
+	req, _ := http.NewRequest("GET", ts.URL+"/page", nil)
+
+	body, rawWire := readHttpStreamWire(t, factory, clientCache, req)
+	if !strings.HasPrefix(body, "version 1\n") {
+		t.Fatalf("first response not right, got len %d", len(body))
+	}
+
+	cm.SetPeerCompression(pid, CT_FLATE)
+	clientCache = makeCache()
+	body, wire := readHttpStreamWire(t, factory, clientCache, req)
+	if !strings.HasPrefix(body, "version 2\n") {
+		t.Fatalf("compressed response not right, got len %d", len(body))
+	}
+	if wire > rawWire/2 {
+		t.Errorf("response should be compressed, raw %d compressed %d", rawWire, wire)
+	}
+
+	//the line diff is compressed as well
+	cacheKey := makeCacheKey(req)
+	digest, _ := clientCache.GetDigest(cacheKey)
+	cm.UpdatePeer(pid, &CacheItem{cacheKey, digest})
+	body, _ = readHttpStreamWire(t, factory, clientCache, req)
+	if !strings.HasPrefix(body, "version 3\n") || !strings.HasSuffix(body, "line 1999 of the page\n") {
+		t.Fatalf("diff response not right, got len %d", len(body))
+	}
+}
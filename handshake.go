@@ -0,0 +1,145 @@
+package dtunnel
+
+import (
+	"errors"
+	"fmt"
+	"github.com/vmihailenco/msgpack"
+	"os"
+)
+
+//larger raw payloads are split into several frames
+const MAX_FRAME_SIZE int = 8 * 1024 * 1024
+
+var ErrorIncompatibleVersion = errors.New("IncompatibleVersion")
+
+// HelloData is exchanged when the client connects, so both sides
+// know the protocol version and what the other can decode.
+// The server replies with what both sides agreed on.
+type HelloData struct {
+	Version  uint8
+	ClientId string
+	//every content type the sender can decode, diffs not in it are not used
+	ContentTypes []uint16
+	Diffs        []uint16
+	Compressions []uint16
+	MaxFrameSize int
+	//bytes in flight per stream before the receiver grants more, zero means no flow control
+	Window int
+	//the sender joins FLAG_MORE fragments
+	JoinFragments bool
+}
+
+func ctNames(cts []uint16) []string {
+	names := make([]string, len(cts))
+	for i, ct := range cts {
+		names[i] = CT_NAMES[ct]
+	}
+	return names
+}
+
+func (d *HelloData) String() string {
+	return fmt.Sprintf("version=%d client=%s content-types=%v diffs=%v compressions=%v max-frame=%d window=%d fragments=%v",
+		d.Version, d.ClientId, ctNames(d.ContentTypes), ctNames(d.Diffs), ctNames(d.Compressions), d.MaxFrameSize, d.Window, d.JoinFragments)
+}
+
+func (d *HelloData) MarshalBinary() (b []byte, err error) {
+	b, err = msgpack.Marshal(d)
+	return
+}
+
+func (d *HelloData) UnmarshalBinary(b []byte) (err error) {
+	err = msgpack.Unmarshal(b, d)
+	return
+}
+
+func SupportedContentTypes() []uint16 {
+	return append([]uint16{CT_RAW}, SupportedDiffs()...)
+}
+
+func makeHelloData(clientId string) *HelloData {
+	return &HelloData{
+		Version:       PROTOCOL_VERSION,
+		ClientId:      clientId,
+		ContentTypes:  SupportedContentTypes(),
+		Diffs:         SupportedDiffs(),
+		Compressions:  SupportedCompressions(),
+		MaxFrameSize:  MAX_FRAME_SIZE,
+		Window:        STREAM_WINDOW,
+		JoinFragments: true,
+	}
+}
+
+func makeHelloMsg(msgType uint16, envelope [][]byte, hello *HelloData) *Msg {
+	return &Msg{
+		Envelope: envelope,
+		Header:   &Header{Version: PROTOCOL_VERSION, MsgType: msgType},
+		Body:     hello,
+	}
+}
+
+func compatibleVersion(version uint8) bool {
+	return version >= MIN_PROTOCOL_VERSION && version <= PROTOCOL_VERSION
+}
+
+func versionError(version uint8) error {
+	return fmt.Errorf("%s: peer speaks version %d, we support %d to %d",
+		ErrorIncompatibleVersion, version, MIN_PROTOCOL_VERSION, PROTOCOL_VERSION)
+}
+
+// hello without version comes from a peer before versioning
+func helloVersion(hello *HelloData, headerVersion uint8) uint8 {
+	if hello.Version == 0 {
+		return headerVersion
+	}
+	return hello.Version
+}
+
+// negotiate checks a hello from the client and returns what both sides agree on
+func negotiate(hello *HelloData, headerVersion uint8) (*HelloData, error) {
+	version := helloVersion(hello, headerVersion)
+	if !compatibleVersion(version) {
+		return nil, versionError(version)
+	}
+	maxFrameSize := MAX_FRAME_SIZE
+	if hello.MaxFrameSize > 0 && hello.MaxFrameSize < maxFrameSize {
+		maxFrameSize = hello.MaxFrameSize
+	}
+	//a peer which doesn't send a window doesn't know WINDOW_UPDATE
+	window := hello.Window
+	if window > STREAM_WINDOW {
+		window = STREAM_WINDOW
+	}
+	contentTypes := SupportedContentTypes()
+	if hello.ContentTypes != nil {
+		contentTypes = intersectDiffs(contentTypes, hello.ContentTypes)
+	}
+	return &HelloData{
+		Version:       version,
+		ClientId:      hello.ClientId,
+		ContentTypes:  contentTypes,
+		Diffs:         intersectDiffs(intersectDiffs(SupportedDiffs(), hello.Diffs), contentTypes),
+		Compressions:  intersectDiffs(SupportedCompressions(), hello.Compressions),
+		MaxFrameSize:  maxFrameSize,
+		Window:        window,
+		JoinFragments: hello.JoinFragments,
+	}, nil
+}
+
+// diffs or compressions both sides support
+func intersectDiffs(a []uint16, b []uint16) []uint16 {
+	common := make([]uint16, 0)
+	for _, ct := range a {
+		if hasContentType(b, ct) {
+			common = append(common, ct)
+		}
+	}
+	return common
+}
+
+func defaultClientId() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
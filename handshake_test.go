@@ -0,0 +1,129 @@
+package dtunnel
+
+import (
+	"bytes"
+	zmq "github.com/pebbe/zmq4"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	hello := makeHelloData("client-1")
+	hello.Compressions = []uint16{CT_GZIP}
+	hello.MaxFrameSize = 1024
+	agreed, err := negotiate(hello, PROTOCOL_VERSION)
+	if err != nil {
+		t.Fatalf("negotiate fail %v", err)
+	}
+	if agreed.ClientId != "client-1" || agreed.MaxFrameSize != 1024 {
+		t.Errorf("agreed not right, got %s", agreed)
+	}
+	if len(agreed.Compressions) != 1 || agreed.Compressions[0] != CT_GZIP {
+		t.Errorf("compressions not right, got %v", agreed.Compressions)
+	}
+
+	//a diff the peer can't decode is not used, even if listed
+	hello = makeHelloData("client-1")
+	hello.ContentTypes = []uint16{CT_RAW, CT_LINE_DIFF}
+	agreed, _ = negotiate(hello, PROTOCOL_VERSION)
+	if len(agreed.Diffs) != 1 || agreed.Diffs[0] != CT_LINE_DIFF {
+		t.Errorf("diffs should be limited by content types, got %v", ctNames(agreed.Diffs))
+	}
+
+	//hello from a peer before versioning
+	agreed, err = negotiate(&HelloData{Diffs: []uint16{CT_CACHE_DIFF}}, VERSION_1)
+	if err != nil || agreed.Version != VERSION_1 || agreed.MaxFrameSize != MAX_FRAME_SIZE {
+		t.Errorf("old hello should be accepted, got %v %v", agreed, err)
+	}
+
+	_, err = negotiate(&HelloData{Version: PROTOCOL_VERSION + 1}, PROTOCOL_VERSION+1)
+	if err == nil || !strings.Contains(err.Error(), ErrorIncompatibleVersion.Error()) {
+		t.Errorf("newer version should be rejected, got %v", err)
+	}
+}
+
+func TestTunnelWriterSplitFrames(t *testing.T) {
+	sendChan := make(chan *Msg, 10)
+	writer := &TunnelWriter{
+		sendChan:     sendChan,
+		msgMaker:     &msgBuilder{defaultFlags: FLAG_TCP},
+		maxFrameSize: 100,
+	}
+	data := makeTestBody(250, 1)
+	writer.send(CT_RAW, data, FLAG_STREAM_END)
+	close(sendChan)
+
+	got := make([]byte, 0)
+	var frames int
+	for msg := range sendChan {
+		frames += 1
+		payload := msg.Body.(*TcpData).GetPayload()
+		if len(payload) > 100 {
+			t.Errorf("frame too large, got %d", len(payload))
+		}
+		if msg.IsEndOfStream() != (frames == 3) {
+			t.Errorf("only the last frame should end the stream, frame %d", frames)
+		}
+		got = append(got, payload...)
+	}
+	if frames != 3 || !bytes.Equal(got, data) {
+		t.Errorf("split not right, got %d frames len %d", frames, len(got))
+	}
+}
+
+func TestTunnelServerRejectVersion(t *testing.T) {
+	addr := "inproc://test-reject-version"
+	ts, _ := NewTunnelServer(addr)
+	go ts.Run()
+
+	socket, _ := zmq.NewSocket(zmq.DEALER)
+	defer socket.Close()
+	socket.Connect(addr)
+	hello := makeHelloData("client-1")
+	hello.Version = PROTOCOL_VERSION + 1
+	frames, _ := toFrames(makeHelloMsg(HELLO, [][]byte{[]byte("")}, hello))
+	socket.SendMessage(frames)
+
+	frames, err := socket.RecvMessageBytes(0)
+	if err != nil {
+		t.Fatalf("recv fail %v", err)
+	}
+	msg, err := fromFrames(frames)
+	if err != nil || msg.GetMsgType() != ERROR {
+		t.Fatalf("expect ERROR, got %v %v", msg, err)
+	}
+	if !strings.Contains(msg.Body.(*ErrorData).String(), ErrorIncompatibleVersion.Error()) {
+		t.Errorf("error not right, got %s", msg.Body)
+	}
+}
+
+func TestTunnelClientRejected(t *testing.T) {
+	addr := "inproc://test-client-rejected"
+	server, _ := zmq.NewSocket(zmq.ROUTER)
+	defer server.Close()
+	server.Bind(addr)
+
+	tc, _ := NewTunnelClient(addr)
+	done := make(chan error, 1)
+	go func() {
+		done <- tc.Run()
+	}()
+
+	frames, _ := server.RecvMessageBytes(0)
+	hello, err := fromFrames(frames)
+	if err != nil || hello.GetMsgType() != HELLO {
+		t.Fatalf("expect HELLO, got %v %v", hello, err)
+	}
+	frames, _ = toFrames(NewMsgBuilderFromMsg(hello).MakeErrorMsg(versionError(hello.Header.Version), 0))
+	server.SendMessage(frames)
+
+	err = <-done
+	if err == nil || !strings.Contains(err.Error(), ErrorIncompatibleVersion.Error()) {
+		t.Errorf("Run should fail with version error, got %v", err)
+	}
+	req, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	if _, err := tc.RoundTrip(req); err != tc.Err() || err == nil {
+		t.Errorf("RoundTrip should fail after rejected, got %v", err)
+	}
+}
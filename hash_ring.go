@@ -0,0 +1,67 @@
+package dtunnel
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+//points of each node on the ring, more points spread keys more evenly
+const RING_REPLICAS = 100
+
+// hashRing maps keys to nodes by consistent hashing, adding or removing
+// a node only moves the keys of that node
+type hashRing struct {
+	hashes []uint32
+	nodes  map[uint32]string
+}
+
+func newHashRing() *hashRing {
+	return &hashRing{nodes: make(map[uint32]string)}
+}
+
+func (r *hashRing) Add(node string) {
+	for i := 0; i < RING_REPLICAS; i++ {
+		h := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + node))
+		if _, ok := r.nodes[h]; ok {
+			continue
+		}
+		r.nodes[h] = node
+		r.hashes = append(r.hashes, h)
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+}
+
+func (r *hashRing) Remove(node string) {
+	hashes := r.hashes[:0]
+	for _, h := range r.hashes {
+		if r.nodes[h] == node {
+			delete(r.nodes, h)
+			continue
+		}
+		hashes = append(hashes, h)
+	}
+	r.hashes = hashes
+}
+
+// Get the node of key, the next one on the ring if accept refuses it.
+// Returns "" if no node is accepted
+func (r *hashRing) Get(key []byte, accept func(node string) bool) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := crc32.ChecksumIEEE(key)
+	start := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	refused := make(map[string]bool)
+	for i := 0; i < len(r.hashes); i++ {
+		node := r.nodes[r.hashes[(start+i)%len(r.hashes)]]
+		if refused[node] {
+			continue
+		}
+		if accept == nil || accept(node) {
+			return node
+		}
+		refused[node] = true
+	}
+	return ""
+}
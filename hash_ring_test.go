@@ -0,0 +1,61 @@
+package dtunnel
+
+import (
+	"fmt"
+	"testing"
+)
+
+func ringOwners(r *hashRing, n int) []string {
+	owners := make([]string, n)
+	for i := range owners {
+		owners[i] = r.Get([]byte(fmt.Sprintf("http://www.example.com/%d", i)), nil)
+	}
+	return owners
+}
+
+func TestHashRing(t *testing.T) {
+	r := newHashRing()
+	if node := r.Get([]byte("key"), nil); node != "" {
+		t.Errorf("empty ring should have no node, got %s", node)
+	}
+	r.Add("a")
+	r.Add("b")
+	r.Add("c")
+	before := ringOwners(r, 1000)
+	counts := make(map[string]int)
+	for _, node := range before {
+		counts[node] += 1
+	}
+	for _, node := range []string{"a", "b", "c"} {
+		if counts[node] < 200 {
+			t.Errorf("keys not spread evenly, %s got %d", node, counts[node])
+		}
+	}
+
+	//only the keys of a removed node move
+	r.Remove("b")
+	after := ringOwners(r, 1000)
+	for i := range before {
+		if after[i] == "b" || (before[i] != "b" && after[i] != before[i]) {
+			t.Fatalf("key %d moved from %s to %s", i, before[i], after[i])
+		}
+	}
+	//and only to an added node
+	r.Add("d")
+	added := ringOwners(r, 1000)
+	for i := range after {
+		if added[i] != after[i] && added[i] != "d" {
+			t.Fatalf("key %d moved from %s to %s", i, after[i], added[i])
+		}
+	}
+
+	key := []byte("http://www.example.com/")
+	owner := r.Get(key, nil)
+	next := r.Get(key, func(node string) bool { return node != owner })
+	if next == "" || next == owner {
+		t.Errorf("refused node should be passed over, got %s", next)
+	}
+	if node := r.Get(key, func(string) bool { return false }); node != "" {
+		t.Errorf("should get no node if all refused, got %s", node)
+	}
+}
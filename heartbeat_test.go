@@ -0,0 +1,166 @@
+package dtunnel
+
+import (
+	"bytes"
+	zmq "github.com/pebbe/zmq4"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func recvMsg(t *testing.T, socket *zmq.Socket, msgType uint16) *Msg {
+	for {
+		frames, err := socket.RecvMessageBytes(0)
+		if err != nil {
+			t.Fatalf("recv fail %v", err)
+		}
+		msg, err := fromFrames(frames)
+		if err != nil {
+			t.Fatalf("invalid frames %v", err)
+		}
+		if msg.GetMsgType() == msgType {
+			return msg
+		}
+	}
+}
+
+func TestTunnelClientReconnect(t *testing.T) {
+	addr := "inproc://test-client-reconnect"
+	server, _ := zmq.NewSocket(zmq.ROUTER)
+	defer server.Close()
+	server.Bind(addr)
+
+	tc, _ := NewTunnelClient(addr)
+	tc.SetHeartbeat(20*time.Millisecond, 100*time.Millisecond)
+	go tc.Run()
+	defer tc.Close()
+
+	hello := recvMsg(t, server, HELLO)
+	frames, _ := toFrames(makeHelloMsg(HELLO_REP, hello.Envelope, makeHelloData("")))
+	server.SendMessage(frames)
+
+	//the server never answers, the request should fail instead of hanging
+	req, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	reader, err := tc.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip fail %v", err)
+	}
+	recvMsg(t, server, PING)
+	_, err = ioutil.ReadAll(reader)
+	if err == nil || err.Error() != ErrorPeerTimeout.Error() {
+		t.Errorf("expect PeerTimeout, got %v", err)
+	}
+
+	again := recvMsg(t, server, HELLO)
+	if bytes.Equal(again.Envelope[0], hello.Envelope[0]) {
+		t.Error("should reconnect with a new socket")
+	}
+}
+
+func TestTunnelServerPing(t *testing.T) {
+	addr := "inproc://test-server-ping"
+	ts, _ := NewTunnelServer(addr)
+	go ts.Run()
+
+	socket, _ := zmq.NewSocket(zmq.DEALER)
+	defer socket.Close()
+	socket.Connect(addr)
+	send := func(msg *Msg) {
+		frames, _ := toFrames(msg)
+		socket.SendMessage(frames)
+	}
+
+	//unknown peer is asked to say hello
+	send(makeReqMsg(UID{}, PING, CT_RAW, []byte(""), 0))
+	recvMsg(t, socket, HELLO)
+
+	send(makeHelloMsg(HELLO, [][]byte{[]byte("")}, makeHelloData("client-1")))
+	recvMsg(t, socket, HELLO_REP)
+	send(makeReqMsg(UID{}, PING, CT_RAW, []byte(""), 0))
+	recvMsg(t, socket, PONG)
+}
+
+type blockingWorker struct {
+	reqChan chan *Msg
+	done    chan error
+}
+
+func (w *blockingWorker) GetReqChannel() chan *Msg {
+	return w.reqChan
+}
+
+func (w *blockingWorker) Run(repChan chan *Msg) error {
+	reader := &TunnelReader{recvChan: w.reqChan}
+	_, err := ioutil.ReadAll(reader)
+	w.done <- err
+	return err
+}
+
+type blockingWorkerFactory struct {
+	done chan error
+}
+
+func (f *blockingWorkerFactory) MakeStreamWorker(sid UID) Worker {
+	return &blockingWorker{make(chan *Msg, 1), f.done}
+}
+
+func TestMultiStreamWorkerReap(t *testing.T) {
+	done := make(chan error, 2)
+	w := newMultiStreamWorker(&blockingWorkerFactory{done})
+	go w.Run(make(chan *Msg, 10))
+
+	alive := [][]byte{[]byte("client-2"), []byte("")}
+	for _, envelope := range [][][]byte{testEnvelope, alive} {
+		msgMaker := NewMsgBuilder(MakeUID(), envelope, FLAG_TCP)
+		w.GetReqChannel() <- msgMaker.MakeMsg(TCP_DATA, CT_RAW, []byte("hello"), FLAG_STREAM_BEGIN)
+	}
+
+	dead := (&Msg{Envelope: testEnvelope}).GetPeerId()
+	w.Reap(dead)
+	select {
+	case err := <-done:
+		if err == nil || err.Error() != ErrorPeerTimeout.Error() {
+			t.Errorf("expect PeerTimeout, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("stream of dead peer should be reaped")
+	}
+	select {
+	case <-done:
+		t.Error("stream of alive peer should not be reaped")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+type countingWorkerFactory struct {
+	made int32
+}
+
+func (f *countingWorkerFactory) MakeStreamWorker(sid UID) Worker {
+	atomic.AddInt32(&f.made, 1)
+	return &blockingWorker{make(chan *Msg, 1), make(chan error, 1)}
+}
+
+func TestMultiStreamWorkerFinishedStream(t *testing.T) {
+	factory := &countingWorkerFactory{}
+	w := newMultiStreamWorker(factory)
+	go w.Run(make(chan *Msg, 10))
+
+	msgMaker := NewMsgBuilder(MakeUID(), testEnvelope, FLAG_TCP)
+	w.GetReqChannel() <- msgMaker.MakeMsg(TCP_DATA, CT_RAW, []byte("hello"), FLAG_STREAM_BEGIN)
+	w.GetReqChannel() <- msgMaker.MakeMsg(TCP_DATA, CT_RAW, []byte(""), FLAG_STREAM_END)
+	for wait := 0; wait < 100 && w.Len() > 0; wait++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if w.Len() != 0 {
+		t.Fatal("stream should end")
+	}
+	//still in flight when the stream ended, the second is taken once the first is handled
+	w.GetReqChannel() <- msgMaker.MakeMsg(TCP_DATA, CT_RAW, []byte("late"), 0)
+	w.GetReqChannel() <- msgMaker.MakeMsg(TCP_DATA, CT_RAW, []byte("later"), 0)
+	if w.Len() != 0 || atomic.LoadInt32(&factory.made) != 1 {
+		t.Errorf("late msg should not start another worker, made %d", factory.made)
+	}
+}
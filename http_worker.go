@@ -2,7 +2,8 @@ package dtunnel
 
 import (
 	"bufio"
-	"log"
+	"context"
+	"errors"
 	"net/http"
 	"time"
 )
@@ -10,12 +11,61 @@ import (
 const (
 	MAX_CACHE_SIZE int = 5 * 1024 * 1024
 	MAX_BUFF_SIZE  int = 500 * 1024
+	//a body not received in full by then is streamed
+	MAX_DELAY = 2 * time.Second
+	//a streamed body is flushed after waiting this long
+	FLUSH_DELAY = 10 * time.Millisecond
 )
 
+var ErrorRetainedNotFound = errors.New("RetainedNotFound")
+
+// HttpConfig tunes how the server sends responses, zero fields take the defaults
+type HttpConfig struct {
+	//larger bodies are streamed, not diffed as a whole, MAX_CACHE_SIZE
+	MaxCacheSize int
+	//buffer of a streamed body, MAX_BUFF_SIZE
+	MaxBuffSize int
+	//MAX_DELAY
+	MaxDelay time.Duration
+	//FLUSH_DELAY
+	FlushDelay time.Duration
+}
+
+func (c HttpConfig) withDefaults() HttpConfig {
+	if c.MaxCacheSize <= 0 {
+		c.MaxCacheSize = MAX_CACHE_SIZE
+	}
+	if c.MaxBuffSize <= 0 {
+		c.MaxBuffSize = MAX_BUFF_SIZE
+	}
+	if c.MaxDelay <= 0 {
+		c.MaxDelay = MAX_DELAY
+	}
+	if c.FlushDelay <= 0 {
+		c.FlushDelay = FLUSH_DELAY
+	}
+	return c
+}
+
 type HttpWorker struct {
-	reqChan chan *Msg
-	ht      *http.Transport
-	cm      *CacheManager
+	reqChan  chan *Msg
+	ht       http.RoundTripper
+	cm       *CacheManager
+	retained *retainStore
+	config   HttpConfig
+	//canceled when the peer resets the stream, aborts the request
+	ctx    context.Context
+	cancel context.CancelFunc
+	window *sendWindow
+}
+
+func (w *HttpWorker) Cancel() {
+	w.cancel()
+	w.window.close()
+}
+
+func (w *HttpWorker) UpdateWindow(n int) {
+	w.window.grant(n)
 }
 
 func (w *HttpWorker) GetReqChannel() chan *Msg {
@@ -27,58 +77,141 @@ func (w *HttpWorker) Run(repChan chan *Msg) error {
 	msgMaker := NewMsgBuilderFromMsg(firstMsg)
 
 	var err error
+	defer w.cancel()
 	defer func() {
-		if err != nil {
+		//nobody is waiting for a reset stream
+		if err != nil && w.ctx.Err() == nil {
 			repChan <- msgMaker.MakeErrorMsg(err, 0)
 		}
 	}()
 
-	reader := &TunnelReader{recvChan: w.reqChan, initMsg: firstMsg}
+	if firstMsg.GetMsgType() == CACHE_MISS {
+		err = w.resend(firstMsg, repChan, msgMaker)
+		return err
+	}
+
+	reader := &TunnelReader{recvChan: w.reqChan, initMsg: firstMsg, aborted: w.ctx.Done()}
+	reader.maxFrameSize = w.cm.GetPeerMaxFrameSize(firstMsg.GetPeerId())
 	req, err := http.ReadRequest(bufio.NewReader(reader))
 	if err != nil {
-		log.Printf("read request errror: %v", err)
+		logger.Printf("read request errror: %v", err)
 		return err
 	}
-	resp, err := w.ht.RoundTrip(req)
+	resp, err := w.ht.RoundTrip(req.WithContext(w.ctx))
 	if err != nil {
-		log.Printf("round trip errror: %v", err)
+		logger.Printf("round trip errror: %v", err)
 		return err
 	}
 
-	cacheAble := resp.ContentLength < int64(MAX_CACHE_SIZE)
+	cacheAble := resp.ContentLength < int64(w.config.MaxCacheSize)
 
-	writer := &TunnelWriter{
-		sendChan: repChan,
-		msgMaker: msgMaker,
+	writer := newPeerWriter(w.cm, firstMsg.GetPeerId(), repChan, msgMaker)
+	writer.window = w.window.open(w.cm.GetPeerWindow(firstMsg.GetPeerId()))
+	writer.priority = httpPriority(req, resp)
+	if isCompressedContent(resp.Header) {
+		writer.compression = CT_RAW
+	}
+	cacheKey := makeCacheKey(req)
+	digest, _ := w.cm.GetPeerDigest(firstMsg.GetPeerId(), cacheKey)
+	diffs := w.cm.GetPeerDiffs(firstMsg.GetPeerId())
+	differ := chooseDiffer(resp.Header.Get("Content-Type"), resp.ContentLength, diffs)
+	cwriter := NewCachedTunnelWriter(writer, NewCacheCompressorDiffer(w.cm.local, cacheKey, digest, true, differ))
+	cwriter.maxCacheSize, cwriter.maxDelay = w.config.MaxCacheSize, w.config.MaxDelay
+	//the first stream frame carries the buffered body, it has to fit in a frame of the peer
+	if limit := writer.maxFrameSize - writer.maxFrameSize/8; limit > 0 && cwriter.maxCacheSize > limit {
+		cwriter.maxCacheSize = limit
+	}
+	//a streamed body may be too large to keep, it has to be fetched again on CACHE_MISS
+	cwriter.noStream = !hasContentType(diffs, CT_STREAM_DIFF) || !isReplayable(req)
+	pid, sid := firstMsg.GetPeerId(), firstMsg.GetStreamId()
+	w.retained.begin(pid, sid)
+	defer w.retained.end(pid, sid)
+	cwriter.retain = func(data []byte) {
+		if !w.retained.put(pid, sid, data) && isReplayable(req) {
+			w.retained.putRequest(pid, sid, req.WithContext(context.Background()))
+		}
 	}
 	if cacheAble {
-		cacheKey := makeCacheKey(req)
-		digest, _ := w.cm.GetPeerDigest("global", cacheKey)
-		cwriter := NewCachedTunnelWriter(writer, NewCacheCompressor(w.cm.local, cacheKey, digest, true))
-		resp.Write(cwriter)
-		cwriter.Close()
+		err = resp.Write(cwriter)
 	} else {
-		log.Printf("result is not cacheable, content-length %d", resp.ContentLength)
-		bw := &TimeoutWriter{bw: bufio.NewWriterSize(writer, MAX_BUFF_SIZE), timeout: 10 * time.Millisecond}
-		resp.Write(bw)
+		logger.Printf("result is too large to diff at once, stream it, content-length %d", resp.ContentLength)
+		cwriter.maxCacheSize = 0
+		bw := &TimeoutWriter{bw: bufio.NewWriterSize(cwriter, w.config.MaxBuffSize), timeout: w.config.FlushDelay}
+		err = resp.Write(bw)
 		bw.Flush()
-		writer.Close()
 	}
+	if err != nil {
+		//don't end a broken or reset body as if it's complete
+		logger.Printf("write response error: %v", err)
+		return err
+	}
+	cwriter.Close()
 	return nil
 }
 
+// resend the raw body of a stream whose diff the peer could not apply,
+// the stream id is in the payload
+func (w *HttpWorker) resend(msg *Msg, repChan chan *Msg, msgMaker MsgBuilder) error {
+	var sid UID
+	copy(sid[:], msg.Body.(*TcpData).GetPayload())
+	retained, ok := w.retained.wait(w.ctx, msg.GetPeerId(), sid)
+	if !ok {
+		logger.Printf("[%x] no retained body for cache miss", sid)
+		return ErrorRetainedNotFound
+	}
+	writer := newPeerWriter(w.cm, msg.GetPeerId(), repChan, msgMaker)
+	writer.window = w.window.open(w.cm.GetPeerWindow(msg.GetPeerId()))
+	if retained.req == nil {
+		logger.Printf("[%x] resend full body len %d", sid, len(retained.data))
+		return writer.send(CT_RAW, retained.data, FLAG_STREAM_END)
+	}
+	logger.Printf("[%x] body was too large to keep, fetch %s again", sid, retained.req.URL)
+	resp, err := w.ht.RoundTrip(retained.req.WithContext(w.ctx))
+	if err != nil {
+		return err
+	}
+	if err = resp.Write(writer); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// isReplayable tells if req can be sent again to fetch the same body
+func isReplayable(req *http.Request) bool {
+	return (req.Method == "GET" || req.Method == "HEAD") && (req.Body == nil || req.Body == http.NoBody)
+}
+
 type HttpWorkerFactory struct {
-	cm *CacheManager
+	cm       *CacheManager
+	retained *retainStore
+	//shared by all streams so idle connections are reused, http.DefaultTransport if nil
+	ht     http.RoundTripper
+	config HttpConfig
+}
+
+func newHttpWorkerFactory(cm *CacheManager) *HttpWorkerFactory {
+	return &HttpWorkerFactory{
+		cm:       cm,
+		retained: newRetainStore(MAX_RETAIN_SIZE, MAX_RETAIN_PEER_SIZE, RETAIN_TTL),
+		ht:       new(http.Transport),
+	}
 }
 
 func (s *HttpWorkerFactory) MakeStreamWorker(sid UID) Worker {
-	return &HttpWorker{make(chan *Msg, 10), new(http.Transport), s.cm}
+	ht := s.ht
+	if ht == nil {
+		ht = http.DefaultTransport
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &HttpWorker{make(chan *Msg, 10), ht, s.cm, s.retained, s.config.withDefaults(), ctx, cancel, newSendWindow()}
 }
 
 func NewMultiStreamHttpWorker(cm *CacheManager) Worker {
-	return &MultiStreamWorker{
-		factory: &HttpWorkerFactory{cm: cm},
-		workers: make(map[UID]Worker),
-		reqChan: make(chan *Msg),
-	}
+	return newMultiStreamHttpWorker(newHttpWorkerFactory(cm))
+}
+
+func newMultiStreamHttpWorker(factory *HttpWorkerFactory) *MultiStreamWorker {
+	w := newMultiStreamWorker(factory)
+	w.cm = factory.cm
+	return w
 }
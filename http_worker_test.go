@@ -0,0 +1,173 @@
+package dtunnel
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var testEnvelope = [][]byte{[]byte("client-1"), []byte("")}
+
+//feed a http request into a new HttpWorker, returns the channel of response msgs
+func startHttpStream(factory StreamWorkerMaker, req *http.Request) (UID, chan *Msg) {
+	sid := MakeUID()
+	worker := factory.MakeStreamWorker(sid)
+	repChan := make(chan *Msg, 10)
+	go worker.Run(repChan)
+
+	buff := new(bytes.Buffer)
+	req.WriteProxy(buff)
+	msgMaker := NewMsgBuilder(sid, testEnvelope, FLAG_HTTP|FLAG_TCP)
+	worker.GetReqChannel() <- msgMaker.MakeMsg(TCP_DATA, CT_RAW, buff.Bytes(), FLAG_STREAM_BEGIN)
+	worker.GetReqChannel() <- msgMaker.MakeMsg(TCP_DATA, CT_RAW, []byte(""), FLAG_STREAM_END)
+	return sid, repChan
+}
+
+//count the payload bytes of msgs passing through, the total is sent to wire at stream end
+func teeStream(in chan *Msg, wire chan int) chan *Msg {
+	out := make(chan *Msg, 10)
+	go func() {
+		var n int
+		for msg := range in {
+			n += len(msg.Body.(*TcpData).GetPayload())
+			out <- msg
+			if msg.IsEndOfStream() {
+				break
+			}
+		}
+		wire <- n
+	}()
+	return out
+}
+
+func readHttpStream(t *testing.T, factory StreamWorkerMaker, cache Cache, req *http.Request) string {
+	body, _ := readHttpStreamWire(t, factory, cache, req)
+	return body
+}
+
+func readHttpStreamWire(t *testing.T, factory StreamWorkerMaker, cache Cache, req *http.Request) (string, int) {
+	wire := make(chan int, 1)
+	sid, repChan := startHttpStream(factory, req)
+	repChan = teeStream(repChan, wire)
+	resend := func() chan *Msg {
+		newSid := MakeUID()
+		worker := factory.MakeStreamWorker(newSid)
+		ch := make(chan *Msg, 10)
+		go worker.Run(ch)
+		msgMaker := NewMsgBuilder(newSid, testEnvelope, FLAG_HTTP|FLAG_TCP)
+		worker.GetReqChannel() <- msgMaker.MakeMsg(CACHE_MISS, CT_RAW, sid[:], FLAG_STREAM_BEGIN)
+		return ch
+	}
+	reader := &CachedTunnelReader{
+		&TunnelReader{recvChan: repChan, cache: cache, resend: resend},
+		cache,
+		makeCacheKey(req),
+		new(bytes.Buffer),
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(reader), req)
+	if err != nil {
+		t.Fatalf("fail to read response %v", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("fail to read body %v", err)
+	}
+	reader.Close()
+	return string(body), <-wire
+}
+
+func TestHttpWorkerResendOnCacheMiss(t *testing.T) {
+	var count int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count += 1
+		fmt.Fprintf(w, "hello world, version %d", count)
+	}))
+	defer ts.Close()
+
+	cm := makeCacheManager()
+	factory := &HttpWorkerFactory{cm: cm, retained: newRetainStore(MAX_RETAIN_SIZE, MAX_RETAIN_PEER_SIZE, RETAIN_TTL)}
+	clientCache := makeCache()
+
+	req, _ := http.NewRequest("GET", ts.URL+"/page", nil)
+	body := readHttpStream(t, factory, clientCache, req)
+	if body != "hello world, version 1" {
+		t.Fatalf("first response not right, got %s", body)
+	}
+
+	//share the digest, then corrupt the client copy behind the server's back
+	cacheKey := makeCacheKey(req)
+	digest, _ := clientCache.GetDigest(cacheKey)
+	cm.UpdatePeer(fmt.Sprintf("%x", bytes.Join(testEnvelope, nil)), &CacheItem{cacheKey, digest})
+	clientCache.Set(cacheKey, []byte("corrupted"))
+
+	body = readHttpStream(t, factory, clientCache, req)
+	if body != "hello world, version 2" {
+		t.Fatalf("second response not right, got %s", body)
+	}
+}
+
+func TestHttpWorkerRefetchOnCacheMiss(t *testing.T) {
+	var count int
+	//larger than a kept request counts for
+	padding := strings.Repeat(".", RETAIN_REQUEST_SIZE)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count += 1
+		fmt.Fprintf(w, "hello world, version %d%s", count, padding)
+	}))
+	defer ts.Close()
+
+	cm := makeCacheManager()
+	//too small to keep the body
+	factory := &HttpWorkerFactory{cm: cm, retained: newRetainStore(MAX_RETAIN_SIZE, RETAIN_REQUEST_SIZE, RETAIN_TTL)}
+	clientCache := makeCache()
+
+	req, _ := http.NewRequest("GET", ts.URL+"/page", nil)
+	readHttpStream(t, factory, clientCache, req)
+	cacheKey := makeCacheKey(req)
+	digest, _ := clientCache.GetDigest(cacheKey)
+	cm.UpdatePeer(fmt.Sprintf("%x", bytes.Join(testEnvelope, nil)), &CacheItem{cacheKey, digest})
+	clientCache.Set(cacheKey, []byte("corrupted"))
+
+	body := readHttpStream(t, factory, clientCache, req)
+	if body != "hello world, version 3"+padding {
+		t.Fatalf("body should be fetched again, got %s", body)
+	}
+}
+
+func TestHttpWorkerStreamDiff(t *testing.T) {
+	content := makeTestBody(MAX_CACHE_SIZE+1024*1024, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(content)))
+		w.Write(content)
+	}))
+	defer ts.Close()
+
+	cm := makeCacheManager()
+	cm.SetPeerDiffs(fmt.Sprintf("%x", bytes.Join(testEnvelope, nil)), SupportedDiffs())
+	factory := &HttpWorkerFactory{cm: cm, retained: newRetainStore(MAX_RETAIN_SIZE, MAX_RETAIN_PEER_SIZE, RETAIN_TTL)}
+	clientCache := makeCache()
+
+	req, _ := http.NewRequest("GET", ts.URL+"/big", nil)
+	body, wire := readHttpStreamWire(t, factory, clientCache, req)
+	if body != string(content) {
+		t.Fatalf("first response not right, got len %d", len(body))
+	}
+
+	cacheKey := makeCacheKey(req)
+	digest, _ := clientCache.GetDigest(cacheKey)
+	cm.UpdatePeer(fmt.Sprintf("%x", bytes.Join(testEnvelope, nil)), &CacheItem{cacheKey, digest})
+	copy(content[1000:], []byte("changed"))
+
+	body, diffWire := readHttpStreamWire(t, factory, clientCache, req)
+	if body != string(content) {
+		t.Fatalf("second response not right, got len %d", len(body))
+	}
+	if diffWire > wire/10 {
+		t.Errorf("stream diff should be small, raw %d diff %d", wire, diffWire)
+	}
+}
@@ -0,0 +1,192 @@
+package dtunnel
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const (
+	DEFAULT_CACHE_BYTES   int = 256 * 1024 * 1024
+	DEFAULT_CACHE_ENTRIES int = 10000
+)
+
+var ErrorCacheTooLarge = errors.New("CacheTooLarge")
+
+// EvictNotifier is implemented by caches which drop entries on their own,
+// fn is called with the key of every entry leaving the cache
+type EvictNotifier interface {
+	NotifyEvict(fn func(key []byte))
+}
+
+type CacheConfig struct {
+	Type       string
+	Dir        string
+	MaxBytes   int
+	MaxEntries int
+}
+
+func NewCache(cfg *CacheConfig) (Cache, error) {
+	switch cfg.Type {
+	case "", "lru":
+		return NewLRUCache(cfg.MaxBytes, cfg.MaxEntries), nil
+	case "memory":
+		return newLocalCache(), nil
+	case "disk":
+		return NewDiskCache(cfg.Dir, cfg.MaxBytes, cfg.MaxEntries)
+	}
+	return nil, fmt.Errorf("unknown cache type %s", cfg.Type)
+}
+
+type lruEntry struct {
+	key    string
+	value  []byte
+	digest []byte
+}
+
+// LRUCache keeps at most maxEntries values and maxBytes bytes of values,
+// the least recently used entries are evicted first
+type LRUCache struct {
+	mu         sync.Mutex
+	ll         *list.List
+	items      map[string]*list.Element
+	size       int
+	maxBytes   int
+	maxEntries int
+	onEvict    func(key []byte)
+}
+
+func (c *LRUCache) Set(key []byte, value []byte) error {
+	if c.maxBytes > 0 && len(value) > c.maxBytes {
+		c.Del(key)
+		return ErrorCacheTooLarge
+	}
+	logger.Printf("set lru cache %x data len %d", key, len(value))
+
+	c.mu.Lock()
+	if el, ok := c.items[string(key)]; ok {
+		entry := el.Value.(*lruEntry)
+		c.size += len(value) - len(entry.value)
+		entry.value = value
+		entry.digest = c.Digest(value)
+		c.ll.MoveToFront(el)
+	} else {
+		entry := &lruEntry{string(key), value, c.Digest(value)}
+		c.items[entry.key] = c.ll.PushFront(entry)
+		c.size += len(value)
+	}
+	evicted := c.shrink()
+	c.mu.Unlock()
+
+	c.notify(evicted)
+	return nil
+}
+
+func (c *LRUCache) Get(key []byte) (value []byte, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[string(key)]
+	if ok {
+		c.ll.MoveToFront(el)
+		value = el.Value.(*lruEntry).value
+	}
+	return
+}
+
+func (c *LRUCache) GetDigest(key []byte) (digest []byte, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[string(key)]
+	if ok {
+		digest = el.Value.(*lruEntry).digest
+	}
+	return
+}
+
+func (c *LRUCache) Del(key []byte) bool {
+	c.mu.Lock()
+	el, ok := c.items[string(key)]
+	if ok {
+		c.remove(el)
+	}
+	c.mu.Unlock()
+
+	if ok {
+		c.notify([]string{string(key)})
+	}
+	return ok
+}
+
+func (c *LRUCache) Digest(data []byte) []byte {
+	return md5Digest(data)
+}
+
+func (c *LRUCache) NotifyEvict(fn func(key []byte)) {
+	c.mu.Lock()
+	c.onEvict = fn
+	c.mu.Unlock()
+}
+
+func (c *LRUCache) Items() []CacheItem {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	items := make([]CacheItem, 0, c.ll.Len())
+	for el := c.ll.Front(); el != nil; el = el.Next() {
+		entry := el.Value.(*lruEntry)
+		items = append(items, CacheItem{[]byte(entry.key), entry.digest})
+	}
+	return items
+}
+
+// Len returns the number of entries and the total bytes of values
+func (c *LRUCache) Len() (entries int, bytes int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len(), c.size
+}
+
+func (c *LRUCache) remove(el *list.Element) {
+	entry := c.ll.Remove(el).(*lruEntry)
+	delete(c.items, entry.key)
+	c.size -= len(entry.value)
+}
+
+//must hold c.mu
+func (c *LRUCache) shrink() (evicted []string) {
+	for c.ll.Len() > 0 && c.overflow() {
+		el := c.ll.Back()
+		evicted = append(evicted, el.Value.(*lruEntry).key)
+		c.remove(el)
+	}
+	return
+}
+
+func (c *LRUCache) overflow() bool {
+	return (c.maxEntries > 0 && c.ll.Len() > c.maxEntries) ||
+		(c.maxBytes > 0 && c.size > c.maxBytes)
+}
+
+//call without c.mu, the callback may send msg to peer
+func (c *LRUCache) notify(keys []string) {
+	c.mu.Lock()
+	fn := c.onEvict
+	c.mu.Unlock()
+	for _, key := range keys {
+		logger.Printf("evict lru cache %x", key)
+		if fn != nil {
+			fn([]byte(key))
+		}
+	}
+}
+
+// NewLRUCache create a cache bounded by maxBytes and maxEntries,
+// zero means no limit
+func NewLRUCache(maxBytes int, maxEntries int) *LRUCache {
+	return &LRUCache{
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+		maxBytes:   maxBytes,
+		maxEntries: maxEntries,
+	}
+}
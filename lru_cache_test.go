@@ -0,0 +1,73 @@
+package dtunnel
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLRUCacheMaxEntries(t *testing.T) {
+	cache := NewLRUCache(0, 2)
+	evicted := make([]string, 0)
+	cache.NotifyEvict(func(key []byte) {
+		evicted = append(evicted, string(key))
+	})
+
+	cache.Set([]byte("a"), []byte("1"))
+	cache.Set([]byte("b"), []byte("2"))
+	//touch a, so b is the oldest
+	cache.Get([]byte("a"))
+	cache.Set([]byte("c"), []byte("3"))
+
+	if _, ok := cache.Get([]byte("b")); ok {
+		t.Error("b should be evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := cache.Get([]byte(key)); !ok {
+			t.Errorf("%s should be in cache", key)
+		}
+	}
+	if len(evicted) != 1 || evicted[0] != "b" {
+		t.Errorf("evict callback not right, got %v", evicted)
+	}
+}
+
+func TestLRUCacheMaxBytes(t *testing.T) {
+	cache := NewLRUCache(10, 0)
+
+	cache.Set([]byte("a"), []byte("12345"))
+	cache.Set([]byte("b"), []byte("12345"))
+	cache.Set([]byte("c"), []byte("123"))
+
+	if _, ok := cache.Get([]byte("a")); ok {
+		t.Error("a should be evicted")
+	}
+	if entries, size := cache.Len(); entries != 2 || size != 8 {
+		t.Errorf("cache size not right, got %d entries %d bytes", entries, size)
+	}
+
+	err := cache.Set([]byte("b"), make([]byte, 11))
+	if err != ErrorCacheTooLarge {
+		t.Errorf("expect ErrorCacheTooLarge, got %v", err)
+	}
+	if _, ok := cache.Get([]byte("b")); ok {
+		t.Error("stale b should be removed")
+	}
+}
+
+func TestLRUCacheDigest(t *testing.T) {
+	cache := NewLRUCache(0, 0)
+	key := []byte("http://www.example.com")
+	value := []byte("hello world")
+
+	cache.Set(key, value)
+	digest, ok := cache.GetDigest(key)
+	if !ok || !bytes.Equal(digest, cache.Digest(value)) {
+		t.Errorf("digest not match, got %x", digest)
+	}
+
+	cache.Set(key, []byte("goodbye"))
+	digest, _ = cache.GetDigest(key)
+	if !bytes.Equal(digest, cache.Digest([]byte("goodbye"))) {
+		t.Errorf("digest should be updated, got %x", digest)
+	}
+}
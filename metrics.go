@@ -0,0 +1,348 @@
+package dtunnel
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// seconds, for the duration histograms
+var (
+	STREAM_DURATION_BUCKETS = []float64{0.01, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 1800}
+	DIFF_DURATION_BUCKETS   = []float64{0.0001, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+)
+
+// the metrics of all tunnels in the process, see WriteMetrics
+var (
+	metricBytes = newCounterVec("dtunnel_bytes_total",
+		"Bytes of msgs sent to or received from the peer.", "side", "direction")
+	metricMsgs = newCounterVec("dtunnel_msgs_total",
+		"Msgs sent to or received from the peer.", "side", "direction")
+	metricCompressBytes = newCounterVec("dtunnel_compress_bytes_total",
+		"Bytes of http bodies, as they are (kind=body) and as sent (kind=sent), CT_RAW when not diffed.", "content_type", "kind")
+	metricCacheLookups = newCounterVec("dtunnel_cache_lookups_total",
+		"Whether the peer has the cached version to diff a body against.", "result")
+	metricDecompressFailures = newCounterVec("dtunnel_decompress_failures_total",
+		"Diffs which could not be applied, the body is fetched again.")
+	metricUdpDropped = newCounterVec("dtunnel_udp_dropped_total",
+		"Datagrams dropped because their stream could not keep up, from the peer (in) or to it (out).", "direction")
+	metricDiffSeconds = newHistogramVec("dtunnel_diff_duration_seconds",
+		"Time spent making diffs of http bodies, CT_CACHE_DIFF is bsdiff, CT_STREAM_DIFF the frames of a streamed one.", DIFF_DURATION_BUCKETS, "content_type")
+	metricStreamSeconds = newHistogramVec("dtunnel_stream_duration_seconds",
+		"How long the workers of the streams the peer opened ran.", STREAM_DURATION_BUCKETS, "side", "worker")
+	metricActiveStreams = newGaugeVec("dtunnel_active_streams",
+		"Streams running now.", "side", "endpoint", "worker")
+	metricQueueLength = newGaugeVec("dtunnel_queue_length",
+		"Msgs waiting in a queue to be sent to the peer.", "side", "endpoint", "queue")
+	metricQueueBytes = newGaugeVec("dtunnel_queue_bytes",
+		"Bytes of the stream msgs waiting in a queue to be sent to the peer.", "side", "endpoint", "queue")
+
+	allMetrics = []metric{
+		metricBytes,
+		metricMsgs,
+		metricCompressBytes,
+		metricCacheLookups,
+		metricDecompressFailures,
+		metricUdpDropped,
+		metricDiffSeconds,
+		metricStreamSeconds,
+		metricActiveStreams,
+		metricQueueLength,
+		metricQueueBytes,
+	}
+)
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// labelKey joins label values, they are split again on output
+func labelKey(values []string) string {
+	return strings.Join(values, "\x00")
+}
+
+func formatLabels(names []string, key string, extra ...string) string {
+	pairs := make([]string, 0, len(names)+1)
+	if len(names) > 0 {
+		for i, value := range strings.Split(key, "\x00") {
+			pairs = append(pairs, fmt.Sprintf("%s=%s", names[i], strconv.Quote(value)))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", extra[i], strconv.Quote(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeHeader(w *bufio.Writer, name string, help string, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// counterVec is a counter for each set of label values
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.RWMutex
+	values map[string]*uint64
+}
+
+func newCounterVec(name string, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]*uint64)}
+}
+
+func (c *counterVec) add(n int, values ...string) {
+	key := labelKey(values)
+	c.mu.RLock()
+	v, ok := c.values[key]
+	c.mu.RUnlock()
+	if !ok {
+		c.mu.Lock()
+		if v, ok = c.values[key]; !ok {
+			v = new(uint64)
+			c.values[key] = v
+		}
+		c.mu.Unlock()
+	}
+	atomic.AddUint64(v, uint64(n))
+}
+
+func (c *counterVec) get(values ...string) uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if v, ok := c.values[labelKey(values)]; ok {
+		return atomic.LoadUint64(v)
+	}
+	return 0
+}
+
+func (c *counterVec) write(w *bufio.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	keys := make(map[string]bool, len(c.values))
+	for k := range c.values {
+		keys[k] = true
+	}
+	for _, k := range sortedKeys(keys) {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, formatLabels(c.labels, k), atomic.LoadUint64(c.values[k]))
+	}
+}
+
+// gaugeVec reads each gauge when written out, from the func set for its labels
+type gaugeVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	funcs  map[string]func() int
+}
+
+func newGaugeVec(name string, help string, labels ...string) *gaugeVec {
+	return &gaugeVec{name: name, help: help, labels: labels, funcs: make(map[string]func() int)}
+}
+
+// set reads the gauge from fn, nil removes it
+func (g *gaugeVec) set(fn func() int, values ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if fn == nil {
+		delete(g.funcs, labelKey(values))
+	} else {
+		g.funcs[labelKey(values)] = fn
+	}
+}
+
+func (g *gaugeVec) write(w *bufio.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	keys := make(map[string]bool, len(g.funcs))
+	for k := range g.funcs {
+		keys[k] = true
+	}
+	for _, k := range sortedKeys(keys) {
+		fmt.Fprintf(w, "%s%s %d\n", g.name, formatLabels(g.labels, k), g.funcs[k]())
+	}
+}
+
+type histogram struct {
+	//counts[i] is of the values <= buckets[i], the last one is +Inf
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// histogramVec is a histogram for each set of label values
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogram
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) observe(v float64, values ...string) {
+	key := labelKey(values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets)+1)}
+		h.values[key] = hist
+	}
+	i := sort.SearchFloat64s(h.buckets, v)
+	hist.counts[i]++
+	hist.sum += v
+	hist.count++
+}
+
+func (h *histogramVec) write(w *bufio.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make(map[string]bool, len(h.values))
+	for k := range h.values {
+		keys[k] = true
+	}
+	for _, k := range sortedKeys(keys) {
+		hist := h.values[k]
+		var cumulative uint64
+		for i, n := range hist.counts {
+			cumulative += n
+			le := math.Inf(1)
+			if i < len(h.buckets) {
+				le = h.buckets[i]
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, k, "le", formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, k), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, k), hist.count)
+	}
+}
+
+// observeSince records the seconds since start
+func (h *histogramVec) observeSince(start time.Time, values ...string) {
+	h.observe(time.Since(start).Seconds(), values...)
+}
+
+// metricsHooks counts the msgs of side, "server" or "client", sent (out)
+// to or received (in) from the peer, and times the streams the peer opened
+func metricsHooks(side string) *Hooks {
+	return &Hooks{
+		MsgSent: func(msg *Msg, size int) {
+			metricBytes.add(size, side, "out")
+			metricMsgs.add(1, side, "out")
+		},
+		MsgReceived: func(msg *Msg, size int) {
+			metricBytes.add(size, side, "in")
+			metricMsgs.add(1, side, "in")
+		},
+		StreamEnd: func(sid UID, flags uint16, d time.Duration) {
+			metricStreamSeconds.observe(d.Seconds(), side, streamKind(flags))
+		},
+	}
+}
+
+// streamKind names the worker of a stream by its flags
+func streamKind(flags uint16) string {
+	switch {
+	case flags&FLAG_HTTP != 0:
+		return "http"
+	case flags&FLAG_UDP != 0:
+		return "udp"
+	}
+	return "tcp"
+}
+
+// exportGauges sets the gauges read from s, or removes them
+func (s *TunnelServer) exportGauges(export bool) {
+	gauge := func(g *gaugeVec, fn func() int, name string) {
+		if !export {
+			fn = nil
+		}
+		g.set(fn, "server", s.endpoint, name)
+	}
+	gauge(metricActiveStreams, s.httpWorker.(*MultiStreamWorker).Len, "http")
+	gauge(metricActiveStreams, s.tcpWorker.(*MultiStreamWorker).Len, "tcp")
+	gauge(metricActiveStreams, s.udpWorker.(*MultiStreamWorker).Len, "udp")
+	gauge(metricActiveStreams, s.reverse.streams.Len, "reverse")
+	gauge(metricQueueLength, s.sched.Len, "scheduler")
+	gauge(metricQueueBytes, s.sched.Size, "scheduler")
+}
+
+// exportGauges sets the gauges read from c, or removes them. The streams
+// we opened are "proxy", those the server opened for exposed services "reverse"
+func (c *TunnelClient) exportGauges(export bool) {
+	gauge := func(g *gaugeVec, fn func() int, name string) {
+		if !export {
+			fn = nil
+		}
+		g.set(fn, "client", c.endpoint, name)
+	}
+	gauge(metricActiveStreams, c.streamCount, "proxy")
+	gauge(metricActiveStreams, c.tcpWorker.Len, "reverse")
+	gauge(metricQueueLength, c.sched.Len, "scheduler")
+	gauge(metricQueueBytes, c.sched.Size, "scheduler")
+}
+
+// WriteMetrics writes the metrics of all tunnels in the process,
+// in the Prometheus text exposition format
+func WriteMetrics(w io.Writer) error {
+	return writeMetrics(w, allMetrics)
+}
+
+func writeMetrics(w io.Writer, metrics []metric) error {
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// MetricsHandler serves WriteMetrics, for a Prometheus server to scrape
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteMetrics(w)
+	})
+}
+
+// ListenAndServeMetrics serves MetricsHandler on /metrics of bind
+func ListenAndServeMetrics(bind string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", MetricsHandler())
+	return http.ListenAndServe(bind, mux)
+}
@@ -0,0 +1,211 @@
+package dtunnel
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsFormat(t *testing.T) {
+	counter := newCounterVec("test_total", "A counter.", "a", "b")
+	counter.add(2, "x", "y")
+	counter.add(3, "x", "y")
+	counter.add(1, "x", "z")
+	hist := newHistogramVec("test_seconds", "A histogram.", []float64{0.1, 1}, "a")
+	hist.observe(0.5, "x")
+	hist.observe(0.1, "x")
+	hist.observe(5, "x")
+	gauge := newGaugeVec("test_gauge", "A gauge.", "a")
+	gauge.set(func() int { return 7 }, "x")
+	gauge.set(func() int { return 8 }, "y")
+	gauge.set(nil, "y")
+	plain := newCounterVec("test_plain_total", "No labels.")
+	plain.add(1)
+
+	buf := new(bytes.Buffer)
+	if err := writeMetrics(buf, []metric{counter, hist, gauge, plain}); err != nil {
+		t.Fatalf("writeMetrics fail %v", err)
+	}
+	expect := `# HELP test_total A counter.
+# TYPE test_total counter
+test_total{a="x",b="y"} 5
+test_total{a="x",b="z"} 1
+# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{a="x",le="0.1"} 1
+test_seconds_bucket{a="x",le="1"} 2
+test_seconds_bucket{a="x",le="+Inf"} 3
+test_seconds_sum{a="x"} 5.6
+test_seconds_count{a="x"} 3
+# HELP test_gauge A gauge.
+# TYPE test_gauge gauge
+test_gauge{a="x"} 7
+# HELP test_plain_total No labels.
+# TYPE test_plain_total counter
+test_plain_total 1
+`
+	if buf.String() != expect {
+		t.Errorf("expect\n%s\ngot\n%s", expect, buf.String())
+	}
+}
+
+func TestMetricsTunnel(t *testing.T) {
+	service := startEcho(t)
+	defer service.Close()
+
+	server, _ := NewServer("inproc://test-metrics")
+	go server.Run()
+	defer server.Close()
+	tc, _ := NewClient("inproc://test-metrics")
+	go tc.Run()
+	defer tc.Close()
+
+	sentBefore := metricBytes.get("client", "out")
+	streamsBefore := streamDurationCount("server", "tcp")
+	conn, err := tc.ConnectTcp(service.Addr().String())
+	if err != nil {
+		t.Fatalf("ConnectTcp fail %v", err)
+	}
+	if err := echo(conn, "hello"); err != nil {
+		t.Fatalf("echo fail %v", err)
+	}
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		body, _ := ioutil.ReadAll(rec.Body)
+		return string(body)
+	}
+	body := scrape()
+	for _, line := range []string{
+		`dtunnel_active_streams{side="server",endpoint="inproc://test-metrics",worker="tcp"} 1`,
+		`dtunnel_active_streams{side="client",endpoint="inproc://test-metrics",worker="proxy"} 1`,
+		`dtunnel_queue_length{side="server",endpoint="inproc://test-metrics",queue="scheduler"} `,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("metrics should have %s, got\n%s", line, body)
+		}
+	}
+	if metricBytes.get("client", "out") <= sentBefore {
+		t.Error("bytes sent by the client not counted")
+	}
+
+	conn.Close()
+	for wait := 0; wait < 100 && streamDurationCount("server", "tcp") == streamsBefore; wait++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if streamDurationCount("server", "tcp") != streamsBefore+1 {
+		t.Error("stream duration not observed")
+	}
+
+	server.Close()
+	tc.Close()
+	for wait := 0; wait < 100 && strings.Contains(scrape(), "test-metrics"); wait++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if strings.Contains(scrape(), "test-metrics") {
+		t.Error("gauges of closed tunnels should be removed")
+	}
+}
+
+func TestMetricsCompress(t *testing.T) {
+	cache := makeCache()
+	key := []byte("http://www.example.com/metrics")
+	value := []byte("hello world \n")
+	cache.Set(key, value)
+
+	hits, misses := metricCacheLookups.get("hit"), metricCacheLookups.get("miss")
+	comp := NewCacheCompressor(cache, key, cache.Digest(value), false)
+	comp.Write([]byte("hello world \n goodbye"))
+	comp.Close()
+	comp = NewCacheCompressor(cache, key, []byte("stale"), false)
+	comp.Write([]byte("hello world \n goodbye"))
+	comp.Close()
+	if metricCacheLookups.get("hit") != hits+1 || metricCacheLookups.get("miss") != misses+1 {
+		t.Error("cache lookups not counted")
+	}
+	if metricCompressBytes.get("CT_CACHE_DIFF", "sent") == 0 || metricCompressBytes.get("CT_RAW", "body") == 0 {
+		t.Error("compress bytes not counted")
+	}
+
+	failures := metricDecompressFailures.get()
+	if _, err := decompress(cache, DIFFERS[CT_CACHE_DIFF], &DiffContent{key, []byte("stale"), nil, nil}); err == nil {
+		t.Error("decompress against a stale digest should fail")
+	}
+	if metricDecompressFailures.get() != failures+1 {
+		t.Error("decompress failure not counted")
+	}
+}
+
+func TestMetricsStreamDiff(t *testing.T) {
+	cache := makeCache()
+	key := []byte("http://www.example.com/metrics-stream")
+	base := makeTestBody(64*1024, 1)
+	cache.Set(key, base)
+
+	hits, failures := metricCacheLookups.get("hit"), metricDecompressFailures.get()
+	body, sent := metricCompressBytes.get("CT_STREAM_DIFF", "body"), metricCompressBytes.get("CT_STREAM_DIFF", "sent")
+	diffs := diffDurationCount("CT_STREAM_DIFF")
+	sendChan := make(chan *Msg, 100)
+	writer := NewCachedTunnelWriter(&TunnelWriter{sendChan: sendChan, msgMaker: &msgBuilder{defaultFlags: FLAG_HTTP}},
+		NewCacheCompressor(cache, key, cache.Digest(base), false))
+	writer.maxCacheSize = 0
+	writer.Write(base)
+	writer.Close()
+	if metricCacheLookups.get("hit") != hits+1 {
+		t.Error("cache lookup of a streamed body not counted")
+	}
+	if metricCompressBytes.get("CT_STREAM_DIFF", "body") != body+uint64(len(base)) || metricCompressBytes.get("CT_STREAM_DIFF", "sent") <= sent {
+		t.Error("compress bytes of a streamed body not counted")
+	}
+	if diffDurationCount("CT_STREAM_DIFF") != diffs+1 {
+		t.Error("diff duration of a streamed body not observed")
+	}
+
+	cache.Set(key, []byte("another version"))
+	dec := NewStreamDiffDecoder(cache)
+	for msg := range sendChan {
+		dec.Decode(msg.Body.(*TcpData).Payload)
+		if msg.IsEndOfStream() {
+			break
+		}
+	}
+	if metricDecompressFailures.get() == failures {
+		t.Error("stream diff decode failure not counted")
+	}
+}
+
+func TestMetricsHooks(t *testing.T) {
+	var sent int
+	user := &Hooks{MsgSent: func(msg *Msg, size int) { sent += size }}
+	hooks := joinHooks(metricsHooks("test"), user)
+	before := metricBytes.get("test", "out")
+	hooks.msgSent(nil, [][]byte{[]byte("hello")})
+	if metricBytes.get("test", "out") != before+5 || sent != 5 {
+		t.Errorf("both hooks should be called, got %d and %d", metricBytes.get("test", "out")-before, sent)
+	}
+	hooks.streamEnd(UID{}, FLAG_UDP, time.Second)
+	if streamDurationCount("test", "udp") != 1 {
+		t.Error("stream duration not observed by the metrics hooks")
+	}
+}
+
+func diffDurationCount(values ...string) uint64 {
+	metricDiffSeconds.mu.Lock()
+	defer metricDiffSeconds.mu.Unlock()
+	if hist, ok := metricDiffSeconds.values[labelKey(values)]; ok {
+		return hist.count
+	}
+	return 0
+}
+
+func streamDurationCount(values ...string) uint64 {
+	metricStreamSeconds.mu.Lock()
+	defer metricStreamSeconds.mu.Unlock()
+	if hist, ok := metricStreamSeconds.values[labelKey(values)]; ok {
+		return hist.count
+	}
+	return 0
+}
@@ -0,0 +1,272 @@
+package dtunnel
+
+import (
+	"context"
+	zmq "github.com/pebbe/zmq4"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Option configures a TunnelClient made by NewClient, or a TunnelServer
+// made by NewServer
+type Option func(*options)
+
+type options struct {
+	cache Cache
+	//curve keys, the client also needs the server's public key
+	serverPub string
+	pub       string
+	secret    string
+	dial      dialFunc
+	transport http.RoundTripper
+	//SetACL may wrap a transport it can't check the dials of
+	bestEffortACL bool
+	//applied to every new socket before it connects or binds
+	socketOptions []func(*zmq.Socket) error
+	hooks         *Hooks
+}
+
+// Hooks are called as the tunnel runs, to collect metrics. They are called
+// on the paths msgs take, so should be quick. Nil ones are skipped
+type Hooks struct {
+	//a msg of size bytes went to or came from the peer
+	MsgSent     func(msg *Msg, size int)
+	MsgReceived func(msg *Msg, size int)
+	//the worker of a stream the peer opened began or ended
+	StreamBegin func(sid UID, flags uint16)
+	StreamEnd   func(sid UID, flags uint16, d time.Duration)
+}
+
+func (h *Hooks) msgSent(msg *Msg, frames [][]byte) {
+	h.msgSentSize(msg, framesSize(frames))
+}
+
+func (h *Hooks) msgReceived(msg *Msg, frames [][]byte) {
+	h.msgReceivedSize(msg, framesSize(frames))
+}
+
+func (h *Hooks) msgSentSize(msg *Msg, size int) {
+	if h != nil && h.MsgSent != nil {
+		h.MsgSent(msg, size)
+	}
+}
+
+func (h *Hooks) msgReceivedSize(msg *Msg, size int) {
+	if h != nil && h.MsgReceived != nil {
+		h.MsgReceived(msg, size)
+	}
+}
+
+func (h *Hooks) streamBegin(sid UID, flags uint16) {
+	if h != nil && h.StreamBegin != nil {
+		h.StreamBegin(sid, flags)
+	}
+}
+
+func (h *Hooks) streamEnd(sid UID, flags uint16, d time.Duration) {
+	if h != nil && h.StreamEnd != nil {
+		h.StreamEnd(sid, flags, d)
+	}
+}
+
+// Logger is what the tunnels log to, *log.Logger is one
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// sharedLogger is what SetLogger sets, it may be set while tunnels run
+type sharedLogger struct {
+	v atomic.Value
+}
+
+type loggerBox struct {
+	l Logger
+}
+
+func (s *sharedLogger) Printf(format string, v ...interface{}) {
+	if box, ok := s.v.Load().(loggerBox); ok && box.l != nil {
+		box.l.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// logger of all tunnels in the process, the standard logger by default
+var logger = new(sharedLogger)
+
+// SetLogger makes all tunnels in the process log to l, nil is the standard
+// logger again
+func SetLogger(l Logger) {
+	logger.v.Store(loggerBox{l})
+}
+
+// joinHooks calls the hooks of a, then those of b
+func joinHooks(a *Hooks, b *Hooks) *Hooks {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	return &Hooks{
+		MsgSent: func(msg *Msg, size int) {
+			a.msgSentSize(msg, size)
+			b.msgSentSize(msg, size)
+		},
+		MsgReceived: func(msg *Msg, size int) {
+			a.msgReceivedSize(msg, size)
+			b.msgReceivedSize(msg, size)
+		},
+		StreamBegin: func(sid UID, flags uint16) {
+			a.streamBegin(sid, flags)
+			b.streamBegin(sid, flags)
+		},
+		StreamEnd: func(sid UID, flags uint16, d time.Duration) {
+			a.streamEnd(sid, flags, d)
+			b.streamEnd(sid, flags, d)
+		},
+	}
+}
+
+func framesSize(frames [][]byte) int {
+	size := 0
+	for _, frame := range frames {
+		size += len(frame)
+	}
+	return size
+}
+
+// WithCache replaces the default in-memory cache
+func WithCache(cache Cache) Option {
+	return func(o *options) {
+		o.cache = cache
+	}
+}
+
+// WithClientKeys encrypts the tunnel with curve keys, the server's public
+// key and the client's own pair
+func WithClientKeys(serverPub string, pub string, secret string) Option {
+	return func(o *options) {
+		o.serverPub, o.pub, o.secret = serverPub, pub, secret
+	}
+}
+
+// WithServerKeys encrypts the tunnel with the server's curve key pair,
+// clients with any key are allowed
+func WithServerKeys(pub string, secret string) Option {
+	return func(o *options) {
+		o.pub, o.secret = pub, secret
+	}
+}
+
+// WithDialer sets how connections are made for streams, the server dials
+// the destinations of clients with it and a client the services it exposes
+func WithDialer(dial func(ctx context.Context, network string, address string) (net.Conn, error)) Option {
+	return func(o *options) {
+		o.dial = dial
+	}
+}
+
+// WithTransport sets how the server sends the http requests of clients,
+// WithDialer doesn't apply to it but SetACL does. SetACL fails on one
+// which goes through a proxy or is not an *http.Transport, unless
+// WithBestEffortACL is given too
+func WithTransport(transport http.RoundTripper) Option {
+	return func(o *options) {
+		o.transport = transport
+	}
+}
+
+// WithBestEffortACL lets SetACL take a transport of WithTransport whose dials
+// it can't check. The host of each request is checked before the transport
+// sends it, but the transport resolves the name again, so a name which
+// resolves to another ip the second time gets past the ip rules
+func WithBestEffortACL() Option {
+	return func(o *options) {
+		o.bestEffortACL = true
+	}
+}
+
+// WithSocketOption sets an option of the zmq socket, like SetSndhwm,
+// before it connects or binds. The client makes a new socket on reconnect
+func WithSocketOption(set func(*zmq.Socket) error) Option {
+	return func(o *options) {
+		o.socketOptions = append(o.socketOptions, set)
+	}
+}
+
+// WithHooks sets the hooks to collect metrics with
+func WithHooks(hooks *Hooks) Option {
+	return func(o *options) {
+		o.hooks = hooks
+	}
+}
+
+func makeOptions(opts []Option) *options {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// newSocket makes a socket of type t with the options, close it if fail
+func (o *options) newSocket(t zmq.Type, setup func(*zmq.Socket) error) (*zmq.Socket, error) {
+	socket, err := zmq.NewSocket(t)
+	if err != nil {
+		return nil, err
+	}
+	for _, set := range o.socketOptions {
+		if err = set(socket); err != nil {
+			socket.Close()
+			return nil, err
+		}
+	}
+	if err = setup(socket); err != nil {
+		socket.Close()
+		return nil, err
+	}
+	return socket, nil
+}
+
+func (o *options) clientSocket(remote string) (*zmq.Socket, error) {
+	return o.newSocket(zmq.DEALER, func(socket *zmq.Socket) error {
+		if o.secret != "" {
+			if err := socket.ClientAuthCurve(o.serverPub, o.pub, o.secret); err != nil {
+				return err
+			}
+		}
+		return socket.Connect(remote)
+	})
+}
+
+var (
+	authOnce sync.Once
+	authErr  error
+)
+
+func (o *options) serverSocket(bind string) (*zmq.Socket, error) {
+	if o.secret != "" {
+		//the zmq auth handler is one per process
+		authOnce.Do(func() {
+			zmq.AuthCurveAdd("global", zmq.CURVE_ALLOW_ANY)
+			authErr = zmq.AuthStart()
+			zmq.AuthCurveAdd(zmq.CURVE_ALLOW_ANY)
+		})
+		if authErr != nil {
+			return nil, authErr
+		}
+	}
+	return o.newSocket(zmq.ROUTER, func(socket *zmq.Socket) error {
+		if o.secret != "" {
+			if err := socket.ServerAuthCurve("global", o.secret); err != nil {
+				return err
+			}
+		}
+		return socket.Bind(bind)
+	})
+}
@@ -0,0 +1,146 @@
+package dtunnel
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	zmq "github.com/pebbe/zmq4"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewServerError(t *testing.T) {
+	addr := "inproc://test-options-error"
+	server, err := NewServer(addr)
+	if err != nil {
+		t.Fatalf("NewServer fail %v", err)
+	}
+	defer server.Close()
+	if _, err := NewServer(addr); err == nil {
+		t.Error("bind twice should fail")
+	}
+
+	failed := errors.New("bad option")
+	_, err = NewClient(addr, WithSocketOption(func(*zmq.Socket) error {
+		return failed
+	}))
+	if err != failed {
+		t.Errorf("socket option error should be returned, got %v", err)
+	}
+}
+
+func TestNewServerOptions(t *testing.T) {
+	service, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen fail %v", err)
+	}
+	defer service.Close()
+	go func() {
+		for {
+			conn, err := service.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	var dialed, sent, received, begun, ended int64
+	dial := func(ctx context.Context, network string, address string) (net.Conn, error) {
+		atomic.AddInt64(&dialed, 1)
+		return new(net.Dialer).DialContext(ctx, network, address)
+	}
+	hooks := &Hooks{
+		MsgReceived: func(msg *Msg, size int) {
+			atomic.AddInt64(&received, int64(size))
+		},
+		StreamBegin: func(sid UID, flags uint16) {
+			atomic.AddInt64(&begun, 1)
+		},
+		StreamEnd: func(sid UID, flags uint16, d time.Duration) {
+			atomic.AddInt64(&ended, 1)
+		},
+	}
+	server, err := NewServer("inproc://test-options", WithDialer(dial), WithHooks(hooks), WithCache(newLocalCache()))
+	if err != nil {
+		t.Fatalf("NewServer fail %v", err)
+	}
+	go server.Run()
+	defer server.Close()
+	tc, err := NewClient("inproc://test-options", WithHooks(&Hooks{
+		MsgSent: func(msg *Msg, size int) {
+			atomic.AddInt64(&sent, int64(size))
+		},
+	}))
+	if err != nil {
+		t.Fatalf("NewClient fail %v", err)
+	}
+	go tc.Run()
+	defer tc.Close()
+
+	conn, err := tc.ConnectTcp(service.Addr().String())
+	if err != nil {
+		t.Fatalf("ConnectTcp fail %v", err)
+	}
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("echo not right %q %v", buf, err)
+	}
+	conn.Close()
+
+	for wait := 0; wait < 100 && atomic.LoadInt64(&ended) == 0; wait++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt64(&dialed) != 1 {
+		t.Errorf("server should dial with ours, got %d", dialed)
+	}
+	if atomic.LoadInt64(&begun) != 1 || atomic.LoadInt64(&ended) != 1 {
+		t.Errorf("expect one stream begun and ended, got %d %d", begun, ended)
+	}
+	if atomic.LoadInt64(&sent) == 0 || atomic.LoadInt64(&received) == 0 {
+		t.Errorf("msg hooks not called, sent %d received %d", sent, received)
+	}
+}
+
+func TestSetLogger(t *testing.T) {
+	buf := new(syncBuffer)
+	SetLogger(log.New(buf, "", 0))
+	defer SetLogger(nil)
+	server, tc := startTunnel(t, "inproc://test-logger")
+	defer server.Close()
+	defer tc.Close()
+	for wait := 0; wait < 100 && !strings.Contains(buf.String(), "[ts]hello from"); wait++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(buf.String(), "[ts]hello from") {
+		t.Errorf("tunnels should log to the logger set, got %q", buf.String())
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe to write from the goroutines of tunnels
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
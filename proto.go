@@ -26,6 +26,26 @@ const (
 	HTTP_DATA    uint16 = 12
 
 	CACHE_SHARE uint16 = 21
+	CACHE_MISS  uint16 = 22
+
+	HELLO     uint16 = 31
+	HELLO_REP uint16 = 32
+
+	PING uint16 = 41
+	PONG uint16 = 42
+
+	//abort a stream, either side can send it
+	RESET uint16 = 51
+	//grant the peer more credit to send on a stream
+	WINDOW_UPDATE uint16 = 52
+
+	//ask the server to listen for a service of the client, see Expose
+	BIND     uint16 = 61
+	BIND_REP uint16 = 62
+
+	//a datagram to the address in it, and one back from the address in it
+	UDP_DATA     uint16 = 71
+	UDP_DATA_REP uint16 = 72
 
 	//CACHE_SHARE uint16 = 51
 	ERROR uint16 = 255
@@ -36,11 +56,26 @@ var TYPE_NAMES map[uint16]string = map[uint16]string{
 	TCP_CONNECT_REP: "TCP_CONNECT_REP",
 	TCP_DATA:        "TCP_DATA",
 	CACHE_SHARE:     "CACHE_SHARE",
+	CACHE_MISS:      "CACHE_MISS",
+	HELLO:           "HELLO",
+	HELLO_REP:       "HELLO_REP",
+	PING:            "PING",
+	PONG:            "PONG",
+	RESET:           "RESET",
+	WINDOW_UPDATE:   "WINDOW_UPDATE",
+	BIND:            "BIND",
+	BIND_REP:        "BIND_REP",
+	UDP_DATA:        "UDP_DATA",
+	UDP_DATA_REP:    "UDP_DATA_REP",
 	ERROR:           "ERROR",
 }
 
 const (
 	VERSION_1 uint8 = 1
+
+	//the protocol version we speak, and the oldest one we still accept
+	PROTOCOL_VERSION     uint8 = VERSION_1
+	MIN_PROTOCOL_VERSION uint8 = VERSION_1
 )
 
 const (
@@ -49,6 +84,8 @@ const (
 	FLAG_HTTP         uint16 = 4
 	FLAG_STREAM_BEGIN uint16 = 8
 	FLAG_STREAM_END   uint16 = 16
+	//the payload goes on in the next msg of the stream
+	FLAG_MORE uint16 = 32
 )
 
 var FLAG_NAMES map[uint16]string = map[uint16]string{
@@ -57,16 +94,25 @@ var FLAG_NAMES map[uint16]string = map[uint16]string{
 	FLAG_HTTP:         "FLAG_HTTP",
 	FLAG_STREAM_BEGIN: "FLAG_STREAM_BEGIN",
 	FLAG_STREAM_END:   "FLAG_STREAM_END",
+	FLAG_MORE:         "FLAG_MORE",
 }
 
 const (
-	CT_RAW        uint16 = 0
-	CT_CACHE_DIFF uint16 = 1
+	CT_RAW         uint16 = 0
+	CT_CACHE_DIFF  uint16 = 1 //bsdiff
+	CT_STREAM_DIFF uint16 = 2
+	CT_DELTA_DIFF  uint16 = 3
+	CT_LINE_DIFF   uint16 = 4
 )
 
 var CT_NAMES map[uint16]string = map[uint16]string{
-	CT_RAW:        "CT_RAW",
-	CT_CACHE_DIFF: "CT_CACHE_DIFF",
+	CT_RAW:         "CT_RAW",
+	CT_CACHE_DIFF:  "CT_CACHE_DIFF",
+	CT_STREAM_DIFF: "CT_STREAM_DIFF",
+	CT_DELTA_DIFF:  "CT_DELTA_DIFF",
+	CT_LINE_DIFF:   "CT_LINE_DIFF",
+	CT_FLATE:       "CT_FLATE",
+	CT_GZIP:        "CT_GZIP",
 }
 
 type UID [12]byte
@@ -157,7 +203,8 @@ func (d *ErrorData) UnmarshalBinary(b []byte) (err error) {
 	}
 	buff := bytes.NewBuffer(b)
 	binary.Read(buff, binary.BigEndian, &d.ContentType)
-	binary.Read(buff, binary.BigEndian, &d.Payload)
+	d.Payload = make([]byte, len(b)-2)
+	binary.Read(buff, binary.BigEndian, d.Payload)
 	return
 }
 
@@ -190,19 +237,63 @@ func (td *TcpData) GetPayload() []byte {
 }
 
 func (td *TcpData) String() string {
-	return fmt.Sprintf("content-type=%s size=%d", CT_NAMES[td.ContentType], len(td.Payload))
+	return fmt.Sprintf("content-type=%s size=%d", ctName(td.ContentType), len(td.Payload))
+}
+
+// UdpData is a datagram, Addr is where it goes to or comes from
+type UdpData struct {
+	Addr    string
+	Payload []byte
+}
+
+func (ud *UdpData) MarshalBinary() (b []byte, err error) {
+	if len(ud.Addr) > 255 {
+		return nil, InvalidBody
+	}
+	b = make([]byte, 0, 1+len(ud.Addr)+len(ud.Payload))
+	b = append(b, byte(len(ud.Addr)))
+	b = append(b, ud.Addr...)
+	return append(b, ud.Payload...), nil
+}
+
+func (ud *UdpData) UnmarshalBinary(b []byte) (err error) {
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return InvalidBody
+	}
+	ud.Addr = string(b[1 : 1+b[0]])
+	ud.Payload = make([]byte, len(b)-1-int(b[0]))
+	copy(ud.Payload, b[1+b[0]:])
+	return nil
+}
+
+func (ud *UdpData) String() string {
+	return fmt.Sprintf("addr=%s size=%d", ud.Addr, len(ud.Payload))
 }
 
 type Msg struct {
 	Envelope [][]byte
 	*Header
 	Body
+	//scheduling hint for the sender, not sent
+	priority uint8
+	//set on the marker of waitSent, which is not sent at all
+	handedOff chan struct{}
 }
 
 func (m *Msg) GetMsgType() uint16 {
 	return m.Header.MsgType
 }
 
+// GetPeerId returns the routing identity of the peer which sent the msg,
+// empty for msgs without one (client side)
+func (m *Msg) GetPeerId() string {
+	var id []byte
+	for _, part := range m.Envelope {
+		id = append(id, part...)
+	}
+	return fmt.Sprintf("%x", id)
+}
+
 func (m *Msg) GetMsgTypeName() string {
 	return TYPE_NAMES[m.Header.MsgType]
 }
@@ -250,16 +341,22 @@ func fromFrames(data [][]byte) (m *Msg, err error) {
 	switch header.MsgType {
 	case CACHE_SHARE:
 		body = new(CacheShareData)
-	case TCP_CONNECT, TCP_DATA, TCP_CONNECT_REP:
+	case HELLO, HELLO_REP:
+		body = new(HelloData)
+	case TCP_CONNECT, TCP_DATA, TCP_CONNECT_REP, CACHE_MISS, PING, PONG, RESET, WINDOW_UPDATE, BIND, BIND_REP:
 		body = new(TcpData)
+	case UDP_DATA, UDP_DATA_REP:
+		body = new(UdpData)
 	case ERROR:
 		body = new(ErrorData)
+	default:
+		return nil, InvalidHeader
 	}
 	err = body.UnmarshalBinary(data[headerPos+1])
 	if err != nil {
 		return nil, err //InvalidBody
 	}
-	return &Msg{data[:headerPos], header, body}, nil
+	return &Msg{Envelope: data[:headerPos], Header: header, Body: body}, nil
 }
 
 func toFrames(m *Msg) (data [][]byte, err error) {
@@ -288,16 +385,30 @@ func toFrames(m *Msg) (data [][]byte, err error) {
 func makeReqMsg(sid UID, msgType uint16, ct uint16, body []byte, flag uint16) *Msg {
 	return &Msg{
 		Envelope: [][]byte{[]byte("")},
-		Header:   &Header{StreamId: sid, Version: VERSION_1, Flag: flag, MsgType: msgType},
+		Header:   &Header{StreamId: sid, Version: PROTOCOL_VERSION, Flag: flag, MsgType: msgType},
 		Body:     &TcpData{ContentType: ct, Payload: body},
 	}
 }
 
+// makeUdpMsg a datagram of stream sid, they go before bulk data
+func makeUdpMsg(sid UID, envelope [][]byte, msgType uint16, addr string, payload []byte, flag uint16) *Msg {
+	return &Msg{
+		Envelope: envelope,
+		Header:   &Header{StreamId: sid, Version: PROTOCOL_VERSION, Flag: flag | FLAG_UDP, MsgType: msgType},
+		Body:     &UdpData{Addr: addr, Payload: payload},
+		priority: PRIORITY_HIGH,
+	}
+}
+
 func makeCacheShareMsg(key []byte, digest []byte) *Msg {
+	return makeCacheShareItemsMsg([]CacheItem{CacheItem{key, digest}})
+}
+
+func makeCacheShareItemsMsg(items []CacheItem) *Msg {
 	return &Msg{
 		Envelope: [][]byte{[]byte("")},
-		Header:   &Header{Version: VERSION_1, MsgType: CACHE_SHARE},
-		Body:     &CacheShareData{Payload: []CacheItem{CacheItem{key, digest}}},
+		Header:   &Header{Version: PROTOCOL_VERSION, MsgType: CACHE_SHARE},
+		Body:     &CacheShareData{Payload: items},
 	}
 }
 
@@ -310,7 +421,7 @@ type msgBuilder struct {
 func (b *msgBuilder) MakeMsg(mt uint16, ct uint16, payload []byte, flag uint16) *Msg {
 	return &Msg{
 		Envelope: b.envelope,
-		Header:   &Header{Version: VERSION_1, StreamId: b.sid, Flag: flag | b.defaultFlags, MsgType: mt},
+		Header:   &Header{Version: PROTOCOL_VERSION, StreamId: b.sid, Flag: flag | b.defaultFlags, MsgType: mt},
 		Body:     &TcpData{ContentType: ct, Payload: payload},
 	}
 }
@@ -319,7 +430,7 @@ func (b *msgBuilder) MakeErrorMsg(err error, flag uint16) *Msg {
 	flag = flag | FLAG_STREAM_END
 	return &Msg{
 		Envelope: b.envelope,
-		Header:   &Header{Version: VERSION_1, StreamId: b.sid, Flag: flag | b.defaultFlags, MsgType: ERROR},
+		Header:   &Header{Version: PROTOCOL_VERSION, StreamId: b.sid, Flag: flag | b.defaultFlags, MsgType: ERROR},
 		Body:     &ErrorData{ContentType: CT_RAW, Payload: []byte(err.Error())},
 	}
 }
@@ -51,3 +51,26 @@ func TestMsgEncodeDecode(t *testing.T) {
 		t.Error("msg should have FLAG_TCP")
 	}
 }
+
+func TestUdpMsgEncodeDecode(t *testing.T) {
+	msg := makeUdpMsg(MakeUID(), [][]byte{[]byte("")}, UDP_DATA, "8.8.8.8:53", []byte("query"), FLAG_STREAM_BEGIN)
+	frames, err := toFrames(msg)
+	if err != nil {
+		t.Fatalf("toFrames fail %v", err)
+	}
+	newMsg, err := fromFrames(frames)
+	if err != nil {
+		t.Fatalf("fromFrames fail %v", err)
+	}
+	data := newMsg.Body.(*UdpData)
+	if data.Addr != "8.8.8.8:53" || string(data.Payload) != "query" {
+		t.Errorf("udp data not right, got %s", data)
+	}
+	if !newMsg.TestFlag(FLAG_UDP) || !newMsg.TestFlag(FLAG_STREAM_BEGIN) {
+		t.Error("msg should have FLAG_UDP and FLAG_STREAM_BEGIN")
+	}
+
+	if _, err := fromFrames([][]byte{[]byte(""), frames[1], []byte{20, 'a'}}); err == nil {
+		t.Error("truncated udp data should fail")
+	}
+}
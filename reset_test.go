@@ -0,0 +1,119 @@
+package dtunnel
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func startTunnel(t *testing.T, addr string) (*TunnelServer, *TunnelClient) {
+	server, err := NewTunnelServer(addr)
+	if err != nil {
+		t.Fatalf("NewTunnelServer fail %v", err)
+	}
+	go server.Run()
+	tc, _ := NewTunnelClient(addr)
+	go tc.Run()
+	return server, tc
+}
+
+func TestHttpProxyResetOnClientGone(t *testing.T) {
+	started := make(chan struct{})
+	aborted := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-r.Context().Done():
+			close(aborted)
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer ts.Close()
+
+	server, tc := startTunnel(t, "inproc://test-reset-http")
+	defer tc.Close()
+	proxy := NewHttpProxyServer(tc)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequest("GET", ts.URL+"/slow", nil)
+	done := make(chan struct{})
+	go func() {
+		proxy.ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+		close(done)
+	}()
+
+	<-started
+	cancel()
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		t.Fatal("upstream request should be aborted")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("proxy should return once the client is gone")
+	}
+	for wait := 0; wait < 50 && server.httpWorker.(*MultiStreamWorker).Len() > 0; wait++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := server.httpWorker.(*MultiStreamWorker).Len(); n != 0 {
+		t.Errorf("http worker should be freed, got %d", n)
+	}
+	if _, ok := tc.cm.local.Get(makeCacheKey(req)); ok {
+		t.Error("reset response should not be cached")
+	}
+}
+
+func TestTcpReset(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen fail %v", err)
+	}
+	defer ln.Close()
+
+	_, tc := startTunnel(t, "inproc://test-reset-tcp")
+	defer tc.Close()
+
+	//client resets, the server closes the conn at once
+	conn, err := tc.ConnectTcp(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("ConnectTcp fail %v", err)
+	}
+	remote, _ := ln.Accept()
+	if conn.RemoteAddr().String() != ln.Addr().String() {
+		t.Errorf("remote addr not right, got %s", conn.RemoteAddr())
+	}
+	conn.(*TunnelConn).Reset()
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := ioutil.ReadAll(remote); err != nil {
+		t.Errorf("remote conn should be closed, got %v", err)
+	}
+	remote.Close()
+
+	//the remote conn breaks, the server resets the client
+	conn, err = tc.ConnectTcp(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("ConnectTcp fail %v", err)
+	}
+	remote, _ = ln.Accept()
+	remote.(*net.TCPConn).SetLinger(0)
+	remote.Close()
+	got := make(chan error, 1)
+	go func() {
+		_, err := ioutil.ReadAll(conn)
+		got <- err
+	}()
+	select {
+	case err := <-got:
+		if err != ErrorStreamReset {
+			t.Errorf("expect StreamReset, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("client should be reset")
+	}
+}
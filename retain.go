@@ -0,0 +1,188 @@
+package dtunnel
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	//bytes of raw bodies kept for CACHE_MISS, in all and of a peer
+	MAX_RETAIN_SIZE      int = 64 * 1024 * 1024
+	MAX_RETAIN_PEER_SIZE int = 16 * 1024 * 1024
+	//a body is dropped this long after it's sent, the peer has applied the diff by then
+	RETAIN_TTL = 30 * time.Second
+	//what a request kept to fetch the body again counts for
+	RETAIN_REQUEST_SIZE int = 1024
+)
+
+type retainEntry struct {
+	key  string
+	pid  string
+	data []byte
+	//to fetch the body again, kept instead of a body too large to keep
+	req     *http.Request
+	size    int
+	expires time.Time
+}
+
+// retainStore keeps the raw bodies sent as diffs for a short while, so a
+// peer which can't apply one may ask for the body again with CACHE_MISS.
+// When full, the oldest bodies of the peer go first, then those of others
+type retainStore struct {
+	mu          sync.Mutex
+	ll          *list.List
+	items       map[string]*list.Element
+	size        int
+	peerSize    map[string]int
+	maxSize     int
+	maxPeerSize int
+	ttl         time.Duration
+	//streams still sending, closed once they end, see wait
+	sending map[string]chan struct{}
+}
+
+func newRetainStore(maxSize int, maxPeerSize int, ttl time.Duration) *retainStore {
+	return &retainStore{
+		ll:          list.New(),
+		items:       make(map[string]*list.Element),
+		peerSize:    make(map[string]int),
+		maxSize:     maxSize,
+		maxPeerSize: maxPeerSize,
+		ttl:         ttl,
+		sending:     make(map[string]chan struct{}),
+	}
+}
+
+func makeRetainKey(pid string, sid UID) string {
+	return fmt.Sprintf("%s/%x", pid, sid)
+}
+
+// begin marks stream sid sending, wait for its body returns once end is called
+func (s *retainStore) begin(pid string, sid UID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sending[makeRetainKey(pid, sid)] = make(chan struct{})
+}
+
+// end marks stream sid done, whether its body is kept or not
+func (s *retainStore) end(pid string, sid UID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := makeRetainKey(pid, sid)
+	if ch, ok := s.sending[key]; ok {
+		close(ch)
+		delete(s.sending, key)
+	}
+}
+
+// put keeps the body of stream sid, returns false if it's empty or too large to
+func (s *retainStore) put(pid string, sid UID, data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+	return s.add(&retainEntry{pid: pid, data: data, size: len(data)}, sid)
+}
+
+// putRequest keeps req to fetch the body of stream sid again, for a body
+// which is not kept. req should have no body
+func (s *retainStore) putRequest(pid string, sid UID, req *http.Request) bool {
+	return s.add(&retainEntry{pid: pid, req: req, size: RETAIN_REQUEST_SIZE}, sid)
+}
+
+func (s *retainStore) add(entry *retainEntry, sid UID) bool {
+	if entry.size > s.maxPeerSize || entry.size > s.maxSize {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(time.Now())
+	entry.key = makeRetainKey(entry.pid, sid)
+	entry.expires = time.Now().Add(s.ttl)
+	if e, ok := s.items[entry.key]; ok {
+		s.remove(e)
+	}
+	for s.peerSize[entry.pid]+entry.size > s.maxPeerSize {
+		s.remove(s.oldest(entry.pid))
+	}
+	for s.size+entry.size > s.maxSize {
+		s.remove(s.ll.Front())
+	}
+	s.items[entry.key] = s.ll.PushBack(entry)
+	s.size += entry.size
+	s.peerSize[entry.pid] += entry.size
+	return true
+}
+
+// take removes what is kept for stream sid and returns it
+func (s *retainStore) take(pid string, sid UID) (*retainEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(time.Now())
+	e, ok := s.items[makeRetainKey(pid, sid)]
+	if !ok {
+		return nil, false
+	}
+	s.remove(e)
+	return e.Value.(*retainEntry), true
+}
+
+// wait takes what is kept for stream sid once it ends, a body is only
+// kept when the stream ends. Returns false at once for unknown streams
+func (s *retainStore) wait(ctx context.Context, pid string, sid UID) (*retainEntry, bool) {
+	s.mu.Lock()
+	ch, sending := s.sending[makeRetainKey(pid, sid)]
+	s.mu.Unlock()
+	if sending {
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+	return s.take(pid, sid)
+}
+
+// dropPeer removes all bodies of a peer which is gone
+func (s *retainStore) dropPeer(pid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for e := s.oldest(pid); e != nil; e = s.oldest(pid) {
+		s.remove(e)
+	}
+}
+
+// Len returns the number of bodies kept
+func (s *retainStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ll.Len()
+}
+
+// expire removes the bodies past their time, entries are in the order they expire
+func (s *retainStore) expire(now time.Time) {
+	for e := s.ll.Front(); e != nil && now.After(e.Value.(*retainEntry).expires); e = s.ll.Front() {
+		s.remove(e)
+	}
+}
+
+func (s *retainStore) oldest(pid string) *list.Element {
+	for e := s.ll.Front(); e != nil; e = e.Next() {
+		if e.Value.(*retainEntry).pid == pid {
+			return e
+		}
+	}
+	return nil
+}
+
+func (s *retainStore) remove(e *list.Element) {
+	entry := s.ll.Remove(e).(*retainEntry)
+	delete(s.items, entry.key)
+	s.size -= entry.size
+	if s.peerSize[entry.pid] -= entry.size; s.peerSize[entry.pid] <= 0 {
+		delete(s.peerSize, entry.pid)
+	}
+}
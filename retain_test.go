@@ -0,0 +1,84 @@
+package dtunnel
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetainStore(t *testing.T) {
+	s := newRetainStore(10, 6, time.Hour)
+	a, b, c, d := MakeUID(), MakeUID(), MakeUID(), MakeUID()
+	s.put("p1", a, []byte("aaa"))
+	s.put("p1", b, []byte("bbb"))
+	//the oldest of p1 makes room
+	s.put("p1", c, []byte("ccc"))
+	if _, ok := s.take("p1", a); ok {
+		t.Error("oldest body of the peer should be evicted")
+	}
+	//then the oldest of all
+	s.put("p2", d, []byte("dddddd"))
+	if _, ok := s.take("p1", b); ok {
+		t.Error("oldest body should be evicted when the store is full")
+	}
+	if e, ok := s.take("p1", c); !ok || string(e.data) != "ccc" {
+		t.Errorf("body not kept, got %v", ok)
+	}
+	if _, ok := s.take("p1", c); ok {
+		t.Error("take should remove the body")
+	}
+	if s.put("p2", a, []byte("too large")) {
+		t.Error("body larger than the peer's share should not be kept")
+	}
+	s.dropPeer("p2")
+	if s.Len() != 0 || s.size != 0 || len(s.peerSize) != 0 {
+		t.Errorf("store should be empty, got %d entries %d bytes", s.Len(), s.size)
+	}
+
+	s = newRetainStore(10, 10, 10*time.Millisecond)
+	s.put("p1", a, []byte("aaa"))
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := s.take("p1", a); ok {
+		t.Error("body should expire")
+	}
+}
+
+func TestRetainStoreWait(t *testing.T) {
+	s := newRetainStore(MAX_RETAIN_SIZE, MAX_RETAIN_PEER_SIZE, RETAIN_TTL)
+	sid := MakeUID()
+	if _, ok := s.wait(context.Background(), "p1", sid); ok {
+		t.Error("wait for an unknown stream should fail at once")
+	}
+
+	s.begin("p1", sid)
+	go func() {
+		//slower than any poll interval
+		time.Sleep(100 * time.Millisecond)
+		s.put("p1", sid, []byte("body"))
+		s.end("p1", sid)
+	}()
+	if e, ok := s.wait(context.Background(), "p1", sid); !ok || string(e.data) != "body" {
+		t.Errorf("wait should get the body once the stream ends, got %v", ok)
+	}
+
+	//ended without a body
+	s.begin("p1", sid)
+	go s.end("p1", sid)
+	if _, ok := s.wait(context.Background(), "p1", sid); ok {
+		t.Error("nothing should be found for a stream ended without a body")
+	}
+
+	s.begin("p1", sid)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, ok := s.wait(ctx, "p1", sid); ok {
+		t.Error("wait should give up when ctx is done")
+	}
+
+	req, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	s.putRequest("p1", sid, req)
+	if e, ok := s.take("p1", sid); !ok || e.req != req {
+		t.Error("request not kept")
+	}
+}
@@ -0,0 +1,290 @@
+package dtunnel
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrorAddressInUse   = errors.New("AddressInUse")
+	ErrorUnknownService = errors.New("UnknownService")
+)
+
+// reverseServer listens on the addresses clients expose, each conn it
+// accepts goes back to the client as a stream the server opens
+type reverseServer struct {
+	cm      *CacheManager
+	repChan chan *Msg
+	//where clients may listen, reverse mode is off while it's nil
+	allow    *ExposeACL
+	mu       sync.Mutex
+	bindings map[string]*reverseBinding
+	streams  *streamTable
+}
+
+// reverseBinding is a listener, and the peer its conns go to
+type reverseBinding struct {
+	addr     string
+	ln       net.Listener
+	pid      string
+	envelope [][]byte
+	//handed to the client in BIND_REP, it takes the binding over with it
+	token string
+}
+
+func newReverseServer(cm *CacheManager, repChan chan *Msg) *reverseServer {
+	return &reverseServer{
+		cm:       cm,
+		repChan:  repChan,
+		bindings: make(map[string]*reverseBinding),
+		streams:  newStreamTable(),
+	}
+}
+
+// bind listens on the address of a BIND, replies BIND_REP with where it
+// listens and the token of the binding. A client which comes back on a new
+// connection takes its bindings over by their token
+func (r *reverseServer) bind(msg *Msg) {
+	pid := msg.GetPeerId()
+	addr, token := splitBindPayload(msg.Body.(*TcpData).GetPayload())
+	msgMaker := NewMsgBuilderFromMsg(msg)
+
+	r.mu.Lock()
+	b, ok := r.bindings[addr]
+	if ok && b.pid != pid && (token == "" || token != b.token) {
+		r.mu.Unlock()
+		r.repChan <- msgMaker.MakeErrorMsg(ErrorAddressInUse, 0)
+		return
+	}
+	if ok {
+		b.pid, b.envelope = pid, msg.Envelope
+	}
+	r.mu.Unlock()
+
+	if !ok {
+		if err := r.allow.Check(addr); err != nil {
+			logger.Printf("[ts]peer %s may not expose %s: %s", pid, addr, err)
+			r.repChan <- msgMaker.MakeErrorMsg(err, 0)
+			return
+		}
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			r.repChan <- msgMaker.MakeErrorMsg(err, 0)
+			return
+		}
+		b = &reverseBinding{addr: ln.Addr().String(), ln: ln, pid: pid, envelope: msg.Envelope, token: makeBindToken()}
+		r.mu.Lock()
+		r.bindings[b.addr] = b
+		r.mu.Unlock()
+		go r.accept(b)
+	}
+	logger.Printf("[ts]peer %s exposes %s", pid, b.addr)
+	r.repChan <- msgMaker.MakeMsg(BIND_REP, CT_RAW, []byte(b.addr+"\n"+b.token), FLAG_STREAM_END)
+}
+
+// makeBindToken is random, so only the client the server gave it to knows it
+func makeBindToken() string {
+	var token [16]byte
+	if _, err := rand.Read(token[:]); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%x", token)
+}
+
+// splitBindPayload splits "addr" or "addr\ntoken" of BIND and BIND_REP
+func splitBindPayload(payload []byte) (string, string) {
+	parts := strings.SplitN(string(payload), "\n", 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+func (r *reverseServer) accept(b *reverseBinding) {
+	for {
+		conn, err := b.ln.Accept()
+		if err != nil {
+			logger.Printf("[ts]stop listening on %s: %s", b.addr, err)
+			return
+		}
+		go r.open(b, conn)
+	}
+}
+
+// open a stream to the client which exposed b, and pipe conn through it
+func (r *reverseServer) open(b *reverseBinding, conn net.Conn) {
+	defer conn.Close()
+	r.mu.Lock()
+	pid, envelope := b.pid, b.envelope
+	r.mu.Unlock()
+
+	sid := MakeUID()
+	msgMaker := NewMsgBuilder(sid, envelope, FLAG_TCP)
+	st := newClientStream(sid, FLAG_TCP, r.cm.GetPeerWindow(pid), r.cm.GetPeerMaxFrameSize(pid), r.repChan, msgMaker)
+	st.pid, st.envelope = pid, envelope
+	r.streams.add(st)
+	r.repChan <- msgMaker.MakeMsg(TCP_CONNECT, CT_RAW, []byte(b.addr), FLAG_STREAM_BEGIN)
+
+	var msg *Msg
+	select {
+	case msg = <-st.ch:
+	case <-st.done:
+	}
+	if msg == nil || msg.GetMsgType() != TCP_CONNECT_REP {
+		logger.Printf("[%x] peer %s fail to connect %s: %s", sid, pid, b.addr, msg)
+		r.cancel(st)
+		return
+	}
+	reader := &TunnelReader{recvChan: st.ch, cancel: r.canceler(st), aborted: st.done}
+	reader.maxFrameSize = r.cm.GetPeerMaxFrameSize(pid)
+	writer := newPeerWriter(r.cm, pid, r.repChan, msgMaker)
+	writer.window = st.window
+	piping(newTunnelConn(reader, writer, b.ln.Addr(), peerAddr(r.cm, pid)), conn)
+}
+
+// cancel drops the stream and tells the client to abort it
+func (r *reverseServer) cancel(st *clientStream) {
+	if _, ok := r.streams.remove(st.sid); ok {
+		logger.Printf("[%x] reset stream", st.sid)
+		r.repChan <- NewMsgBuilder(st.sid, st.envelope, st.flags).MakeMsg(RESET, CT_RAW, []byte(""), FLAG_STREAM_END)
+	}
+	st.abandon()
+}
+
+func (r *reverseServer) canceler(st *clientStream) func() {
+	return func() {
+		r.cancel(st)
+	}
+}
+
+// dispatch delivers msg to a stream the server opened,
+// returns false if it's not one of them
+func (r *reverseServer) dispatch(msg *Msg) bool {
+	return r.streams.dispatch(msg, r.cancel)
+}
+
+// reap closes what a peer which stopped responding exposed, and fails its streams
+func (r *reverseServer) reap(pid string) {
+	r.mu.Lock()
+	for addr, b := range r.bindings {
+		if b.pid == pid {
+			b.ln.Close()
+			delete(r.bindings, addr)
+		}
+	}
+	r.mu.Unlock()
+	for _, st := range r.streams.removeAll(func(st *clientStream) bool { return st.pid == pid }) {
+		st.fail(ErrorPeerTimeout)
+	}
+}
+
+// abort resets all streams with err
+func (r *reverseServer) abort(err error) {
+	for _, st := range r.streams.removeAll(nil) {
+		r.repChan <- NewMsgBuilder(st.sid, st.envelope, st.flags).MakeMsg(RESET, CT_RAW, []byte(""), FLAG_STREAM_END)
+		st.fail(err)
+	}
+}
+
+func (r *reverseServer) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for addr, b := range r.bindings {
+		b.ln.Close()
+		delete(r.bindings, addr)
+	}
+	return nil
+}
+
+// Expose asks the server to listen on public, and connects each conn it
+// accepts to local through the tunnel. Returns where the server listens,
+// the service is exposed there again whenever we reconnect.
+// Should be called after Run
+func (c *TunnelClient) Expose(public string, local string) (string, error) {
+	addr, token, err := c.bind(public, "")
+	if err != nil {
+		return "", err
+	}
+	c.servicesMu.Lock()
+	c.services[addr] = local
+	c.bindTokens[addr] = token
+	c.servicesMu.Unlock()
+	logger.Printf("[tc]expose %s on %s", local, addr)
+	return addr, nil
+}
+
+// bind asks the server to listen on public, token takes over a binding
+// we had. Returns where the server listens and the token of the binding
+func (c *TunnelClient) bind(public string, token string) (string, string, error) {
+	if err := c.usable(); err != nil {
+		return "", "", err
+	}
+	payload := public
+	if token != "" {
+		payload += "\n" + token
+	}
+	st := c.addStream(MakeUID(), FLAG_TCP)
+	c.reqChan <- makeReqMsg(st.sid, BIND, CT_RAW, []byte(payload), FLAG_TCP|FLAG_STREAM_BEGIN|FLAG_STREAM_END)
+	msg := <-st.ch
+	if msg.GetMsgType() == ERROR {
+		return "", "", fmt.Errorf("Bind Error : %s", msg.Body)
+	}
+	addr, token := splitBindPayload(msg.Body.(*TcpData).GetPayload())
+	return addr, token, nil
+}
+
+// exposeAgain binds the services on a new connection
+func (c *TunnelClient) exposeAgain() {
+	c.servicesMu.Lock()
+	tokens := make(map[string]string, len(c.services))
+	for addr := range c.services {
+		tokens[addr] = c.bindTokens[addr]
+	}
+	c.servicesMu.Unlock()
+	for addr, token := range tokens {
+		_, token, err := c.bind(addr, token)
+		if err != nil {
+			logger.Printf("[tc]fail to expose %s again: %s", addr, err)
+			continue
+		}
+		c.servicesMu.Lock()
+		c.bindTokens[addr] = token
+		c.servicesMu.Unlock()
+	}
+}
+
+// acceptStream hands the streams the server opened to the tcp worker,
+// returns false if msg is not of one of them. Their TCP_CONNECT names
+// the exposed address, the worker connects to the local service instead
+func (c *TunnelClient) acceptStream(msg *Msg) bool {
+	sid := msg.GetStreamId()
+	c.servicesMu.Lock()
+	_, ok := c.accepted[sid]
+	if !ok && msg.GetMsgType() == TCP_CONNECT {
+		local, found := c.services[string(msg.Body.(*TcpData).GetPayload())]
+		if !found {
+			c.servicesMu.Unlock()
+			c.reqChan <- NewMsgBuilderFromMsg(msg).MakeErrorMsg(ErrorUnknownService, 0)
+			return true
+		}
+		c.accepted[sid] = struct{}{}
+		msg = &Msg{Envelope: msg.Envelope, Header: msg.Header, Body: &TcpData{ContentType: CT_RAW, Payload: []byte(local)}}
+		ok = true
+	}
+	c.servicesMu.Unlock()
+	if ok {
+		c.tcpWorker.GetReqChannel() <- msg
+	}
+	return ok
+}
+
+// acceptedDone is called once the worker of an accepted stream is gone
+func (c *TunnelClient) acceptedDone(sid UID) {
+	c.servicesMu.Lock()
+	delete(c.accepted, sid)
+	c.servicesMu.Unlock()
+}
@@ -0,0 +1,91 @@
+package dtunnel
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReverseTunnel(t *testing.T) {
+	//the local service echoes what it gets
+	service, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen fail %v", err)
+	}
+	defer service.Close()
+	go func() {
+		for {
+			conn, err := service.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	server, tc := startTunnel(t, "inproc://test-reverse")
+	defer server.Close()
+	defer tc.Close()
+	for tc.getAgreed() == nil {
+		time.Sleep(5 * time.Millisecond)
+	}
+	//reverse mode is off by default
+	if _, err := tc.Expose("127.0.0.1:0", service.Addr().String()); err == nil {
+		t.Error("expose should fail without an expose acl")
+	}
+	acl, _ := NewExposeACL([]string{"127.0.0.1:0-65535"})
+	server.SetExposeACL(acl)
+	if _, err := tc.Expose("127.0.0.2:0", service.Addr().String()); err == nil {
+		t.Error("expose an address the acl denies should fail")
+	}
+	public, err := tc.Expose("127.0.0.1:0", service.Addr().String())
+	if err != nil {
+		t.Fatalf("Expose fail %v", err)
+	}
+
+	//more than a window each way
+	data := makeTestBody(3*STREAM_WINDOW, 1)
+	conn, err := net.Dial("tcp", public)
+	if err != nil {
+		t.Fatalf("dial exposed service fail %v", err)
+	}
+	go func() {
+		conn.Write(data)
+		conn.(*net.TCPConn).CloseWrite()
+	}()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := ioutil.ReadAll(conn)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("echo not right, got len %d %v", len(got), err)
+	}
+	conn.Close()
+
+	for wait := 0; wait < 100 && (server.reverse.streams.Len() > 0 || tc.tcpWorker.Len() > 0); wait++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if server.reverse.streams.Len() != 0 || tc.tcpWorker.Len() != 0 {
+		t.Errorf("streams leak: server %d, client %d", server.reverse.streams.Len(), tc.tcpWorker.Len())
+	}
+
+	//another client can't take the address, not even with our client id
+	other, _ := NewTunnelClient("inproc://test-reverse")
+	other.SetClientId(tc.id)
+	go other.Run()
+	defer other.Close()
+	if _, err := other.Expose(public, service.Addr().String()); err == nil {
+		t.Error("expose an address in use should fail")
+	}
+	//but the token of the binding takes it over
+	tc.servicesMu.Lock()
+	token := tc.bindTokens[public]
+	tc.servicesMu.Unlock()
+	if addr, _, err := other.bind(public, token); err != nil || addr != public {
+		t.Errorf("take the binding over by its token fail %s %v", addr, err)
+	}
+}
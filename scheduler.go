@@ -0,0 +1,264 @@
+package dtunnel
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	//larger TCP_DATA payloads are split, so streams interleave at a fine grain
+	FRAGMENT_SIZE int = 64 * 1024
+	//bytes a stream may send in its turn, times its weight
+	SCHED_QUANTUM int = 16 * 1024
+	//bytes queued in front of the socket before writers have to wait
+	MAX_SCHED_SIZE int = 16 * 1024 * 1024
+	//what a msg costs beside its payload
+	MSG_COST int = 64
+)
+
+const (
+	PRIORITY_NORMAL uint8 = 0
+	PRIORITY_HIGH   uint8 = 1
+	PRIORITY_LOW    uint8 = 2
+)
+
+var PRIORITY_WEIGHTS map[uint8]int = map[uint8]int{
+	PRIORITY_HIGH:   4,
+	PRIORITY_NORMAL: 2,
+	PRIORITY_LOW:    1,
+}
+
+// scheduler sits in front of the socket writer, it interleaves streams
+// with deficit round robin so a bulk download doesn't starve page loads.
+// Msgs without a stream and window updates go first
+type scheduler struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	control []*Msg
+	streams map[UID]*schedQueue
+	//streams with msgs, the first one has its turn
+	ring []*schedQueue
+	size int
+	//msgs queued, control ones and fragments included
+	count int
+	//msgs popped but not sent yet, see Sent
+	sending int
+	//tells if the peer a msg goes to joins FLAG_MORE fragments
+	canJoin func(msg *Msg) bool
+	closed  bool
+}
+
+type schedQueue struct {
+	sid     UID
+	msgs    []*Msg
+	weight  int
+	deficit int
+}
+
+func newScheduler(canJoin func(msg *Msg) bool) *scheduler {
+	s := &scheduler{
+		streams: make(map[UID]*schedQueue),
+		canJoin: canJoin,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// a RESET stays behind the data of its stream, or the tail would look like a new stream
+func isControlMsg(msg *Msg) bool {
+	return msg.GetMsgType() == WINDOW_UPDATE || msg.GetStreamId() == UID{}
+}
+
+func msgCost(msg *Msg) int {
+	return MSG_COST + payloadSize(msg)
+}
+
+// Push queues msg for sending, it waits if too much is queued already
+func (s *scheduler) Push(msg *Msg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if isControlMsg(msg) {
+		s.control = append(s.control, msg)
+		s.count++
+		s.cond.Broadcast()
+		return
+	}
+	for s.size > MAX_SCHED_SIZE && !s.closed {
+		s.cond.Wait()
+	}
+	sid := msg.GetStreamId()
+	q, ok := s.streams[sid]
+	if !ok {
+		q = &schedQueue{sid: sid}
+		s.streams[sid] = q
+		s.ring = append(s.ring, q)
+	}
+	//the latest hint wins
+	q.weight = PRIORITY_WEIGHTS[msg.priority]
+	if q.weight == 0 {
+		q.weight = PRIORITY_WEIGHTS[PRIORITY_NORMAL]
+	}
+	for _, frag := range s.split(msg) {
+		q.msgs = append(q.msgs, frag)
+		s.size += msgCost(frag)
+		s.count++
+	}
+	s.cond.Broadcast()
+}
+
+// split a large TCP_DATA payload into fragments. Raw ones are just
+// more data to any peer, others need a peer which joins them
+func (s *scheduler) split(msg *Msg) []*Msg {
+	if msg.GetMsgType() != TCP_DATA || payloadSize(msg) <= FRAGMENT_SIZE {
+		return []*Msg{msg}
+	}
+	body := msg.Body.(*TcpData)
+	join := body.ContentType != CT_RAW
+	if join && (s.canJoin == nil || !s.canJoin(msg)) {
+		return []*Msg{msg}
+	}
+	frags := make([]*Msg, 0, len(body.Payload)/FRAGMENT_SIZE+1)
+	for payload := body.Payload; len(payload) > 0; {
+		n := FRAGMENT_SIZE
+		if n > len(payload) {
+			n = len(payload)
+		}
+		header := *msg.Header
+		if n < len(payload) {
+			header.Flag &^= FLAG_STREAM_END
+			if join {
+				header.Flag |= FLAG_MORE
+			}
+		}
+		frags = append(frags, &Msg{
+			Envelope: msg.Envelope,
+			Header:   &header,
+			Body:     &TcpData{ContentType: body.ContentType, Payload: payload[:n]},
+			priority: msg.priority,
+		})
+		payload = payload[n:]
+	}
+	return frags
+}
+
+// Pop waits for the next msg to send, nil once closed
+func (s *scheduler) Pop() *Msg {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.control) == 0 && len(s.ring) == 0 && !s.closed {
+		s.cond.Wait()
+	}
+	if s.closed {
+		return nil
+	}
+	s.count--
+	s.sending++
+	if len(s.control) > 0 {
+		msg := s.control[0]
+		s.control[0] = nil
+		s.control = s.control[1:]
+		return msg
+	}
+	msg := s.next()
+	s.size -= msgCost(msg)
+	s.cond.Broadcast()
+	return msg
+}
+
+// next takes a msg from the stream whose turn it is, a stream which used up
+// its deficit goes to the back of the ring with a new quantum
+func (s *scheduler) next() *Msg {
+	for {
+		q := s.ring[0]
+		if q.deficit < msgCost(q.msgs[0]) {
+			q.deficit += SCHED_QUANTUM * q.weight
+			s.ring = append(s.ring[1:], q)
+			continue
+		}
+		msg := q.msgs[0]
+		q.msgs[0] = nil
+		q.msgs = q.msgs[1:]
+		q.deficit -= msgCost(msg)
+		if len(q.msgs) == 0 {
+			s.ring = s.ring[1:]
+			delete(s.streams, q.sid)
+		}
+		return msg
+	}
+}
+
+// Sent tells a msg of Pop is on the socket, or given up
+func (s *scheduler) Sent() {
+	s.mu.Lock()
+	s.sending--
+	s.mu.Unlock()
+}
+
+// Pending tells if msgs are waiting to be sent, or being sent
+func (s *scheduler) Pending() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.control) > 0 || len(s.ring) > 0 || s.sending > 0
+}
+
+// Len returns the number of msgs waiting to be sent
+func (s *scheduler) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
+
+// Size returns the cost of the stream msgs waiting to be sent, their bytes
+// and MSG_COST each
+func (s *scheduler) Size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+func (s *scheduler) Close() {
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// httpPriority guesses how urgent a stream is. The Priority header
+// (RFC 9218 urgency) wins, then pages, styles and scripts go before
+// media and large downloads. resp may be nil
+func httpPriority(req *http.Request, resp *http.Response) uint8 {
+	for _, param := range strings.Split(req.Header.Get("Priority"), ",") {
+		param = strings.TrimSpace(param)
+		if !strings.HasPrefix(param, "u=") {
+			continue
+		}
+		u, err := strconv.Atoi(param[2:])
+		if err != nil {
+			break
+		}
+		switch {
+		case u <= 2:
+			return PRIORITY_HIGH
+		case u >= 5:
+			return PRIORITY_LOW
+		}
+		return PRIORITY_NORMAL
+	}
+	if resp == nil {
+		return PRIORITY_NORMAL
+	}
+	if resp.ContentLength > int64(MAX_CACHE_SIZE) {
+		return PRIORITY_LOW
+	}
+	mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch {
+	case mt == "text/html", mt == "text/css", strings.Contains(mt, "javascript"), strings.HasSuffix(mt, "json"):
+		return PRIORITY_HIGH
+	case strings.HasPrefix(mt, "video/"), strings.HasPrefix(mt, "audio/"), mt == "application/octet-stream", mt == "application/zip":
+		return PRIORITY_LOW
+	}
+	return PRIORITY_NORMAL
+}
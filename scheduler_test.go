@@ -0,0 +1,126 @@
+package dtunnel
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+func makeStreamMsg(sid UID, ct uint16, payload []byte, flag uint16, priority uint8) *Msg {
+	msg := NewMsgBuilder(sid, testEnvelope, FLAG_HTTP).MakeMsg(TCP_DATA, ct, payload, flag)
+	msg.priority = priority
+	return msg
+}
+
+func TestSchedulerInterleave(t *testing.T) {
+	s := newScheduler(nil)
+	bulk, page := MakeUID(), MakeUID()
+	for i := 0; i < 3; i++ {
+		s.Push(makeStreamMsg(bulk, CT_RAW, makeTestBody(1024*1024, int64(i)), 0, PRIORITY_NORMAL))
+	}
+	s.Push(makeStreamMsg(page, CT_RAW, []byte("hello"), FLAG_STREAM_END, PRIORITY_NORMAL))
+	s.Push(makeReqMsg(UID{}, PING, CT_RAW, []byte(""), 0))
+	//the fragments of the bulk stream, the page and the ping
+	frags := 3*(1024*1024/FRAGMENT_SIZE) + 2
+	if s.Len() != frags || s.Size() != 3*1024*1024+5+(frags-1)*MSG_COST {
+		t.Errorf("queued msgs not counted, got %d msgs of %d", s.Len(), s.Size())
+	}
+
+	if msg := s.Pop(); msg.GetMsgType() != PING {
+		t.Errorf("control msg should go first, got %s", msg)
+	}
+	if s.Len() != frags-1 {
+		t.Errorf("popped msg should not be counted, got %d", s.Len())
+	}
+	for i := 0; i < 5; i++ {
+		msg := s.Pop()
+		if payloadSize(msg) > FRAGMENT_SIZE {
+			t.Errorf("frame too large, got %d", payloadSize(msg))
+		}
+		if msg.GetStreamId() == page {
+			return
+		}
+	}
+	t.Error("small stream should not wait for the bulk one")
+}
+
+func TestSchedulerWeights(t *testing.T) {
+	s := newScheduler(nil)
+	high, low := MakeUID(), MakeUID()
+	for i := 0; i < 50; i++ {
+		s.Push(makeStreamMsg(low, CT_RAW, makeTestBody(16*1024, int64(i)), 0, PRIORITY_LOW))
+		s.Push(makeStreamMsg(high, CT_RAW, makeTestBody(16*1024, int64(i)), 0, PRIORITY_HIGH))
+	}
+	counts := make(map[UID]int)
+	for i := 0; i < 50; i++ {
+		counts[s.Pop().GetStreamId()] += 1
+	}
+	if counts[low] == 0 || counts[high] < 3*counts[low] {
+		t.Errorf("high should get about 4 times the turns of low, got %d and %d", counts[high], counts[low])
+	}
+}
+
+func TestSchedulerSplit(t *testing.T) {
+	sid := MakeUID()
+	data := makeTestBody(3*FRAGMENT_SIZE+100, 1)
+
+	//raw payloads are split for any peer
+	s := newScheduler(nil)
+	s.Push(makeStreamMsg(sid, CT_RAW, data, FLAG_STREAM_END, PRIORITY_NORMAL))
+	for i := 0; i < 4; i++ {
+		msg := s.Pop()
+		if msg.TestFlag(FLAG_MORE) || msg.IsEndOfStream() != (i == 3) {
+			t.Errorf("raw fragment %d flags not right, got %s", i, msg)
+		}
+	}
+
+	//others only for a peer which joins them
+	s.Push(makeStreamMsg(sid, CT_CACHE_DIFF, data, FLAG_STREAM_END, PRIORITY_NORMAL))
+	if msg := s.Pop(); payloadSize(msg) != len(data) {
+		t.Errorf("should not split for peer without fragments, got %d", payloadSize(msg))
+	}
+
+	s = newScheduler(func(*Msg) bool { return true })
+	s.Push(makeStreamMsg(sid, CT_CACHE_DIFF, data, FLAG_STREAM_END, PRIORITY_NORMAL))
+	recvChan := make(chan *Msg, 10)
+	for i := 0; i < 4; i++ {
+		msg := s.Pop()
+		if msg.TestFlag(FLAG_MORE) != (i < 3) {
+			t.Errorf("fragment %d flags not right, got %s", i, msg)
+		}
+		recvChan <- msg
+	}
+	reader := &TunnelReader{recvChan: recvChan}
+	msg, err := reader.readMsgFromChannel()
+	if msg == nil || !msg.IsEndOfStream() || !bytes.Equal(msg.Body.(*TcpData).GetPayload(), data) {
+		t.Errorf("fragments not joined, got %s %v", msg, err)
+	}
+}
+
+func TestHttpPriority(t *testing.T) {
+	cases := []struct {
+		priority    string
+		contentType string
+		length      int64
+		expect      uint8
+	}{
+		{"", "text/html; charset=utf-8", 100, PRIORITY_HIGH},
+		{"", "application/javascript", 100, PRIORITY_HIGH},
+		{"", "video/mp4", 100, PRIORITY_LOW},
+		{"", "text/plain", int64(MAX_CACHE_SIZE) + 1, PRIORITY_LOW},
+		{"", "image/png", 100, PRIORITY_NORMAL},
+		{"u=1, i", "video/mp4", 100, PRIORITY_HIGH},
+		{"u=6", "text/html", 100, PRIORITY_LOW},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+		if c.priority != "" {
+			req.Header.Set("Priority", c.priority)
+		}
+		resp := &http.Response{Header: make(http.Header), ContentLength: c.length}
+		resp.Header.Set("Content-Type", c.contentType)
+		if got := httpPriority(req, resp); got != c.expect {
+			t.Errorf("priority of %q %s not right, got %d expect %d", c.priority, c.contentType, got, c.expect)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package dtunnel
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+const STORE_SHARDS = 16
+
+type storeShard struct {
+	sync.RWMutex
+	m map[string][]byte
+}
+
+// shardedStore is a map safe for concurrent use, keys are spread over
+// STORE_SHARDS locks so workers touching different keys seldom contend
+type shardedStore struct {
+	shards [STORE_SHARDS]*storeShard
+}
+
+func (s *shardedStore) shard(key string) *storeShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return s.shards[h.Sum32()%STORE_SHARDS]
+}
+
+func (s *shardedStore) get(key string) (value []byte, ok bool) {
+	shard := s.shard(key)
+	shard.RLock()
+	value, ok = shard.m[key]
+	shard.RUnlock()
+	return
+}
+
+func (s *shardedStore) set(key string, value []byte) {
+	shard := s.shard(key)
+	shard.Lock()
+	shard.m[key] = value
+	shard.Unlock()
+}
+
+func (s *shardedStore) del(key string) bool {
+	shard := s.shard(key)
+	shard.Lock()
+	_, ok := shard.m[key]
+	delete(shard.m, key)
+	shard.Unlock()
+	return ok
+}
+
+func newShardedStore() *shardedStore {
+	s := new(shardedStore)
+	for i := range s.shards {
+		s.shards[i] = &storeShard{m: make(map[string][]byte)}
+	}
+	return s
+}
@@ -0,0 +1,160 @@
+package dtunnel
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	//how long in-flight streams may take to finish on shutdown
+	GRACE_PERIOD = 10 * time.Second
+	//how often to check if they are done
+	DRAIN_INTERVAL = 50 * time.Millisecond
+	//for the aborted streams to tell the peer
+	ABORT_TIMEOUT = time.Second
+)
+
+var ErrorShuttingDown = errors.New("ShuttingDown")
+
+// Flusher is a cache which keeps some of its state in memory,
+// Flush saves it before we exit
+type Flusher interface {
+	Flush() error
+}
+
+func flushCache(cache Cache) {
+	if f, ok := cache.(Flusher); ok {
+		if err := f.Flush(); err != nil {
+			logger.Printf("fail to flush cache: %s", err)
+		}
+	}
+}
+
+// waitDrained waits for active to be zero, returns false if it's not by timeout
+func waitDrained(active func() int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for active() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(DRAIN_INTERVAL)
+	}
+	return true
+}
+
+// waitSent waits for the msgs queued for the peer to go out, Close drops
+// them. A marker queued after them tells when they are all in sched, then
+// sched is pending till the last one is on the socket
+func waitSent(queue chan *Msg, sched *scheduler) {
+	deadline := time.Now().Add(ABORT_TIMEOUT)
+	timeout := time.NewTimer(ABORT_TIMEOUT)
+	defer timeout.Stop()
+	marker := &Msg{handedOff: make(chan struct{})}
+	select {
+	case queue <- marker:
+	case <-timeout.C:
+		return
+	}
+	select {
+	case <-marker.handedOff:
+	case <-timeout.C:
+		return
+	}
+	waitDrained(func() int {
+		if sched.Pending() {
+			return 1
+		}
+		return 0
+	}, time.Until(deadline))
+}
+
+// handOff moves the msgs of queue to sched in order, sent is told of each
+// first. The marker of waitSent is not scheduled, it's closed instead
+func handOff(queue chan *Msg, sched *scheduler, sent func(msg *Msg)) {
+	for msg := range queue {
+		if msg.handedOff != nil {
+			close(msg.handedOff)
+			continue
+		}
+		sent(msg)
+		sched.Push(msg)
+	}
+}
+
+// SetGracePeriod set how long in-flight streams may take to finish once
+// the context of RunContext is done, should be called before Run
+func (s *TunnelServer) SetGracePeriod(d time.Duration) {
+	s.gracePeriod = d
+}
+
+func (s *TunnelServer) streamWorkers() []*MultiStreamWorker {
+	return []*MultiStreamWorker{
+		s.httpWorker.(*MultiStreamWorker),
+		s.tcpWorker.(*MultiStreamWorker),
+		s.udpWorker.(*MultiStreamWorker),
+	}
+}
+
+func (s *TunnelServer) streamCount() int {
+	n := s.reverse.streams.Len()
+	for _, w := range s.streamWorkers() {
+		n += w.Len()
+	}
+	return n
+}
+
+// shutdown refuses new streams and stops listening for exposed services,
+// the streams in flight have the grace period to finish before they are
+// aborted. Then the cache is flushed and the server closed
+func (s *TunnelServer) shutdown() {
+	atomic.StoreInt32(&s.draining, 1)
+	s.reverse.Close()
+	for _, w := range s.streamWorkers() {
+		w.Drain()
+	}
+	logger.Printf("[ts]shutting down, %d streams in flight", s.streamCount())
+	if !waitDrained(s.streamCount, s.gracePeriod) {
+		logger.Printf("[ts]abort %d streams after %s", s.streamCount(), s.gracePeriod)
+		for _, w := range s.streamWorkers() {
+			w.Abort(ErrorShuttingDown)
+		}
+		s.reverse.abort(ErrorShuttingDown)
+		waitDrained(s.streamCount, ABORT_TIMEOUT)
+	}
+	waitSent(s.repChan, s.sched)
+	flushCache(s.cm.local)
+	s.Close()
+}
+
+// SetGracePeriod set how long in-flight streams may take to finish once
+// the context of RunContext is done, should be called before Run
+func (c *TunnelClient) SetGracePeriod(d time.Duration) {
+	c.gracePeriod = d
+}
+
+// activeStreams counts the streams we opened and those the server opened
+func (c *TunnelClient) activeStreams() int {
+	return c.streamCount() + c.tcpWorker.Len()
+}
+
+// shutdown refuses new streams, the streams in flight have the grace
+// period to finish before they are reset. Then the cache is flushed and
+// the client closed
+func (c *TunnelClient) shutdown() {
+	atomic.StoreInt32(&c.draining, 1)
+	c.tcpWorker.Drain()
+	logger.Printf("[tc]shutting down, %d streams in flight", c.activeStreams())
+	if !waitDrained(c.activeStreams, c.gracePeriod) {
+		logger.Printf("[tc]abort %d streams after %s", c.activeStreams(), c.gracePeriod)
+		for _, st := range c.streams.removeAll(nil) {
+			c.reqChan <- makeReqMsg(st.sid, RESET, CT_RAW, []byte(""), st.flags|FLAG_STREAM_END)
+			st.fail(ErrorShuttingDown)
+		}
+		c.tcpWorker.Abort(ErrorShuttingDown)
+		waitDrained(c.activeStreams, ABORT_TIMEOUT)
+	}
+	waitSent(c.reqChan, c.sched)
+	flushCache(c.cm.local)
+	c.Close()
+}
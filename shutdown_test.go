@@ -0,0 +1,185 @@
+package dtunnel
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func startEcho(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen fail %v", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return ln
+}
+
+func echo(conn net.Conn, word string) error {
+	if _, err := conn.Write([]byte(word)); err != nil {
+		return err
+	}
+	buf := make([]byte, len(word))
+	_, err := io.ReadFull(conn, buf)
+	return err
+}
+
+func TestServerShutdown(t *testing.T) {
+	service := startEcho(t)
+	defer service.Close()
+
+	server, _ := NewTunnelServer("inproc://test-shutdown")
+	server.SetGracePeriod(5 * time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- server.RunContext(ctx)
+	}()
+	defer server.Close()
+	tc, _ := NewTunnelClient("inproc://test-shutdown")
+	go tc.Run()
+	defer tc.Close()
+
+	conn, err := tc.ConnectTcp(service.Addr().String())
+	if err != nil {
+		t.Fatalf("ConnectTcp fail %v", err)
+	}
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	if _, err := tc.ConnectTcp(service.Addr().String()); err == nil || !strings.Contains(err.Error(), ErrorShuttingDown.Error()) {
+		t.Errorf("new stream should be refused, got %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := echo(conn, "hello"); err != nil {
+		t.Errorf("stream in flight should go on, got %v", err)
+	}
+	select {
+	case <-stopped:
+		t.Fatal("should wait for the stream in flight")
+	default:
+	}
+
+	conn.Close()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("RunContext should return nil, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("should return once the streams are drained")
+	}
+}
+
+func TestClientShutdownGracePeriod(t *testing.T) {
+	service := startEcho(t)
+	defer service.Close()
+
+	server, _ := NewTunnelServer("inproc://test-shutdown-grace")
+	go server.Run()
+	defer server.Close()
+	tc, _ := NewTunnelClient("inproc://test-shutdown-grace")
+	tc.SetGracePeriod(200 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- tc.RunContext(ctx)
+	}()
+
+	conn, err := tc.ConnectTcp(service.Addr().String())
+	if err != nil {
+		t.Fatalf("ConnectTcp fail %v", err)
+	}
+	defer conn.Close()
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	if _, err := tc.ConnectTcp(service.Addr().String()); err != ErrorShuttingDown {
+		t.Errorf("expect ShuttingDown, got %v", err)
+	}
+
+	//the stream is left open, it's aborted after the grace period
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("RunContext should return nil, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("should return after the grace period")
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := echo(conn, "hello"); err == nil {
+		t.Error("aborted stream should fail")
+	}
+	workers := server.tcpWorker.(*MultiStreamWorker)
+	for wait := 0; wait < 100 && workers.Len() > 0; wait++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if workers.Len() != 0 {
+		t.Errorf("server should end the reset stream, got %d", workers.Len())
+	}
+}
+
+func TestWaitSent(t *testing.T) {
+	queue := make(chan *Msg, 10)
+	sched := newScheduler(func(*Msg) bool { return false })
+	defer sched.Close()
+	for i := 0; i < 3; i++ {
+		queue <- makeReqMsg(MakeUID(), TCP_DATA, CT_RAW, []byte("data"), FLAG_TCP)
+	}
+	var handed int32
+	//slow to hand them to the scheduler, they are in neither for a while
+	go handOff(queue, sched, func(*Msg) {
+		time.Sleep(100 * time.Millisecond)
+		atomic.AddInt32(&handed, 1)
+	})
+	//and slow to send them once taken
+	var sent int32
+	go func() {
+		for msg := sched.Pop(); msg != nil; msg = sched.Pop() {
+			time.Sleep(100 * time.Millisecond)
+			atomic.AddInt32(&sent, 1)
+			sched.Sent()
+		}
+	}()
+	waitSent(queue, sched)
+	if n := atomic.LoadInt32(&handed); n != 3 || sched.Pending() {
+		t.Errorf("waitSent should wait for all msgs to be scheduled and taken, got %d", n)
+	}
+	if n := atomic.LoadInt32(&sent); n != 3 {
+		t.Errorf("waitSent should wait for the last msg to be sent, got %d", n)
+	}
+}
+
+func TestServerCloseReleasesSocket(t *testing.T) {
+	addr := "inproc://test-server-close"
+	for i := 0; i < 2; i++ {
+		server, err := NewServer(addr)
+		if err != nil {
+			t.Fatalf("bind again after Close fail %v", err)
+		}
+		if i == 0 {
+			go server.Run()
+			time.Sleep(20 * time.Millisecond)
+		}
+		server.Close()
+		//safe to call twice, and a Run after Close returns at once
+		server.Close()
+		if err := server.Run(); err != nil {
+			t.Errorf("Run after Close fail %v", err)
+		}
+	}
+}
@@ -0,0 +1,431 @@
+package dtunnel
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//SOCKS5, RFC 1928, and its username/password auth, RFC 1929
+const (
+	SOCKS_VERSION      = 5
+	SOCKS_AUTH_VERSION = 1
+
+	SOCKS_AUTH_NONE          = 0
+	SOCKS_AUTH_PASSWORD      = 2
+	SOCKS_AUTH_NO_ACCEPTABLE = 0xff
+
+	SOCKS_CMD_CONNECT       = 1
+	SOCKS_CMD_BIND          = 2
+	SOCKS_CMD_UDP_ASSOCIATE = 3
+
+	SOCKS_ATYP_IPV4   = 1
+	SOCKS_ATYP_DOMAIN = 3
+	SOCKS_ATYP_IPV6   = 4
+
+	SOCKS_REP_SUCCEEDED          = 0
+	SOCKS_REP_FAILURE            = 1
+	SOCKS_REP_HOST_UNREACHABLE   = 4
+	SOCKS_REP_CMD_NOT_SUPPORTED  = 7
+	SOCKS_REP_ATYP_NOT_SUPPORTED = 8
+
+	//a client has this long to say what it wants
+	SOCKS_HANDSHAKE_TIMEOUT = 30 * time.Second
+	MAX_DATAGRAM_SIZE       = 65535
+)
+
+var (
+	ErrorSocksVersion  = errors.New("SocksVersion")
+	ErrorSocksAuth     = errors.New("SocksAuth")
+	ErrorSocksAddrType = errors.New("SocksAddrType")
+	ErrorSocksFragment = errors.New("SocksFragment")
+)
+
+// SocksProxyServer is a SOCKS5 front end of the tunnel. Domain names are
+// resolved by the server, UDP ASSOCIATE works if the transport is
+// also a UdpTransport
+type SocksProxyServer struct {
+	tt    TcpTransport
+	users map[string]string
+	//what we serve, for Shutdown
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+}
+
+func NewSocksProxyServer(tt TcpTransport) *SocksProxyServer {
+	return &SocksProxyServer{
+		tt:        tt,
+		users:     make(map[string]string),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// SetAuth adds a user, once there is one clients have to log in
+// with username and password. Should be called before serving
+func (s *SocksProxyServer) SetAuth(user string, password string) {
+	s.users[user] = password
+}
+
+func (s *SocksProxyServer) ListenAndServe(bind string) error {
+	ln, err := net.Listen("tcp", bind)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve accepts conns on ln till Shutdown, then it returns nil
+func (s *SocksProxyServer) Serve(ln net.Listener) error {
+	defer ln.Close()
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.listeners[ln] = struct{}{}
+	s.mu.Unlock()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			delete(s.listeners, ln)
+			if s.closed {
+				return nil
+			}
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// Shutdown stops listening and waits for the clients to go till ctx
+// is done, the conns left are closed then
+func (s *SocksProxyServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	s.mu.Unlock()
+	ticker := time.NewTicker(DRAIN_INTERVAL)
+	defer ticker.Stop()
+	for {
+		s.mu.Lock()
+		left := len(s.conns)
+		s.mu.Unlock()
+		if left == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			s.mu.Lock()
+			for conn := range s.conns {
+				conn.Close()
+			}
+			s.mu.Unlock()
+			return ctx.Err()
+		}
+	}
+}
+
+// ServeConn speaks SOCKS5 on conn till the client is gone
+func (s *SocksProxyServer) ServeConn(conn net.Conn) {
+	defer conn.Close()
+	s.mu.Lock()
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+	conn.SetDeadline(time.Now().Add(SOCKS_HANDSHAKE_TIMEOUT))
+	if err := s.auth(conn); err != nil {
+		logger.Printf("[socks]%s fail to auth: %s", conn.RemoteAddr(), err)
+		return
+	}
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	if header[0] != SOCKS_VERSION {
+		logger.Printf("[socks]%s unknown version %d", conn.RemoteAddr(), header[0])
+		return
+	}
+	host, port, err := readSocksAddr(conn)
+	if err == ErrorSocksAddrType {
+		writeSocksReply(conn, SOCKS_REP_ATYP_NOT_SUPPORTED, nil)
+		return
+	}
+	if err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	switch header[1] {
+	case SOCKS_CMD_CONNECT:
+		s.connect(conn, net.JoinHostPort(host, strconv.Itoa(port)))
+	case SOCKS_CMD_UDP_ASSOCIATE:
+		s.associate(conn)
+	default:
+		writeSocksReply(conn, SOCKS_REP_CMD_NOT_SUPPORTED, nil)
+	}
+}
+
+// auth picks a method the client offers, and checks the password if it's needed
+func (s *SocksProxyServer) auth(conn net.Conn) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[0] != SOCKS_VERSION {
+		return ErrorSocksVersion
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+	want := byte(SOCKS_AUTH_NONE)
+	if len(s.users) > 0 {
+		want = SOCKS_AUTH_PASSWORD
+	}
+	if bytes.IndexByte(methods, want) < 0 {
+		conn.Write([]byte{SOCKS_VERSION, SOCKS_AUTH_NO_ACCEPTABLE})
+		return ErrorSocksAuth
+	}
+	if _, err := conn.Write([]byte{SOCKS_VERSION, want}); err != nil {
+		return err
+	}
+	if want == SOCKS_AUTH_NONE {
+		return nil
+	}
+
+	//VER ULEN UNAME PLEN PASSWD
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[0] != SOCKS_AUTH_VERSION {
+		return ErrorSocksVersion
+	}
+	user := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, header[:1]); err != nil {
+		return err
+	}
+	password := make([]byte, header[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return err
+	}
+	if expected, ok := s.users[string(user)]; !ok || expected != string(password) {
+		conn.Write([]byte{SOCKS_AUTH_VERSION, 1})
+		return ErrorSocksAuth
+	}
+	_, err := conn.Write([]byte{SOCKS_AUTH_VERSION, 0})
+	return err
+}
+
+func (s *SocksProxyServer) connect(conn net.Conn, addr string) {
+	remote, err := s.tt.ConnectTcp(addr)
+	if err != nil {
+		logger.Printf("[socks]fail to connect %s: %s", addr, err)
+		writeSocksReply(conn, SOCKS_REP_HOST_UNREACHABLE, nil)
+		return
+	}
+	//where the server connects from is not known here
+	if err := writeSocksReply(conn, SOCKS_REP_SUCCEEDED, nil); err != nil {
+		remote.Close()
+		return
+	}
+	piping(conn, remote)
+}
+
+// associate relays the datagrams of the client till conn is closed
+func (s *SocksProxyServer) associate(conn net.Conn) {
+	ut, ok := s.tt.(UdpTransport)
+	if !ok {
+		writeSocksReply(conn, SOCKS_REP_CMD_NOT_SUPPORTED, nil)
+		return
+	}
+	host, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	relay, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		logger.Printf("[socks]fail to listen udp: %s", err)
+		writeSocksReply(conn, SOCKS_REP_FAILURE, nil)
+		return
+	}
+	defer relay.Close()
+	remote, err := ut.ListenUdp()
+	if err != nil {
+		logger.Printf("[socks]fail to open udp association: %s", err)
+		writeSocksReply(conn, SOCKS_REP_FAILURE, nil)
+		return
+	}
+	defer remote.Close()
+	if err := writeSocksReply(conn, SOCKS_REP_SUCCEEDED, relay.LocalAddr()); err != nil {
+		return
+	}
+
+	client, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	go func() {
+		relayDatagrams(net.ParseIP(client), relay, remote)
+		//the tunnel ended the association
+		conn.Close()
+	}()
+	io.Copy(ioutil.Discard, conn)
+}
+
+// relayDatagrams sends what the client sends to relay on to remote,
+// and back what comes from remote. Only datagrams from the ip of the
+// client are taken, the first of them tells where replies go.
+// Returns once relay is closed, or remote fails
+func relayDatagrams(client net.IP, relay net.PacketConn, remote net.PacketConn) {
+	var mu sync.Mutex
+	var clientAddr net.Addr
+	go func() {
+		buf := make([]byte, MAX_DATAGRAM_SIZE)
+		for {
+			n, from, err := remote.ReadFrom(buf)
+			if err != nil {
+				relay.Close()
+				return
+			}
+			mu.Lock()
+			to := clientAddr
+			mu.Unlock()
+			if to == nil {
+				continue
+			}
+			//RSV FRAG ATYP DST.ADDR DST.PORT DATA
+			datagram := appendSocksAddr([]byte{0, 0, 0}, from)
+			relay.WriteTo(append(datagram, buf[:n]...), to)
+		}
+	}()
+
+	buf := make([]byte, MAX_DATAGRAM_SIZE)
+	for {
+		n, from, err := relay.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if udpFrom, ok := from.(*net.UDPAddr); !ok || !udpFrom.IP.Equal(client) {
+			continue
+		}
+		dst, data, err := parseSocksDatagram(buf[:n])
+		if err != nil {
+			logger.Printf("[socks]drop datagram from %s: %s", from, err)
+			continue
+		}
+		mu.Lock()
+		clientAddr = from
+		mu.Unlock()
+		if _, err := remote.WriteTo(data, dst); err != nil {
+			logger.Printf("[socks]fail to send datagram to %s: %s", dst, err)
+		}
+	}
+}
+
+func parseSocksDatagram(datagram []byte) (net.Addr, []byte, error) {
+	if len(datagram) < 4 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	//fragments are rare, and optional to support
+	if datagram[2] != 0 {
+		return nil, nil, ErrorSocksFragment
+	}
+	r := bytes.NewReader(datagram[3:])
+	host, port, err := readSocksAddr(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return makeUdpAddr(host, port), datagram[len(datagram)-r.Len():], nil
+}
+
+// makeUdpAddr the addr of host, a domain name is left to the server to resolve
+func makeUdpAddr(host string, port int) net.Addr {
+	if ip := net.ParseIP(host); ip != nil {
+		return &net.UDPAddr{IP: ip, Port: port}
+	}
+	return tunnelAddr(net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+// readSocksAddr reads ATYP DST.ADDR DST.PORT
+func readSocksAddr(r io.Reader) (host string, port int, err error) {
+	header := make([]byte, 1)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+	atyp := header[0]
+	var addr []byte
+	switch atyp {
+	case SOCKS_ATYP_IPV4:
+		addr = make([]byte, net.IPv4len)
+	case SOCKS_ATYP_IPV6:
+		addr = make([]byte, net.IPv6len)
+	case SOCKS_ATYP_DOMAIN:
+		if _, err = io.ReadFull(r, header); err != nil {
+			return
+		}
+		addr = make([]byte, header[0])
+	default:
+		err = ErrorSocksAddrType
+		return
+	}
+	portBytes := make([]byte, 2)
+	if _, err = io.ReadFull(r, addr); err != nil {
+		return
+	}
+	if _, err = io.ReadFull(r, portBytes); err != nil {
+		return
+	}
+	if atyp == SOCKS_ATYP_DOMAIN {
+		host = string(addr)
+	} else {
+		host = net.IP(addr).String()
+	}
+	port = int(binary.BigEndian.Uint16(portBytes))
+	return
+}
+
+// appendSocksAddr appends ATYP ADDR PORT of addr to b, nil is 0.0.0.0:0
+func appendSocksAddr(b []byte, addr net.Addr) []byte {
+	host, port := "0.0.0.0", 0
+	if addr != nil {
+		if h, p, err := net.SplitHostPort(addr.String()); err == nil {
+			host = h
+			port, _ = strconv.Atoi(p)
+		}
+	}
+	if ip := net.ParseIP(host); ip == nil {
+		b = append(b, SOCKS_ATYP_DOMAIN, byte(len(host)))
+		b = append(b, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, SOCKS_ATYP_IPV4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, SOCKS_ATYP_IPV6)
+		b = append(b, ip.To16()...)
+	}
+	portBytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBytes, uint16(port))
+	return append(b, portBytes...)
+}
+
+// writeSocksReply VER REP RSV ATYP BND.ADDR BND.PORT
+func writeSocksReply(w io.Writer, rep byte, bound net.Addr) error {
+	_, err := w.Write(appendSocksAddr([]byte{SOCKS_VERSION, rep, 0}, bound))
+	return err
+}
@@ -0,0 +1,160 @@
+package dtunnel
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func startSocks(t *testing.T, tt TcpTransport, user string, password string) string {
+	s := NewSocksProxyServer(tt)
+	if user != "" {
+		s.SetAuth(user, password)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen fail %v", err)
+	}
+	go s.Serve(ln)
+	return ln.Addr().String()
+}
+
+// socksRequest logs in to the proxy and sends cmd, returns the reply
+func socksRequest(t *testing.T, conn net.Conn, user string, password string, cmd byte, addr net.Addr) (byte, net.Addr) {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	method := byte(SOCKS_AUTH_NONE)
+	if user != "" {
+		method = SOCKS_AUTH_PASSWORD
+	}
+	conn.Write([]byte{SOCKS_VERSION, 1, method})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != method {
+		return SOCKS_REP_FAILURE, nil
+	}
+	if user != "" {
+		auth := append([]byte{SOCKS_AUTH_VERSION, byte(len(user))}, user...)
+		auth = append(append(auth, byte(len(password))), password...)
+		conn.Write(auth)
+		if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 0 {
+			return SOCKS_REP_FAILURE, nil
+		}
+	}
+	conn.Write(appendSocksAddr([]byte{SOCKS_VERSION, cmd, 0}, addr))
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatalf("read reply fail %v", err)
+	}
+	host, port, err := readSocksAddr(conn)
+	if err != nil {
+		t.Fatalf("read bound address fail %v", err)
+	}
+	return header[1], makeUdpAddr(host, port)
+}
+
+func TestSocksConnect(t *testing.T) {
+	service, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen fail %v", err)
+	}
+	defer service.Close()
+	go func() {
+		for {
+			conn, err := service.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	server, tc := startTunnel(t, "inproc://test-socks")
+	defer server.Close()
+	defer tc.Close()
+	proxy := startSocks(t, tc, "user", "secret")
+
+	//the name is resolved by the tunnel server
+	_, port, _ := net.SplitHostPort(service.Addr().String())
+	target := tunnelAddr(net.JoinHostPort("localhost", port))
+
+	conn, _ := net.Dial("tcp", proxy)
+	defer conn.Close()
+	if rep, _ := socksRequest(t, conn, "user", "secret", SOCKS_CMD_CONNECT, target); rep != SOCKS_REP_SUCCEEDED {
+		t.Fatalf("connect should succeed, got %d", rep)
+	}
+	data := makeTestBody(100*1024, 1)
+	go conn.Write(data)
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("echo not right %v", err)
+	}
+
+	bad, _ := net.Dial("tcp", proxy)
+	defer bad.Close()
+	if rep, _ := socksRequest(t, bad, "user", "wrong", SOCKS_CMD_CONNECT, target); rep == SOCKS_REP_SUCCEEDED {
+		t.Error("wrong password should fail")
+	}
+
+	//udp needs a transport which can relay it
+	tcpOnly := startSocks(t, struct{ TcpTransport }{tc}, "", "")
+	assoc, _ := net.Dial("tcp", tcpOnly)
+	defer assoc.Close()
+	if rep, _ := socksRequest(t, assoc, "", "", SOCKS_CMD_UDP_ASSOCIATE, nil); rep != SOCKS_REP_CMD_NOT_SUPPORTED {
+		t.Errorf("expect command not supported, got %d", rep)
+	}
+}
+
+func TestSocksUdpAssociate(t *testing.T) {
+	service, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen fail %v", err)
+	}
+	defer service.Close()
+	go func() {
+		buf := make([]byte, MAX_DATAGRAM_SIZE)
+		for {
+			n, from, err := service.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			service.WriteTo(bytes.ToUpper(buf[:n]), from)
+		}
+	}()
+
+	server, tc := startTunnel(t, "inproc://test-socks-udp")
+	defer server.Close()
+	defer tc.Close()
+	proxy := startSocks(t, tc, "", "")
+	conn, _ := net.Dial("tcp", proxy)
+	defer conn.Close()
+	rep, relay := socksRequest(t, conn, "", "", SOCKS_CMD_UDP_ASSOCIATE, nil)
+	if rep != SOCKS_REP_SUCCEEDED {
+		t.Fatalf("udp associate should succeed, got %d", rep)
+	}
+
+	client, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	defer client.Close()
+	_, port, _ := net.SplitHostPort(service.LocalAddr().String())
+	n, _ := strconv.Atoi(port)
+	datagram := appendSocksAddr([]byte{0, 0, 0}, tunnelAddr(net.JoinHostPort("localhost", port)))
+	client.WriteTo(append(datagram, "hello"...), relay)
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, MAX_DATAGRAM_SIZE)
+	size, _, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("no reply %v", err)
+	}
+	from, data, err := parseSocksDatagram(buf[:size])
+	if err != nil || string(data) != "HELLO" {
+		t.Errorf("reply not right %q %v", data, err)
+	}
+	if from.(*net.UDPAddr).Port != n {
+		t.Errorf("reply should come from the service, got %s", from)
+	}
+}
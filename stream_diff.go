@@ -0,0 +1,271 @@
+package dtunnel
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"github.com/vmihailenco/msgpack"
+)
+
+const (
+	STREAM_BLOCK_SIZE int = 2048
+	MAX_LITERAL_SIZE  int = 64 * 1024
+	//max bytes of a streamed body we keep for cache
+	MAX_STREAM_CACHE_SIZE int = 64 * 1024 * 1024
+)
+
+const (
+	OP_COPY    byte = 'C'
+	OP_LITERAL byte = 'L'
+)
+
+var ErrorInvalidOps = errors.New("InvalidOps")
+
+// one CT_STREAM_DIFF frame, CacheKey and PatchTo are only set in the first frame
+type StreamDiffFrame struct {
+	CacheKey  []byte
+	PatchTo   []byte
+	BlockSize int
+	Ops       []byte
+}
+
+// StreamDiffEncoder encode data against a base version rsync style:
+// the base is split into blocks indexed by a rolling checksum, input which
+// matches a block is sent as a copy op, anything else as literal bytes.
+// Data can be written in pieces, each Flush returns the ops decided so far.
+type StreamDiffEncoder struct {
+	cacheKey  []byte
+	patchTo   []byte
+	base      []byte
+	blockSize int
+	weak      map[uint32][]int
+	strong    [][md5.Size]byte
+
+	pending []byte
+	pos     int //scan position in pending
+	lit     int //start of undecided literal in pending
+	a, b    uint32
+	rolling bool
+
+	ops       *bytes.Buffer
+	copyIndex int
+	copyCount int
+	sentFirst bool
+}
+
+func weakSum(data []byte) (a uint32, b uint32) {
+	n := len(data)
+	for i, x := range data {
+		a += uint32(x)
+		b += uint32(n-i) * uint32(x)
+	}
+	return a & 0xffff, b & 0xffff
+}
+
+func (e *StreamDiffEncoder) Write(data []byte) (int, error) {
+	e.pending = append(e.pending, data...)
+	e.scan()
+	return len(data), nil
+}
+
+func (e *StreamDiffEncoder) scan() {
+	bs := e.blockSize
+	for e.pos+bs <= len(e.pending) {
+		if !e.rolling {
+			e.a, e.b = weakSum(e.pending[e.pos : e.pos+bs])
+			e.rolling = true
+		}
+		if idx, ok := e.match(); ok {
+			e.writeLiteral(e.pending[e.lit:e.pos])
+			e.addCopy(idx)
+			e.pos += bs
+			e.lit = e.pos
+			e.rolling = false
+			continue
+		}
+		if e.pos-e.lit >= MAX_LITERAL_SIZE {
+			e.writeLiteral(e.pending[e.lit:e.pos])
+			e.lit = e.pos
+		}
+		if e.pos+bs < len(e.pending) {
+			out, in := uint32(e.pending[e.pos]), uint32(e.pending[e.pos+bs])
+			e.a = (e.a - out + in) & 0xffff
+			e.b = (e.b - uint32(bs)*out + e.a) & 0xffff
+		} else {
+			e.rolling = false
+		}
+		e.pos++
+	}
+	//drop what has been encoded
+	if e.lit > 0 {
+		e.pending = append([]byte(nil), e.pending[e.lit:]...)
+		e.pos -= e.lit
+		e.lit = 0
+	}
+}
+
+func (e *StreamDiffEncoder) match() (int, bool) {
+	candidates, ok := e.weak[e.a|e.b<<16]
+	if !ok {
+		return 0, false
+	}
+	sum := md5.Sum(e.pending[e.pos : e.pos+e.blockSize])
+	next := e.copyIndex + e.copyCount
+	found := -1
+	for _, idx := range candidates {
+		if e.strong[idx] == sum {
+			found = idx
+			//prefer the block following the last copy, so the copy op grows
+			if idx == next {
+				break
+			}
+		}
+	}
+	return found, found >= 0
+}
+
+func (e *StreamDiffEncoder) addCopy(idx int) {
+	if e.copyCount > 0 && idx == e.copyIndex+e.copyCount {
+		e.copyCount++
+		return
+	}
+	e.flushCopy()
+	e.copyIndex = idx
+	e.copyCount = 1
+}
+
+func (e *StreamDiffEncoder) flushCopy() {
+	if e.copyCount == 0 {
+		return
+	}
+	e.ops.WriteByte(OP_COPY)
+	e.writeUvarint(uint64(e.copyIndex))
+	e.writeUvarint(uint64(e.copyCount))
+	e.copyCount = 0
+}
+
+func (e *StreamDiffEncoder) writeLiteral(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	e.flushCopy()
+	e.ops.WriteByte(OP_LITERAL)
+	e.writeUvarint(uint64(len(data)))
+	e.ops.Write(data)
+}
+
+func (e *StreamDiffEncoder) writeUvarint(x uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], x)
+	e.ops.Write(buf[:n])
+}
+
+// Flush returns the encoded frame of everything decided so far,
+// at most one block of input is held back waiting for more data
+func (e *StreamDiffEncoder) Flush() []byte {
+	e.writeLiteral(e.pending[e.lit:e.pos])
+	e.lit = e.pos
+	e.flushCopy()
+	return e.frame()
+}
+
+// Close returns the last frame, the remaining input is sent as literal
+func (e *StreamDiffEncoder) Close() []byte {
+	e.writeLiteral(e.pending[e.lit:])
+	e.pending = nil
+	e.pos, e.lit = 0, 0
+	e.flushCopy()
+	return e.frame()
+}
+
+// Pending reports whether Flush would produce any ops
+func (e *StreamDiffEncoder) Pending() bool {
+	return e.ops.Len() > 0 || e.copyCount > 0 || e.pos > e.lit
+}
+
+func (e *StreamDiffEncoder) frame() []byte {
+	frame := &StreamDiffFrame{BlockSize: e.blockSize, Ops: e.ops.Bytes()}
+	if !e.sentFirst {
+		frame.CacheKey = e.cacheKey
+		frame.PatchTo = e.patchTo
+		e.sentFirst = true
+	}
+	data, _ := msgpack.Marshal(frame)
+	e.ops.Reset()
+	return data
+}
+
+func NewStreamDiffEncoder(cacheKey []byte, patchTo []byte, base []byte, blockSize int) *StreamDiffEncoder {
+	e := &StreamDiffEncoder{
+		cacheKey:  cacheKey,
+		patchTo:   patchTo,
+		base:      base,
+		blockSize: blockSize,
+		weak:      make(map[uint32][]int),
+		ops:       new(bytes.Buffer),
+	}
+	for i := 0; (i+1)*blockSize <= len(base); i++ {
+		block := base[i*blockSize : (i+1)*blockSize]
+		a, b := weakSum(block)
+		e.weak[a|b<<16] = append(e.weak[a|b<<16], i)
+		e.strong = append(e.strong, md5.Sum(block))
+	}
+	return e
+}
+
+// StreamDiffDecoder rebuild data from CT_STREAM_DIFF frames of one stream
+type StreamDiffDecoder struct {
+	cache Cache
+	base  []byte
+}
+
+func (d *StreamDiffDecoder) Decode(payload []byte) (data []byte, err error) {
+	defer func() {
+		if err != nil {
+			metricDecompressFailures.add(1)
+		}
+	}()
+	frame := new(StreamDiffFrame)
+	err = msgpack.Unmarshal(payload, frame)
+	if err != nil {
+		return
+	}
+	if d.base == nil {
+		d.base, err = getStreamBase(d.cache, frame)
+		if err != nil {
+			return
+		}
+	}
+	return applyStreamOps(d.base, frame.BlockSize, frame.Ops)
+}
+
+func getStreamBase(cache Cache, frame *StreamDiffFrame) ([]byte, error) {
+	digest, ok := cache.GetDigest(frame.CacheKey)
+	if !ok || !bytes.Equal(digest, frame.PatchTo) {
+		return nil, ErrorDecompressFail
+	}
+	base, ok := cache.Get(frame.CacheKey)
+	if !ok {
+		return nil, ErrorDecompressFail
+	}
+	return base, nil
+}
+
+func applyStreamOps(base []byte, blockSize int, ops []byte) ([]byte, error) {
+	return applyOps(ops, func(idx int, count int) ([]byte, bool) {
+		//only whole blocks are copied
+		if blockSize <= 0 || !validRange(idx, count, len(base)/blockSize) {
+			return nil, false
+		}
+		start, end := idx*blockSize, (idx+count)*blockSize
+		if start > end || end > len(base) {
+			return nil, false
+		}
+		return base[start:end], true
+	})
+}
+
+func NewStreamDiffDecoder(cache Cache) *StreamDiffDecoder {
+	return &StreamDiffDecoder{cache: cache}
+}
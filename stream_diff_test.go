@@ -0,0 +1,75 @@
+package dtunnel
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func makeTestBody(size int, seed int64) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func TestStreamDiffRoundTrip(t *testing.T) {
+	key := []byte("http://www.example.com/big")
+	base := makeTestBody(200*1024, 1)
+
+	//change a few places, insert and delete some bytes
+	body := append([]byte(nil), base[:50000]...)
+	body = append(body, []byte("inserted")...)
+	body = append(body, base[50000:120000]...)
+	body = append(body, base[121000:]...)
+	copy(body[150000:], []byte("patched"))
+
+	cache := makeCache()
+	cache.Set(key, base)
+	enc := NewStreamDiffEncoder(key, cache.Digest(base), base, STREAM_BLOCK_SIZE)
+	dec := NewStreamDiffDecoder(cache)
+
+	var frames [][]byte
+	var sent int
+	//feed in odd sized pieces, like a slow stream
+	for start := 0; start < len(body); start += 3001 {
+		end := start + 3001
+		if end > len(body) {
+			end = len(body)
+		}
+		enc.Write(body[start:end])
+		frames = append(frames, enc.Flush())
+	}
+	frames = append(frames, enc.Close())
+
+	result := new(bytes.Buffer)
+	for _, frame := range frames {
+		sent += len(frame)
+		data, err := dec.Decode(frame)
+		if err != nil {
+			t.Fatalf("fail to decode frame %v", err)
+		}
+		result.Write(data)
+	}
+
+	if !bytes.Equal(result.Bytes(), body) {
+		t.Fatalf("decode result not match, expect len %d got %d", len(body), result.Len())
+	}
+	if sent > len(body)/10 {
+		t.Errorf("diff too large, %d bytes for %d bytes body", sent, len(body))
+	}
+}
+
+func TestStreamDiffBaseMismatch(t *testing.T) {
+	key := []byte("http://www.example.com/big")
+	base := makeTestBody(10*1024, 1)
+
+	enc := NewStreamDiffEncoder(key, md5Digest(base), base, STREAM_BLOCK_SIZE)
+	enc.Write(base)
+
+	cache := makeCache()
+	cache.Set(key, []byte("another version"))
+	_, err := NewStreamDiffDecoder(cache).Decode(enc.Close())
+	if err != ErrorDecompressFail {
+		t.Errorf("expect ErrorDecompressFail, got %v", err)
+	}
+}
@@ -0,0 +1,184 @@
+package dtunnel
+
+import (
+	"sync"
+)
+
+// clientStream is the side of a stream which opened it. Msgs of the stream
+// are delivered to ch, ch is closed after its last msg, done is closed when
+// the reader is gone
+type clientStream struct {
+	sid      UID
+	flags    uint16
+	ch       chan *Msg
+	done     chan struct{}
+	doneOnce sync.Once
+	//msgs waiting for the reader, fed to ch
+	queue *recvQueue
+	//credit the peer granted us, nil without flow control
+	window *sendWindow
+	//the peer the stream goes to, empty on the client
+	pid      string
+	envelope [][]byte
+	//which sides ended the stream, guarded by the streamTable
+	recvEnded bool
+	sentEnded bool
+}
+
+// newClientStream makes a stream with the flow control window agreed with
+// the peer, msgMaker makes the WINDOW_UPDATEs sent to sendChan as the
+// reader takes msgs
+func newClientStream(sid UID, flags uint16, window int, maxFrameSize int, sendChan chan *Msg, msgMaker MsgBuilder) *clientStream {
+	st := &clientStream{
+		sid:    sid,
+		flags:  flags,
+		ch:     make(chan *Msg, 1),
+		done:   make(chan struct{}),
+		window: newSendWindow().open(window),
+	}
+	if flags&FLAG_UDP != 0 {
+		//datagrams the reader can't keep up with are dropped
+		st.queue = newLossyRecvQueue(UDP_QUEUE_SIZE, "in")
+	} else if window > 0 {
+		st.queue = newRecvQueue(window + maxFrameSize)
+	} else {
+		st.queue = newRecvQueue(0)
+	}
+	credit := windowUpdater(window, func(n int) {
+		sendChan <- msgMaker.MakeMsg(WINDOW_UPDATE, CT_RAW, encodeWindowUpdate(n), 0)
+	})
+	go func() {
+		if st.queue.pump(st.ch, st.done, credit) {
+			close(st.ch)
+		}
+	}()
+	return st
+}
+
+func (st *clientStream) deliver(msg *Msg) error {
+	return st.queue.push(msg)
+}
+
+func (st *clientStream) abandon() {
+	st.doneOnce.Do(func() {
+		close(st.done)
+		st.queue.close()
+		if st.window != nil {
+			st.window.close()
+		}
+	})
+}
+
+// fail ends the stream with err, the reader gets what came before
+func (st *clientStream) fail(err error) {
+	logger.Printf("[%x] fail stream: %s", st.sid, err)
+	if st.window != nil {
+		st.window.close()
+	}
+	st.deliver(NewMsgBuilder(st.sid, nil, 0).MakeErrorMsg(err, 0))
+}
+
+// streamTable holds the streams we opened. A stream stays until both sides
+// ended it, the peer grants credit to our writer till we end our side
+type streamTable struct {
+	mu      sync.Mutex
+	streams map[UID]*clientStream
+}
+
+func newStreamTable() *streamTable {
+	return &streamTable{streams: make(map[UID]*clientStream)}
+}
+
+func (t *streamTable) add(st *clientStream) {
+	t.mu.Lock()
+	t.streams[st.sid] = st
+	t.mu.Unlock()
+}
+
+func (t *streamTable) get(sid UID) (*clientStream, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st, ok := t.streams[sid]
+	return st, ok
+}
+
+// whoever removes a stream from the table is the only one to end it
+func (t *streamTable) remove(sid UID) (*clientStream, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st, ok := t.streams[sid]
+	if ok {
+		delete(t.streams, sid)
+	}
+	return st, ok
+}
+
+// removeAll removes the streams match returns true for, all if match is nil
+func (t *streamTable) removeAll(match func(st *clientStream) bool) []*clientStream {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	removed := make([]*clientStream, 0)
+	for sid, st := range t.streams {
+		if match == nil || match(st) {
+			delete(t.streams, sid)
+			removed = append(removed, st)
+		}
+	}
+	return removed
+}
+
+func (t *streamTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.streams)
+}
+
+// ended marks a side of the stream of msg ended, and removes it once both are.
+// It's removed at once when the peer fails it, or ends one without flow control
+func (t *streamTable) ended(msg *Msg, sent bool) (*clientStream, bool) {
+	sid := msg.GetStreamId()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st, ok := t.streams[sid]
+	if !ok || !msg.IsEndOfStream() {
+		return st, ok
+	}
+	if sent {
+		st.sentEnded = true
+	} else {
+		st.recvEnded = true
+	}
+	mt := msg.GetMsgType()
+	peerDone := !sent && (st.window == nil || mt == ERROR || mt == RESET)
+	if (st.sentEnded && st.recvEnded) || peerDone {
+		delete(t.streams, sid)
+	}
+	return st, ok
+}
+
+// sent tells the table msg went out to the peer
+func (t *streamTable) sent(msg *Msg) {
+	if msg.IsEndOfStream() {
+		t.ended(msg, true)
+	}
+}
+
+// dispatch delivers msg from the peer to its stream, cancel is called
+// if the stream can't take it. Returns false for an unknown stream
+func (t *streamTable) dispatch(msg *Msg, cancel func(st *clientStream)) bool {
+	st, ok := t.ended(msg, false)
+	if !ok {
+		return false
+	}
+	if msg.GetMsgType() == WINDOW_UPDATE {
+		if st.window != nil {
+			st.window.grant(windowIncrement(msg))
+		}
+		return true
+	}
+	if err := st.deliver(msg); err != nil {
+		logger.Printf("[%x] fail to deliver msg: %s", st.sid, err)
+		cancel(st)
+	}
+	return true
+}
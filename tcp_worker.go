@@ -1,13 +1,36 @@
 package dtunnel
 
 import (
+	"context"
 	"errors"
-	"log"
 	"net"
 )
 
 type TcpWorker struct {
 	reqChan chan *Msg
+	cm      *CacheManager
+	//canceled when the peer resets the stream, closes the conn
+	ctx    context.Context
+	cancel context.CancelFunc
+	window *sendWindow
+	//how to connect the host of TCP_CONNECT
+	dial dialFunc
+}
+
+type dialFunc func(ctx context.Context, network string, address string) (net.Conn, error)
+
+func newTcpWorker(reqChan chan *Msg, cm *CacheManager) *TcpWorker {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &TcpWorker{reqChan, cm, ctx, cancel, newSendWindow(), new(net.Dialer).DialContext}
+}
+
+func (w *TcpWorker) Cancel() {
+	w.cancel()
+	w.window.close()
+}
+
+func (w *TcpWorker) UpdateWindow(n int) {
+	w.window.grant(n)
 }
 
 func (w *TcpWorker) GetReqChannel() chan *Msg {
@@ -20,6 +43,7 @@ func (w *TcpWorker) Run(repChan chan *Msg) error {
 		return errors.New("invalid first msg")
 	}
 
+	defer w.cancel()
 	msgMaker := NewMsgBuilderFromMsg(connectMsg)
 	conn, err := w.handleConnect(connectMsg, repChan, msgMaker)
 	if err != nil {
@@ -27,40 +51,70 @@ func (w *TcpWorker) Run(repChan chan *Msg) error {
 	}
 
 	defer conn.Close()
-	tunnelConn := &TunnelConn{
-		&TunnelReader{recvChan: w.reqChan},
-		&TunnelWriter{
-			sendChan: repChan,
-			msgMaker: msgMaker,
-		},
-	}
+	go func() {
+		<-w.ctx.Done()
+		conn.Close()
+	}()
+	writer := newPeerWriter(w.cm, connectMsg.GetPeerId(), repChan, msgMaker)
+	writer.window = w.window.open(w.cm.GetPeerWindow(connectMsg.GetPeerId()))
+	reader := &TunnelReader{recvChan: w.reqChan, cancel: w.reset(repChan, msgMaker), aborted: w.ctx.Done()}
+	reader.maxFrameSize = w.cm.GetPeerMaxFrameSize(connectMsg.GetPeerId())
+	tunnelConn := newTunnelConn(reader, writer, conn.LocalAddr(), peerAddr(w.cm, connectMsg.GetPeerId()))
 	piping(tunnelConn, conn)
 	return nil
 }
 
+// peerAddr names the peer by the id it said hello with
+func peerAddr(cm *CacheManager, pid string) net.Addr {
+	if peer, ok := cm.GetPeer(pid); ok && peer.ClientId() != "" {
+		return tunnelAddr(peer.ClientId())
+	}
+	return tunnelAddr(pid)
+}
+
+// reset tells the peer to abort the stream, unless the peer did it first
+func (w *TcpWorker) reset(repChan chan *Msg, msgMaker MsgBuilder) func() {
+	return func() {
+		if w.ctx.Err() == nil {
+			repChan <- msgMaker.MakeMsg(RESET, CT_RAW, []byte(""), FLAG_STREAM_END)
+		}
+		w.Cancel()
+	}
+}
+
 func (w *TcpWorker) handleConnect(reqMsg *Msg, repChan chan *Msg, msgMaker MsgBuilder) (conn net.Conn, err error) {
 	host := string(reqMsg.Body.(*TcpData).GetPayload())
-	conn, err = net.Dial("tcp", host)
+	conn, err = w.dial(w.ctx, "tcp", host)
 	if err != nil {
 		repChan <- msgMaker.MakeErrorMsg(err, 0)
 	} else {
 		remoteAddr := conn.RemoteAddr().String()
-		log.Printf("dial to %s success, remote: %s", host, remoteAddr)
+		logger.Printf("dial to %s success, remote: %s", host, remoteAddr)
 		repChan <- msgMaker.MakeMsg(TCP_CONNECT_REP, CT_RAW, []byte(remoteAddr), FLAG_STREAM_BEGIN)
 	}
 	return
 }
 
-type TcpWorkerFactory struct{}
+type TcpWorkerFactory struct {
+	cm *CacheManager
+	//net.Dialer if nil
+	dial dialFunc
+}
 
 func (s *TcpWorkerFactory) MakeStreamWorker(sid UID) Worker {
-	return &TcpWorker{make(chan *Msg)}
+	w := newTcpWorker(make(chan *Msg), s.cm)
+	if s.dial != nil {
+		w.dial = s.dial
+	}
+	return w
 }
 
-func NewMultiStreamTcpWorker() Worker {
-	return &MultiStreamWorker{
-		factory: new(TcpWorkerFactory),
-		workers: make(map[UID]Worker),
-		reqChan: make(chan *Msg),
-	}
+func NewMultiStreamTcpWorker(cm *CacheManager) Worker {
+	return newMultiStreamTcpWorker(&TcpWorkerFactory{cm: cm})
+}
+
+func newMultiStreamTcpWorker(factory *TcpWorkerFactory) *MultiStreamWorker {
+	w := newMultiStreamWorker(factory)
+	w.cm = factory.cm
+	return w
 }
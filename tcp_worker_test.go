@@ -20,7 +20,7 @@ func TestTcpWorker(t *testing.T) {
 	reqChan := make(chan *Msg)
 	repChan := make(chan *Msg)
 
-	worker := &TcpWorker{reqChan}
+	worker := newTcpWorker(reqChan, makeCacheManager())
 
 	host := "httpbin.org:80"
 	sid := MakeUID()
@@ -2,92 +2,289 @@ package dtunnel
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	zmq "github.com/pebbe/zmq4"
 	"io"
-	"log"
 	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//max cache items in one CACHE_SHARE msg
+const CACHE_SHARE_BATCH = 100
+
+//default heartbeat, see SetHeartbeat
+const (
+	HEARTBEAT_INTERVAL = 10 * time.Second
+	LIVENESS_TIMEOUT   = 30 * time.Second
+)
+
+var (
+	ErrorPeerTimeout = errors.New("PeerTimeout")
+	ErrorPeerReset   = errors.New("PeerReset")
 )
 
 type TunnelClient struct {
-	socket   *zmq.Socket
-	repChans map[UID]chan *Msg
-	reqChan  chan *Msg
-	cm       *CacheManager
+	sockMu sync.Mutex
+	socket *zmq.Socket
+	//make a new socket connected to the server
+	dial    func() (*zmq.Socket, error)
+	streams *streamTable
+	reqChan chan *Msg
+	cm      *CacheManager
+	id      string
+	//*HelloData agreed with the server, empty until HELLO_REP
+	agreed atomic.Value
+	//closed on HELLO_REP, made again on reconnect
+	agreedMu   sync.Mutex
+	handshaken chan struct{}
+	//error the server rejected our hello with
+	rejected atomic.Value
+	//ping the server every heartbeat, reconnect if nothing is heard in timeout
+	heartbeat time.Duration
+	timeout   time.Duration
+	done      chan struct{}
+	sched     *scheduler
+	//address of the server
+	endpoint string
+	//unix nano of the last msg from the server
+	lastHeard int64
+	//services we expose, by the address the server listens on
+	servicesMu sync.Mutex
+	services   map[string]string
+	//tokens of the bindings of services, to take them over on reconnect
+	bindTokens map[string]string
+	//streams the server opened, they are run by tcpWorker
+	accepted  map[UID]struct{}
+	tcpWorker *MultiStreamWorker
+	hooks     *Hooks
+	//in-flight streams may take this long to finish when RunContext stops
+	gracePeriod time.Duration
+	//set once RunContext is shutting down
+	draining  int32
+	closeOnce sync.Once
 }
 
 func NewTunnelClient(remote string) (*TunnelClient, error) {
-	//TODO: panic if failed
-	socket, _ := zmq.NewSocket(zmq.DEALER)
-	socket.Connect(remote)
-	return &TunnelClient{
-		socket,
-		make(map[UID]chan *Msg),
-		make(chan *Msg, 1),
-		makeCacheManager(),
-	}, nil
+	return NewClient(remote)
 }
 
 func NewTunnelClientKeyPair(remote string, server_pub string, pub string, secret string) (*TunnelClient, error) {
 	if len(server_pub) == 0 || len(pub) == 0 || len(secret) == 0 {
 		return NewTunnelClient(remote)
 	}
-	socket, _ := zmq.NewSocket(zmq.DEALER)
-	socket.ClientAuthCurve(server_pub, pub, secret)
-	socket.Connect(remote)
-	return &TunnelClient{
-		socket,
-		make(map[UID]chan *Msg),
-		make(chan *Msg, 1),
-		makeCacheManager(),
-	}, nil
+	return NewClient(remote, WithClientKeys(server_pub, pub, secret))
+}
+
+// NewClient makes a client of the server at remote, see Option for what it takes
+func NewClient(remote string, opts ...Option) (*TunnelClient, error) {
+	o := makeOptions(opts)
+	c, err := newTunnelClient(func() (*zmq.Socket, error) {
+		return o.clientSocket(remote)
+	}, remote)
+	if err != nil {
+		return nil, err
+	}
+	if o.cache != nil {
+		c.SetCache(o.cache)
+	}
+	if o.dial != nil {
+		c.tcpWorker.factory.(*TcpWorkerFactory).dial = o.dial
+	}
+	c.hooks = joinHooks(metricsHooks("client"), o.hooks)
+	c.tcpWorker.hooks = c.hooks
+	return c, nil
+}
+
+func newTunnelClient(dial func() (*zmq.Socket, error), endpoint string) (*TunnelClient, error) {
+	socket, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	c := &TunnelClient{
+		endpoint:    endpoint,
+		socket:      socket,
+		dial:        dial,
+		streams:     newStreamTable(),
+		reqChan:     make(chan *Msg, 1),
+		cm:          makeCacheManager(),
+		id:          defaultClientId(),
+		heartbeat:   HEARTBEAT_INTERVAL,
+		timeout:     LIVENESS_TIMEOUT,
+		gracePeriod: GRACE_PERIOD,
+		done:        make(chan struct{}),
+		handshaken:  make(chan struct{}),
+		services:    make(map[string]string),
+		bindTokens:  make(map[string]string),
+		accepted:    make(map[UID]struct{}),
+	}
+	c.tcpWorker = NewMultiStreamTcpWorker(c.cm).(*MultiStreamWorker)
+	c.tcpWorker.onDone = c.acceptedDone
+	c.sched = newScheduler(func(*Msg) bool {
+		agreed := c.getAgreed()
+		return agreed != nil && agreed.JoinFragments
+	})
+	c.cm.OnEvict = c.shareEvicted
+	return c, nil
+}
+
+// SetCache replace the local cache, should be called before Run
+func (c *TunnelClient) SetCache(cache Cache) {
+	c.cm.SetLocal(cache)
+}
+
+// SetClientId set the identity sent to the server, should be called before Run
+func (c *TunnelClient) SetClientId(id string) {
+	c.id = id
+}
+
+// SetHeartbeat set how often to ping the server, and how long without
+// hearing from it before in-flight streams fail and we reconnect.
+// Should be called before Run
+func (c *TunnelClient) SetHeartbeat(interval time.Duration, timeout time.Duration) {
+	c.heartbeat = interval
+	c.timeout = timeout
+}
+
+// Err returns why the server rejected us, nil if it didn't
+func (c *TunnelClient) Err() error {
+	if err, ok := c.rejected.Load().(error); ok {
+		return err
+	}
+	return nil
+}
+
+// usable tells why no new stream may be opened, nil if they may
+func (c *TunnelClient) usable() error {
+	if err := c.Err(); err != nil {
+		return err
+	}
+	if atomic.LoadInt32(&c.draining) == 1 {
+		return ErrorShuttingDown
+	}
+	return nil
+}
+
+// Healthy tells if the handshake is done and the server answered
+// in the last two heartbeats
+func (c *TunnelClient) Healthy() bool {
+	if c.Err() != nil || c.getAgreed() == nil {
+		return false
+	}
+	heard := time.Unix(0, atomic.LoadInt64(&c.lastHeard))
+	return time.Since(heard) < 2*c.heartbeat
+}
+
+func (c *TunnelClient) getAgreed() *HelloData {
+	if agreed, ok := c.agreed.Load().(*HelloData); ok && agreed != nil {
+		return agreed
+	}
+	return nil
+}
+
+// newWriter makes a writer using what the server agreed on in the handshake
+func (c *TunnelClient) newWriter(st *clientStream) *TunnelWriter {
+	w := &TunnelWriter{
+		sendChan:     c.reqChan,
+		msgMaker:     NewMsgBuilder(st.sid, [][]byte{[]byte("")}, st.flags),
+		maxFrameSize: MAX_FRAME_SIZE,
+		window:       st.window,
+	}
+	if agreed := c.getAgreed(); agreed != nil {
+		w.compression = preferCompression(agreed.Compressions)
+		if agreed.MaxFrameSize > 0 {
+			w.maxFrameSize = agreed.MaxFrameSize
+		}
+	}
+	return w
+}
+
+//tell the server what we already hold, so it can diff against them at once
+func (c *TunnelClient) shareLocal() {
+	sc, ok := c.cm.local.(SharableCache)
+	if !ok {
+		return
+	}
+	items := sc.Items()
+	logger.Printf("share %d local cache items", len(items))
+	for len(items) > 0 {
+		n := CACHE_SHARE_BATCH
+		if len(items) < n {
+			n = len(items)
+		}
+		c.reqChan <- makeCacheShareItemsMsg(items[:n])
+		items = items[n:]
+	}
+}
+
+//tell the server we no longer have the base version
+func (c *TunnelClient) shareEvicted(key []byte) {
+	c.reqChan <- makeCacheShareMsg(key, nil)
 }
 
 func (c *TunnelClient) ConnectTcp(host string) (net.Conn, error) {
+	if err := c.usable(); err != nil {
+		return nil, err
+	}
 	sid := MakeUID()
-	repChan := make(chan *Msg, 1)
-	c.repChans[sid] = repChan
+	st := c.addStream(sid, FLAG_TCP)
 
 	c.reqChan <- makeReqMsg(sid, TCP_CONNECT, CT_RAW, []byte(host), FLAG_TCP|FLAG_STREAM_BEGIN)
 
-	msg := <-repChan
+	msg := <-st.ch
 
-	envelope := [][]byte{[]byte("")}
 	if msg.GetMsgType() == ERROR {
 		return nil, fmt.Errorf("Connect Error : %s", msg.Body)
 	}
-	conn := &TunnelConn{
-		&TunnelReader{recvChan: repChan},
-		&TunnelWriter{
-			sendChan: c.reqChan,
-			msgMaker: NewMsgBuilder(sid, envelope, FLAG_TCP),
-		},
-	}
+	reader := &TunnelReader{recvChan: st.ch, cancel: c.canceler(st), aborted: st.done}
+	remoteAddr := parseAddr(string(msg.Body.(*TcpData).GetPayload()))
+	conn := newTunnelConn(reader, c.newWriter(st), tunnelAddr(c.endpoint), remoteAddr)
 	return conn, nil
 }
 
 // implement http.RoundTrip interface
 // send http request via the tunnel
 func (c *TunnelClient) RoundTrip(r *http.Request) (io.ReadCloser, error) {
+	if err := c.usable(); err != nil {
+		return nil, err
+	}
 	sid := MakeUID()
-	repChan := make(chan *Msg, 1)
-	c.repChans[sid] = repChan
-	envelope := [][]byte{[]byte("")}
+	st := c.addStream(sid, FLAG_HTTP|FLAG_TCP)
 	var reader io.ReadCloser
 	var writer io.WriteCloser
 
 	cacheKey := makeCacheKey(r)
+	tr := &TunnelReader{
+		recvChan: st.ch,
+		cache:    c.cm.local,
+		release:  c.releaser(st),
+		cancel:   c.canceler(st),
+		aborted:  st.done,
+	}
+	tr.resend = func() chan *Msg {
+		resent := c.requestResend(sid)
+		tr.release = c.releaser(resent)
+		tr.mu.Lock()
+		if tr.cancel != nil {
+			tr.cancel = c.canceler(resent)
+		}
+		tr.mu.Unlock()
+		tr.aborted = resent.done
+		return resent.ch
+	}
 	reader = &CachedTunnelReader{
-		&TunnelReader{recvChan: repChan, cache: c.cm.local},
+		tr,
 		c.cm.local,
 		cacheKey,
 		new(bytes.Buffer),
 	}
-	writer = &TunnelWriter{
-		sendChan: c.reqChan,
-		msgMaker: NewMsgBuilder(sid, envelope, FLAG_HTTP|FLAG_TCP),
-	}
+	w := c.newWriter(st)
+	w.priority = httpPriority(r, nil)
+	writer = w
 
 	if c.cm != nil {
 		cacheKey := makeCacheKey(r)
@@ -105,51 +302,254 @@ func (c *TunnelClient) RoundTrip(r *http.Request) (io.ReadCloser, error) {
 	return reader, nil
 }
 
+func (c *TunnelClient) reject(err error) error {
+	logger.Printf("[tc]handshake failed: %s", err)
+	c.rejected.Store(err)
+	//wake up the streams waiting for the handshake
+	c.setAgreed(nil)
+	return err
+}
+
+// ask the server for the full body of stream sid on a new stream
+func (c *TunnelClient) requestResend(sid UID) *clientStream {
+	st := c.addStream(MakeUID(), FLAG_HTTP|FLAG_TCP)
+	c.reqChan <- makeReqMsg(st.sid, CACHE_MISS, CT_RAW, sid[:], FLAG_HTTP|FLAG_TCP|FLAG_STREAM_BEGIN)
+	return st
+}
+
 func (c *TunnelClient) Run() error {
+	return c.RunContext(context.Background())
+}
+
+// RunContext runs till ctx is done, Close is called, or the server rejects
+// us, see shutdown
+func (c *TunnelClient) RunContext(ctx context.Context) error {
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.shutdown()
+		case <-c.done:
+		}
+	}()
+	c.exportGauges(true)
+	defer c.exportGauges(false)
+	go c.tcpWorker.Run(c.reqChan)
 
+	//streams take turns on the socket
+	go func() {
+		handOff(c.reqChan, c.sched, c.streams.sent)
+		logger.Printf("reach end of reqChan, should not happen")
+	}()
 	//just to solve zmq socket thread safe problem
 	go func() {
-		for msg := range c.reqChan {
+		for msg := c.sched.Pop(); msg != nil; msg = c.sched.Pop() {
 			frames, err := toFrames(msg)
 			if err != nil {
-				log.Printf("fail to build frames: %s", err.Error())
+				logger.Printf("fail to build frames: %s", err.Error())
+				c.sched.Sent()
 				continue
 			}
-			log.Printf("[tc]send msg %s", msg)
+			logger.Printf("[tc]send msg %s", msg)
+			c.sockMu.Lock()
 			c.socket.SendMessage(frames)
+			c.sockMu.Unlock()
+			c.sched.Sent()
+			c.hooks.msgSent(msg, frames)
 		}
-		log.Print("reach end of reqChan, should not happen")
 	}()
 
+	c.sockMu.Lock()
+	c.socket.SetRcvtimeo(c.heartbeat)
+	c.sockMu.Unlock()
+	c.handshake()
+
+	lastRecv, lastPing := time.Now(), time.Now()
 	for {
-		frames, err := c.socket.RecvMessageBytes(0)
+		c.sockMu.Lock()
+		socket := c.socket
+		c.sockMu.Unlock()
+		frames, err := socket.RecvMessageBytes(0)
+		select {
+		case <-c.done:
+			return nil
+		default:
+		}
+
+		now := time.Now()
+		if now.Sub(lastPing) >= c.heartbeat {
+			c.reqChan <- makeReqMsg(UID{}, PING, CT_RAW, []byte(""), 0)
+			lastPing = now
+		}
 		if err != nil {
-			log.Printf("[tc]recv zmq error %s", err)
+			if now.Sub(lastRecv) > c.timeout {
+				logger.Printf("[tc]nothing from server in %s, reconnect", c.timeout)
+				c.reconnect(ErrorPeerTimeout)
+				lastRecv = time.Now()
+			}
 			continue
 		}
+		lastRecv = now
+		atomic.StoreInt64(&c.lastHeard, now.UnixNano())
 		msg, err := fromFrames(frames)
 		if err != nil {
-			log.Printf("invalid frames : %s", err.Error())
+			logger.Printf("invalid frames : %s", err.Error())
 			continue
 		}
 
-		log.Printf("[tc]recv msg %s", msg)
-		sid := msg.GetStreamId()
-		repChan, ok := c.repChans[sid]
-		if !ok {
-			log.Printf("invalid request id: %s", sid)
+		logger.Printf("[tc]recv msg %s", msg)
+		c.hooks.msgReceived(msg, frames)
+		switch msg.GetMsgType() {
+		case PONG:
+			continue
+		case HELLO:
+			//the server lost our state, it restarted or reaped us
+			logger.Printf("[tc]server asks for hello again, reconnect")
+			c.reconnect(ErrorPeerReset)
+			continue
+		case HELLO_REP:
+			agreed := msg.Body.(*HelloData)
+			if version := helloVersion(agreed, msg.Header.Version); !compatibleVersion(version) {
+				return c.reject(versionError(version))
+			}
+			logger.Printf("[tc]server agreed on %s", agreed)
+			c.setAgreed(agreed)
+			//for the streams the server opens
+			c.cm.SetPeerHello("", agreed)
 			continue
 		}
-		repChan <- msg
-		if msg.IsEndOfStream() {
-			close(repChan)
+		if msg.GetMsgType() == ERROR && msg.GetStreamId() == (UID{}) {
+			return c.reject(fmt.Errorf("server rejected hello: %s", msg.Body))
 		}
+		if c.acceptStream(msg) {
+			continue
+		}
+		c.dispatch(msg)
 	}
-	log.Print("should never reach here")
+	logger.Printf("should never reach here")
 	return nil
 }
 
-func (c *TunnelClient) Close() error {
+func (c *TunnelClient) handshake() {
+	c.reqChan <- makeHelloMsg(HELLO, [][]byte{[]byte("")}, makeHelloData(c.id))
+	go c.shareLocal()
+	go c.exposeAgain()
+}
+
+// fail in-flight streams and start over with a new socket,
+// the server treats us as a new peer and we share our cache again
+func (c *TunnelClient) reconnect(err error) {
+	c.failStreams(err)
+	c.tcpWorker.Reap("")
+	c.agreedMu.Lock()
+	c.agreed.Store((*HelloData)(nil))
+	c.handshaken = make(chan struct{})
+	c.agreedMu.Unlock()
+	socket, err := c.dial()
+	if err != nil {
+		//keep the old one, we try again after another timeout
+		logger.Printf("[tc]fail to reconnect: %s", err)
+		return
+	}
+	socket.SetRcvtimeo(c.heartbeat)
+	c.sockMu.Lock()
 	c.socket.Close()
+	c.socket = socket
+	c.sockMu.Unlock()
+	c.handshake()
+}
+
+// setAgreed ends the handshake, agreed is nil if it failed
+func (c *TunnelClient) setAgreed(agreed *HelloData) {
+	c.agreedMu.Lock()
+	defer c.agreedMu.Unlock()
+	if agreed != nil {
+		c.agreed.Store(agreed)
+	}
+	if !isClosedChan(c.handshaken) {
+		close(c.handshaken)
+	}
+}
+
+// waitAgreed waits for the handshake, the server gives the streams of
+// a peer its window only once it's done. Returns nil if it didn't finish in timeout
+func (c *TunnelClient) waitAgreed() *HelloData {
+	timeout := time.NewTimer(c.timeout)
+	defer timeout.Stop()
+	for {
+		c.agreedMu.Lock()
+		agreed, handshaken := c.getAgreed(), c.handshaken
+		c.agreedMu.Unlock()
+		if agreed != nil || c.Err() != nil {
+			return agreed
+		}
+		select {
+		case <-handshaken:
+		case <-c.done:
+			return nil
+		case <-timeout.C:
+			return nil
+		}
+	}
+}
+
+func (c *TunnelClient) addStream(sid UID, flags uint16) *clientStream {
+	var window, maxFrameSize int
+	if agreed := c.waitAgreed(); agreed != nil {
+		window, maxFrameSize = agreed.Window, agreed.MaxFrameSize
+	}
+	msgMaker := NewMsgBuilder(sid, [][]byte{[]byte("")}, flags)
+	st := newClientStream(sid, flags, window, maxFrameSize, c.reqChan, msgMaker)
+	c.streams.add(st)
+	return st
+}
+
+// releaser drops the stream quietly, the server still finishes it
+func (c *TunnelClient) releaser(st *clientStream) func() {
+	return func() {
+		c.streams.remove(st.sid)
+		st.abandon()
+	}
+}
+
+// canceler drops the stream and tells the server to abort it
+func (c *TunnelClient) canceler(st *clientStream) func() {
+	return func() {
+		if _, ok := c.streams.remove(st.sid); ok {
+			logger.Printf("[%x] reset stream", st.sid)
+			c.reqChan <- makeReqMsg(st.sid, RESET, CT_RAW, []byte(""), st.flags|FLAG_STREAM_END)
+		}
+		st.abandon()
+	}
+}
+
+func (c *TunnelClient) streamCount() int {
+	return c.streams.Len()
+}
+
+// deliver msg to its stream
+func (c *TunnelClient) dispatch(msg *Msg) {
+	ok := c.streams.dispatch(msg, func(st *clientStream) {
+		c.canceler(st)()
+	})
+	if !ok {
+		logger.Printf("[%x] drop msg of unknown stream", msg.GetStreamId())
+	}
+}
+
+// end all in-flight streams with err
+func (c *TunnelClient) failStreams(err error) {
+	for _, st := range c.streams.removeAll(nil) {
+		st.fail(err)
+	}
+}
+
+func (c *TunnelClient) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.sched.Close()
+		c.sockMu.Lock()
+		c.socket.Close()
+		c.sockMu.Unlock()
+	})
 	return nil
 }
@@ -0,0 +1,96 @@
+package dtunnel
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamLifecycle(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s", r.URL.Path)
+	}))
+	defer ts.Close()
+
+	addr := "inproc://test-stream-lifecycle"
+	server, _ := NewTunnelServer(addr)
+	go server.Run()
+	tc, _ := NewTunnelClient(addr)
+	go tc.Run()
+	defer tc.Close()
+	proxy := NewHttpProxyServer(tc)
+
+	get := func(i int) {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("%s/%d", ts.URL, i), nil)
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, req)
+		if body := rec.Body.String(); body != fmt.Sprintf("hello /%d", i) {
+			t.Fatalf("response not right, got %s", body)
+		}
+	}
+	abort := func(i int) {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("%s/%d", ts.URL, i), nil)
+		reader, err := tc.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("RoundTrip fail %v", err)
+		}
+		reader.Close()
+	}
+	connect := func(i int) {
+		conn, err := tc.ConnectTcp(strings.TrimPrefix(ts.URL, "http://"))
+		if err != nil {
+			t.Fatalf("ConnectTcp fail %v", err)
+		}
+		fmt.Fprintf(conn, "GET /%d HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n", i)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("read response fail %v", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		conn.Close()
+	}
+
+	settled := func(goroutines int) bool {
+		for wait := 0; wait < 100; wait++ {
+			if tc.streamCount() == 0 &&
+				server.httpWorker.(*MultiStreamWorker).Len() == 0 &&
+				server.tcpWorker.(*MultiStreamWorker).Len() == 0 &&
+				runtime.NumGoroutine() <= goroutines {
+				return true
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		return false
+	}
+
+	get(0)
+	connect(0)
+	settled(0)
+	baseline := runtime.NumGoroutine()
+
+	for i := 1; i <= 2000; i++ {
+		switch i % 10 {
+		case 0:
+			abort(i)
+		case 1:
+			connect(i)
+		default:
+			get(i)
+		}
+	}
+
+	//a few idle keep-alive connections may come and go
+	if !settled(baseline + 4) {
+		t.Errorf("streams leak: client %d, http workers %d, tcp workers %d, goroutines %d, baseline %d",
+			tc.streamCount(),
+			server.httpWorker.(*MultiStreamWorker).Len(),
+			server.tcpWorker.(*MultiStreamWorker).Len(),
+			runtime.NumGoroutine(), baseline)
+	}
+}
@@ -6,11 +6,16 @@ import (
 	"errors"
 	"github.com/vmihailenco/msgpack"
 	"io"
-	"log"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var ErrorStreamReset = errors.New("StreamReset")
+var ErrorFrameTooLarge = errors.New("FrameTooLarge")
+
 type MsgBuilder interface {
 	MakeMsg(mt uint16, ct uint16, data []byte, flags uint16) *Msg
 	MakeErrorMsg(err error, flags uint16) *Msg
@@ -23,15 +28,110 @@ type TunnelReader struct {
 	initMsg  *Msg
 	cache    Cache
 	isEof    bool
+	//ask the peer to send the full body again when a diff can't be applied,
+	//returns the channel the full body will arrive on
+	resend func() chan *Msg
+	//called when we stop reading recvChan for a resent body, nil drains it
+	release func()
+	stream  *StreamDiffDecoder
+	//abort the stream and tell the peer, see Reset
+	mu      sync.Mutex
+	cancel  func()
+	isReset bool
+	//closed when the stream is aborted, wakes up a blocked read
+	aborted <-chan struct{}
+	//a blocked read gives up when it passes, see TunnelConn
+	deadline *connDeadline
+	//closed by CloseRead
+	stopped <-chan struct{}
+	//largest payload the peer sends, inflated or joined, MAX_FRAME_SIZE if zero
+	maxFrameSize int
+	//the fragments joined so far, see joinFragments
+	joining *TcpData
 }
 
-func (c *TunnelReader) readMsgFromChannel() (*Msg, error) {
-	var msg *Msg
+func (c *TunnelReader) frameLimit() int {
+	if c.maxFrameSize <= 0 {
+		return MAX_FRAME_SIZE
+	}
+	return c.maxFrameSize
+}
+
+func (c *TunnelReader) nextMsg() (msg *Msg, err error) {
 	if c.initMsg != nil {
 		msg = c.initMsg
 		c.initMsg = nil
+		return
+	}
+	select {
+	case msg = <-c.recvChan:
+	case <-c.aborted:
+		err = ErrorStreamReset
+	case <-c.deadline.wait():
+		err = os.ErrDeadlineExceeded
+	case <-c.stopped:
+		err = errReadClosed
+	}
+	return
+}
+
+// drain reads and drops the rest of the stream
+func (c *TunnelReader) drain() {
+	for !c.isEof {
+		select {
+		case msg := <-c.recvChan:
+			c.isEof = msg == nil || msg.IsEndOfStream()
+		case <-c.aborted:
+			return
+		}
+	}
+}
+
+// joinFragments reads the rest of a payload the peer's scheduler split,
+// a join cut short by the deadline is resumed by the next read
+func (c *TunnelReader) joinFragments() (*Msg, error) {
+	for {
+		msg, err := c.nextMsg()
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil {
+			c.joining = nil
+			return nil, io.ErrUnexpectedEOF
+		}
+		if msg.GetMsgType() != TCP_DATA {
+			//ERROR or RESET in the middle
+			c.joining = nil
+			return msg, nil
+		}
+		body := c.joining
+		body.Payload = append(body.Payload, msg.Body.(*TcpData).GetPayload()...)
+		if len(body.Payload) > c.frameLimit() {
+			//every fragment gives back its credit, the window doesn't bound a join
+			c.joining = nil
+			c.Reset()
+			return nil, ErrorFrameTooLarge
+		}
+		if !msg.TestFlag(FLAG_MORE) {
+			c.joining = nil
+			return &Msg{Envelope: msg.Envelope, Header: msg.Header, Body: body}, nil
+		}
+	}
+}
+
+func (c *TunnelReader) readMsgFromChannel() (msg *Msg, err error) {
+	if c.joining != nil {
+		msg, err = c.joinFragments()
 	} else {
-		msg = <-c.recvChan
+		msg, err = c.nextMsg()
+		if err == nil && msg != nil && msg.GetMsgType() == TCP_DATA && msg.TestFlag(FLAG_MORE) {
+			first := msg.Body.(*TcpData)
+			c.joining = &TcpData{ContentType: first.ContentType, Payload: append([]byte(nil), first.Payload...)}
+			msg, err = c.joinFragments()
+		}
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	if msg == nil {
@@ -45,6 +145,7 @@ func (c *TunnelReader) readMsgFromChannel() (*Msg, error) {
 
 func (c *TunnelReader) readFromChannel(b []byte) (n int, err error) {
 	var msg *Msg
+	var payload []byte
 	for {
 		msg, err = c.readMsgFromChannel()
 		if msg == nil {
@@ -54,34 +155,33 @@ func (c *TunnelReader) readFromChannel(b []byte) (n int, err error) {
 			err = errors.New(msg.Body.String())
 			return
 		}
-		if err == io.EOF {
-			break
+		if msg.GetMsgType() == RESET {
+			err = ErrorStreamReset
+			return
 		}
-		if msg.GetMsgType() == TCP_DATA && len(msg.Body.(*TcpData).GetPayload()) > 0 {
-			break
+		if err != io.EOF && (msg.GetMsgType() != TCP_DATA || len(msg.Body.(*TcpData).GetPayload()) == 0) {
+			continue
 		}
-	}
-
-	var payload []byte
 
-	body := msg.Body.(*TcpData)
-	if body.ContentType == CT_CACHE_DIFF {
 		var cerr error
-		diff := new(DiffContent)
-		cerr = msgpack.Unmarshal(body.Payload, diff)
+		payload, cerr = c.decodePayload(msg.Body.(*TcpData))
+		if cerr == ErrorDecompressFail && c.resend != nil {
+			logger.Printf("[%x] diff can't be applied, ask for full body", msg.GetStreamId())
+			if err != io.EOF {
+				//the rest of a streamed diff is useless now
+				c.releaseChannel()
+			}
+			c.recvChan = c.resend()
+			c.resend = nil
+			continue
+		}
 		if cerr != nil {
 			return n, cerr
 		}
-		if len(diff.PatchTo) > 0 {
-			payload, cerr = decompress(c.cache, diff)
-			if cerr != nil {
-				return n, cerr
-			}
-		} else {
-			payload = diff.Diff
+		if len(payload) == 0 && err != io.EOF {
+			continue
 		}
-	} else {
-		payload = body.Payload
+		break
 	}
 
 	n = len(b)
@@ -94,6 +194,41 @@ func (c *TunnelReader) readFromChannel(b []byte) (n int, err error) {
 	return
 }
 
+func (c *TunnelReader) decodePayload(body *TcpData) (payload []byte, err error) {
+	payload, err = uncompressPayload(body.ContentType, body.Payload, c.frameLimit())
+	if err != nil {
+		return
+	}
+	ct := baseContentType(body.ContentType)
+	if ct == CT_STREAM_DIFF {
+		if c.stream == nil {
+			c.stream = NewStreamDiffDecoder(c.cache)
+		}
+		return c.stream.Decode(payload)
+	}
+	differ, ok := DIFFERS[ct]
+	if !ok {
+		return payload, nil
+	}
+	diff := new(DiffContent)
+	err = msgpack.Unmarshal(payload, diff)
+	if err != nil {
+		return
+	}
+	if len(diff.PatchTo) > 0 {
+		return decompress(c.cache, differ, diff)
+	}
+	return diff.Diff, nil
+}
+
+func drainChannel(ch chan *Msg) {
+	for msg := range ch {
+		if msg.IsEndOfStream() {
+			return
+		}
+	}
+}
+
 func (c *TunnelReader) readFromBuff(b []byte) (n int) {
 	n = len(b)
 	if len(c.recvBuff) < n {
@@ -107,11 +242,10 @@ func (c *TunnelReader) readFromBuff(b []byte) (n int) {
 }
 
 func (c *TunnelReader) Read(b []byte) (n int, err error) {
-	var cn int
 	n = c.readFromBuff(b)
-	if n < len(b) && !c.isEof {
-		cn, err = c.readFromChannel(b[n:])
-		n += cn
+	//don't wait for more when there is something to return
+	if n == 0 && len(b) > 0 && !c.isEof {
+		n, err = c.readFromChannel(b)
 		if err == io.EOF {
 			c.isEof = true
 			err = nil
@@ -123,7 +257,38 @@ func (c *TunnelReader) Read(b []byte) (n int, err error) {
 	return
 }
 
+func (c *TunnelReader) releaseChannel() {
+	if c.release == nil {
+		go drainChannel(c.recvChan)
+		return
+	}
+	c.release()
+	c.release = nil
+}
+
+// Reset aborts the stream, the peer stops sending at once.
+// It's safe to call while another goroutine is reading
+func (c *TunnelReader) Reset() error {
+	c.mu.Lock()
+	cancel := c.cancel
+	c.cancel, c.isReset = nil, true
+	c.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	return nil
+}
+
+func (c *TunnelReader) wasReset() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.isReset
+}
+
 func (c *TunnelReader) Close() error {
+	if !c.isEof {
+		c.Reset()
+	}
 	return nil
 }
 
@@ -136,42 +301,136 @@ type CachedTunnelReader struct {
 
 func (c *CachedTunnelReader) Read(b []byte) (n int, err error) {
 	n, err = c.TunnelReader.Read(b)
-	if n > 0 {
-		c.buff.Write(b[:n])
+	if err != nil && err != io.EOF {
+		//the body is broken
+		c.buff = nil
+	}
+	if n > 0 && c.buff != nil {
+		if c.buff.Len()+n > MAX_STREAM_CACHE_SIZE {
+			//too large to keep
+			c.buff = nil
+		} else {
+			c.buff.Write(b[:n])
+		}
 	}
 	return
 }
 
 func (c *CachedTunnelReader) Close() error {
-	c.cache.Set(c.cacheKey, c.buff.Bytes())
+	if c.buff != nil && !c.wasReset() {
+		c.cache.Set(c.cacheKey, c.buff.Bytes())
+	}
 	return c.TunnelReader.Close()
 }
 
 type TunnelWriter struct {
 	sendChan chan *Msg
 	msgMaker MsgBuilder
+	//CT_FLATE, CT_GZIP or CT_RAW for none
+	compression uint16
+	misses      int
+	//raw payloads larger than this are split, zero means no limit
+	maxFrameSize int
+	//credit the peer granted on this stream, nil without flow control
+	window *sendWindow
+	//scheduling hint for the msgs, see httpPriority
+	priority uint8
+	//a blocked write gives up when it passes, see TunnelConn
+	deadline *connDeadline
+}
+
+// newPeerWriter makes a writer using what the peer agreed on in the handshake
+func newPeerWriter(cm *CacheManager, pid string, sendChan chan *Msg, msgMaker MsgBuilder) *TunnelWriter {
+	return &TunnelWriter{
+		sendChan:     sendChan,
+		msgMaker:     msgMaker,
+		compression:  cm.GetPeerCompression(pid),
+		maxFrameSize: cm.GetPeerMaxFrameSize(pid),
+	}
 }
 
 func (c *TunnelWriter) Write(b []byte) (n int, err error) {
-	n = len(b)
-	data := make([]byte, n, n)
+	data := make([]byte, len(b), len(b))
 	copy(data, b)
-	c.sendChan <- c.msgMaker.MakeMsg(TCP_DATA, CT_RAW, data, 0)
-	return
+	return c.sendPayload(CT_RAW, data, 0)
 }
 
 func (c *TunnelWriter) Close() error {
-	c.sendChan <- c.msgMaker.MakeMsg(TCP_DATA, CT_RAW, []byte(""), FLAG_STREAM_END)
-	return nil
+	return c.send(CT_RAW, []byte(""), FLAG_STREAM_END)
+}
+
+func (c *TunnelWriter) send(ct uint16, payload []byte, flag uint16) error {
+	_, err := c.sendPayload(ct, payload, flag)
+	return err
+}
+
+// sendPayload sends TCP_DATA msgs, a raw payload is split by maxFrameSize and
+// by the credit the peer granted, other payloads wait for credit as a whole.
+// Returns the bytes of payload sent
+func (c *TunnelWriter) sendPayload(ct uint16, payload []byte, flag uint16) (written int, err error) {
+	for {
+		n := len(payload)
+		if ct == CT_RAW && c.maxFrameSize > 0 && n > c.maxFrameSize {
+			n = c.maxFrameSize
+		}
+		if c.window != nil && n > 0 {
+			n, err = c.window.take(n, ct == CT_RAW, c.deadline.wait())
+			if err != nil {
+				return
+			}
+		}
+		frameFlag := flag
+		if n < len(payload) {
+			frameFlag = flag &^ FLAG_STREAM_END
+		}
+		var sent int
+		sent, err = c.sendFrame(ct, payload[:n], frameFlag)
+		if c.window != nil && sent < n {
+			//the peer gives back credit for what it got on the wire
+			c.window.grant(n - sent)
+		}
+		if err != nil {
+			return
+		}
+		written += n
+		payload = payload[n:]
+		if len(payload) == 0 {
+			return written, nil
+		}
+	}
+}
+
+// the payload is compressed if it's worth it, returns the size sent
+func (c *TunnelWriter) sendFrame(ct uint16, payload []byte, flag uint16) (int, error) {
+	if c.compression != CT_RAW && c.misses < MAX_COMPRESS_MISS {
+		compressed, ok := compressPayload(c.compression, payload)
+		if ok {
+			ct, payload = ct|c.compression, compressed
+			c.misses = 0
+		} else if len(payload) >= MIN_COMPRESS_SIZE {
+			c.misses += 1
+		}
+	}
+	msg := c.msgMaker.MakeMsg(TCP_DATA, ct, payload, flag)
+	msg.priority = c.priority
+	select {
+	case c.sendChan <- msg:
+	case <-c.deadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	}
+	return len(payload), nil
 }
 
 type TimeoutWriter struct {
+	mu           sync.Mutex
 	bw           *bufio.Writer
 	timeout      time.Duration
 	flushPending bool
 }
 
 func (w *TimeoutWriter) Write(b []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 	n, err = w.bw.Write(b)
 	if err == nil && !w.flushPending {
 		w.flushPending = true
@@ -181,6 +440,8 @@ func (w *TimeoutWriter) Write(b []byte) (n int, err error) {
 }
 
 func (w *TimeoutWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 	w.flushPending = false
 	return w.bw.Flush()
 }
@@ -188,14 +449,18 @@ func (w *TimeoutWriter) Flush() error {
 func (w *TimeoutWriter) scheduleFlush() {
 	select {
 	case <-time.After(w.timeout):
+		w.mu.Lock()
 		if w.flushPending && w.bw.Buffered() > 0 {
 			w.bw.Flush()
 		}
+		w.flushPending = false
+		w.mu.Unlock()
 	}
-	w.flushPending = false
 }
 
-// A CachedTunnelWriter will cache the data, send them with one msg when close
+// A CachedTunnelWriter will cache the data, send them with one msg when close.
+// If the data is too large or too slow, it's streamed instead: as CT_STREAM_DIFF
+// frames if the compressor has a base version to diff against, or raw.
 type CachedTunnelWriter struct {
 	*TunnelWriter
 	comp         Compressor
@@ -204,6 +469,15 @@ type CachedTunnelWriter struct {
 	maxCacheSize int
 	maxDelay     time.Duration
 	deadline     time.Time
+	//keep the raw data sent as diff, so the peer can ask for it again
+	retain func(data []byte)
+	stream *StreamDiffEncoder
+	//peer can't decode CT_STREAM_DIFF
+	noStream bool
+	//false if the streamed data is too large to keep for cache
+	keepBody bool
+	//spent encoding the streamed data, for metrics
+	streamTime time.Duration
 }
 
 func (c *CachedTunnelWriter) Write(b []byte) (n int, err error) {
@@ -221,7 +495,8 @@ func (c *CachedTunnelWriter) Write(b []byte) (n int, err error) {
 	}
 
 	if c.noCache {
-		return c.TunnelWriter.Write(b)
+		c.keep(b)
+		return c.writeStream(b)
 	} else {
 		return c.buf.Write(b)
 	}
@@ -229,14 +504,50 @@ func (c *CachedTunnelWriter) Write(b []byte) (n int, err error) {
 
 func (c *CachedTunnelWriter) cancelCache() (err error) {
 	c.noCache = true
-	_, err = c.TunnelWriter.Write(c.buf.Bytes())
+	if sc, ok := c.comp.(StreamCompressor); ok && !c.noStream {
+		c.stream = sc.StreamEncoder()
+	}
+	c.keepBody = c.buf.Len() <= MAX_STREAM_CACHE_SIZE
+	_, err = c.writeStream(c.buf.Bytes())
+	return
+}
+
+func (c *CachedTunnelWriter) keep(b []byte) {
+	if !c.keepBody {
+		return
+	}
+	if c.buf.Len()+len(b) > MAX_STREAM_CACHE_SIZE {
+		c.keepBody = false
+		c.buf = new(bytes.Buffer)
+		return
+	}
+	c.buf.Write(b)
+}
+
+func (c *CachedTunnelWriter) writeStream(b []byte) (n int, err error) {
+	if c.stream == nil {
+		metricCompressBytes.add(len(b), CT_NAMES[CT_RAW], "body")
+		metricCompressBytes.add(len(b), CT_NAMES[CT_RAW], "sent")
+		return c.TunnelWriter.Write(b)
+	}
+	metricCompressBytes.add(len(b), CT_NAMES[CT_STREAM_DIFF], "body")
+	start := time.Now()
+	n, err = c.stream.Write(b)
+	c.streamTime += time.Since(start)
+	if err == nil && c.stream.Pending() {
+		err = c.sendStream(c.stream.Flush(), 0)
+	}
 	return
 }
 
+func (c *CachedTunnelWriter) sendStream(frame []byte, flag uint16) error {
+	metricCompressBytes.add(len(frame), CT_NAMES[CT_STREAM_DIFF], "sent")
+	return c.TunnelWriter.send(CT_STREAM_DIFF, frame, flag)
+}
+
 func (c *CachedTunnelWriter) Close() (err error) {
 	if c.noCache {
-		c.TunnelWriter.sendChan <- c.msgMaker.MakeMsg(TCP_DATA, CT_RAW, []byte(""), FLAG_STREAM_END)
-		return
+		return c.closeStream()
 	}
 	_, err = c.comp.Write(c.buf.Bytes())
 	if err != nil {
@@ -246,8 +557,35 @@ func (c *CachedTunnelWriter) Close() (err error) {
 	if err != nil {
 		return
 	}
-	c.TunnelWriter.sendChan <- c.msgMaker.MakeMsg(TCP_DATA, CT_CACHE_DIFF, c.comp.Bytes(), FLAG_STREAM_END)
-	return
+	if c.maxFrameSize > 0 && len(c.comp.Bytes()) > c.maxFrameSize {
+		//the peer would refuse the joined frame, a raw body is split
+		return c.TunnelWriter.send(CT_RAW, c.buf.Bytes(), FLAG_STREAM_END)
+	}
+	if c.retain != nil && c.comp.Hit() {
+		c.retain(c.buf.Bytes())
+	}
+	return c.TunnelWriter.send(c.comp.ContentType(), c.comp.Bytes(), FLAG_STREAM_END)
+}
+
+func (c *CachedTunnelWriter) closeStream() (err error) {
+	var body []byte
+	if c.keepBody {
+		body = c.buf.Bytes()
+		if sc, ok := c.comp.(StreamCompressor); ok {
+			sc.Store(body)
+		}
+	}
+	if c.stream == nil {
+		return c.TunnelWriter.send(CT_RAW, []byte(""), FLAG_STREAM_END)
+	}
+	//empty body tells the peer there is nothing to resend
+	if c.retain != nil {
+		c.retain(body)
+	}
+	start := time.Now()
+	frame := c.stream.Close()
+	metricDiffSeconds.observe((c.streamTime + time.Since(start)).Seconds(), CT_NAMES[CT_STREAM_DIFF])
+	return c.sendStream(frame, FLAG_STREAM_END)
 }
 
 func NewCachedTunnelWriter(w *TunnelWriter, comp Compressor) *CachedTunnelWriter {
@@ -255,50 +593,246 @@ func NewCachedTunnelWriter(w *TunnelWriter, comp Compressor) *CachedTunnelWriter
 		TunnelWriter: w,
 		comp:         comp,
 		maxCacheSize: MAX_CACHE_SIZE,
-		maxDelay:     2 * time.Second, //if we can't receive all the data in 2 seconds , stream it
+		maxDelay:     MAX_DELAY,
 		buf:          new(bytes.Buffer),
 	}
 	return cw
 }
 
-// TunnelConn
+// TunnelConn is a stream of the tunnel as a net.Conn
 type TunnelConn struct {
-	io.Reader
-	io.WriteCloser
+	reader *TunnelReader
+	writer *TunnelWriter
+	local  net.Addr
+	remote net.Addr
+
+	readMu       sync.Mutex
+	readDeadline *connDeadline
+	readStop     chan struct{}
+	readStopOnce sync.Once
+	//set once Read returned io.EOF
+	readEof       int32
+	writeMu       sync.Mutex
+	writeDeadline *connDeadline
+	writeClosed   bool
 }
 
-func (c *TunnelConn) LocalAddr() net.Addr {
+func newTunnelConn(reader *TunnelReader, writer *TunnelWriter, local net.Addr, remote net.Addr) *TunnelConn {
+	c := &TunnelConn{
+		reader:        reader,
+		writer:        writer,
+		local:         local,
+		remote:        remote,
+		readDeadline:  newConnDeadline(),
+		readStop:      make(chan struct{}),
+		writeDeadline: newConnDeadline(),
+	}
+	reader.deadline, reader.stopped = c.readDeadline, c.readStop
+	writer.deadline = c.writeDeadline
+	return c
+}
+
+var errReadClosed = errors.New("ReadClosed")
+
+func (c *TunnelConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if isClosedChan(c.readStop) {
+		return 0, io.EOF
+	}
+	if isClosedChan(c.readDeadline.wait()) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	n, err := c.reader.Read(b)
+	if err == errReadClosed {
+		err = io.EOF
+	} else if err == io.EOF {
+		atomic.StoreInt32(&c.readEof, 1)
+	}
+	return n, err
+}
+
+func (c *TunnelConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.writeClosed {
+		return 0, io.ErrClosedPipe
+	}
+	if isClosedChan(c.writeDeadline.wait()) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return c.writer.Write(b)
+}
+
+// CloseWrite ends our side of the stream, we can still read what the peer sends
+func (c *TunnelConn) CloseWrite() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.writeClosed {
+		return nil
+	}
+	c.writeClosed = true
+	return c.writer.Close()
+}
+
+// CloseRead stops reading, the rest the peer sends is dropped
+func (c *TunnelConn) CloseRead() error {
+	c.readStopOnce.Do(func() {
+		close(c.readStop)
+		go func() {
+			c.readMu.Lock()
+			c.reader.drain()
+			c.readMu.Unlock()
+		}()
+	})
 	return nil
 }
 
+// Close aborts the stream if the peer is still sending, and ends our side
+func (c *TunnelConn) Close() error {
+	if atomic.LoadInt32(&c.readEof) == 0 {
+		c.Reset()
+	}
+	c.CloseRead()
+	return c.CloseWrite()
+}
+
+// a stream which can be aborted, see TunnelReader.Reset
+type resetter interface {
+	Reset() error
+}
+
+// Reset aborts both directions of the stream
+func (c *TunnelConn) Reset() error {
+	return c.reader.Reset()
+}
+
+// LocalAddr is the tunnel endpoint on the client, on the server
+// it's where the server connects to the target from
+func (c *TunnelConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr is the address the server connected to on the client,
+// and the client on the server
 func (c *TunnelConn) RemoteAddr() net.Addr {
-	return nil
+	return c.remote
 }
 
 func (c *TunnelConn) SetDeadline(t time.Time) error {
-	//c.readTimeout = t
-	//c.writeTimeout = t
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
 	return nil
 }
 
 func (c *TunnelConn) SetReadDeadline(t time.Time) error {
-	//c.readTimeout = t
+	c.readDeadline.set(t)
 	return nil
 }
 
 func (c *TunnelConn) SetWriteDeadline(t time.Time) error {
-	//c.writeTimeout = t
+	c.writeDeadline.set(t)
 	return nil
 }
 
+// tunnelAddr is an address only the tunnel knows, like a client id
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string {
+	return "dtunnel"
+}
+
+func (a tunnelAddr) String() string {
+	return string(a)
+}
+
+// parseAddr makes a net.TCPAddr of an ip:port, a tunnelAddr of anything else
+func parseAddr(addr string) net.Addr {
+	if host, _, err := net.SplitHostPort(addr); err == nil && net.ParseIP(host) != nil {
+		if tcpAddr, err := net.ResolveTCPAddr("tcp", addr); err == nil {
+			return tcpAddr
+		}
+	}
+	return tunnelAddr(addr)
+}
+
+// connDeadline is a channel closed once the deadline passes
+type connDeadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func newConnDeadline() *connDeadline {
+	return &connDeadline{cancel: make(chan struct{})}
+}
+
+// set the deadline, the zero time means none
+func (d *connDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		//the timer fired, wait for it to close cancel
+		<-d.cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() || time.Until(t) > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		if !t.IsZero() {
+			cancel := d.cancel
+			d.timer = time.AfterFunc(time.Until(t), func() {
+				close(cancel)
+			})
+		}
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel closed when the deadline passes, nil for no deadline
+func (d *connDeadline) wait() chan struct{} {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
 func copyAndClose(w net.Conn, r io.Reader, finish chan bool) {
 	connOk := true
 	if _, err := io.Copy(w, r); err != nil {
 		connOk = false
-		log.Printf("Error copying to client %s %s", err, connOk)
+		logger.Printf("Error copying to client %s %s", err, connOk)
+		//one end is broken, abort the tunnel stream instead of waiting for it
+		for _, c := range []interface{}{w, r} {
+			if tc, ok := c.(*TunnelConn); ok {
+				tc.Reset()
+			}
+		}
 	}
-	if err := w.Close(); err != nil && connOk {
-		log.Printf("Error closing %s", err)
+	//the other direction may still be going
+	closeWrite := w.Close
+	if cw, ok := w.(closeWriter); ok {
+		closeWrite = cw.CloseWrite
+	}
+	if err := closeWrite(); err != nil && connOk {
+		logger.Printf("Error closing %s", err)
 	}
 	finish <- true
 }
@@ -310,4 +844,11 @@ func piping(src, dst net.Conn) {
 	<-ch
 	<-ch
 	//make both direction is finished
+	src.Close()
+	dst.Close()
+}
+
+// a conn which can end its side only, like TunnelConn and net.TCPConn
+type closeWriter interface {
+	CloseWrite() error
 }
@@ -3,7 +3,9 @@ package dtunnel
 import (
 	"bytes"
 	"io"
+	"net"
 	"testing"
+	"time"
 )
 
 func TestTunnelWriter(t *testing.T) {
@@ -156,3 +158,129 @@ func TestTunnelReaderBigMessage(t *testing.T) {
 	}
 
 }
+
+func makeFragment(sid UID, payload []byte, flag uint16) *Msg {
+	return &Msg{
+		Envelope: [][]byte{[]byte("")},
+		Header:   &Header{MsgType: TCP_DATA, StreamId: sid, Version: VERSION_1, Flag: FLAG_TCP | flag},
+		Body:     &TcpData{ContentType: CT_RAW, Payload: payload},
+	}
+}
+
+func TestTunnelReaderJoinLimit(t *testing.T) {
+	sid := MakeUID()
+	readChan := make(chan *Msg, 10)
+	reset := false
+	reader := &TunnelReader{recvChan: readChan, maxFrameSize: 10, cancel: func() { reset = true }}
+	readChan <- makeFragment(sid, []byte("hello"), FLAG_STREAM_BEGIN|FLAG_MORE)
+	readChan <- makeFragment(sid, []byte("world"), FLAG_MORE)
+	readChan <- makeFragment(sid, []byte("again"), FLAG_MORE)
+
+	_, err := reader.Read(make([]byte, 64))
+	if err != ErrorFrameTooLarge {
+		t.Fatalf("read past the frame limit should fail, got %v", err)
+	}
+	if !reset {
+		t.Errorf("the stream should be reset")
+	}
+}
+
+func makeTestConn() (*TunnelConn, chan *Msg, chan *Msg) {
+	recvChan, sendChan := make(chan *Msg, 10), make(chan *Msg, 10)
+	reader := &TunnelReader{recvChan: recvChan}
+	writer := &TunnelWriter{
+		sendChan: sendChan,
+		msgMaker: &msgBuilder{defaultFlags: FLAG_TCP},
+		window:   newSendWindow().open(5),
+	}
+	return newTunnelConn(reader, writer, tunnelAddr("local"), tunnelAddr("remote")), recvChan, sendChan
+}
+
+func TestTunnelConnDeadline(t *testing.T) {
+	conn, recvChan, _ := makeTestConn()
+	b := make([]byte, 10)
+
+	conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err := conn.Read(b)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("read should time out, got %v", err)
+	}
+	//still usable once the deadline is moved
+	conn.SetReadDeadline(time.Time{})
+	recvChan <- makeReqMsg(MakeUID(), TCP_DATA, CT_RAW, []byte("hello"), FLAG_TCP)
+	if n, err := conn.Read(b); err != nil || string(b[:n]) != "hello" {
+		t.Errorf("read after deadline fail, got %q %v", b[:n], err)
+	}
+
+	//a write blocked on credit gives up too
+	conn.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	n, err := conn.Write([]byte("hello world"))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() || n != 5 {
+		t.Errorf("write should time out after 5 bytes, got %d %v", n, err)
+	}
+	conn.SetWriteDeadline(time.Now().Add(-time.Second))
+	if _, err := conn.Write([]byte("x")); err == nil {
+		t.Error("write after deadline should fail")
+	}
+
+	if conn.LocalAddr().String() != "local" || conn.RemoteAddr().String() != "remote" {
+		t.Errorf("addresses not right, got %s %s", conn.LocalAddr(), conn.RemoteAddr())
+	}
+}
+
+func TestTunnelConnDeadlineMidJoin(t *testing.T) {
+	conn, recvChan, _ := makeTestConn()
+	sid := MakeUID()
+	b := make([]byte, 64)
+
+	recvChan <- makeFragment(sid, []byte("hello "), FLAG_STREAM_BEGIN|FLAG_MORE)
+	conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err := conn.Read(b)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("read should time out between fragments, got %v", err)
+	}
+	//the join goes on from where it stopped
+	conn.SetReadDeadline(time.Time{})
+	recvChan <- makeFragment(sid, []byte("world"), 0)
+	if n, err := conn.Read(b); err != nil || string(b[:n]) != "hello world" {
+		t.Errorf("read after deadline should finish the join, got %q %v", b[:n], err)
+	}
+}
+
+func TestTunnelConnHalfClose(t *testing.T) {
+	conn, recvChan, sendChan := makeTestConn()
+	conn.CloseWrite()
+	if msg := <-sendChan; !msg.IsEndOfStream() {
+		t.Errorf("CloseWrite should end the stream, got %s", msg)
+	}
+	if _, err := conn.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Errorf("write after CloseWrite should fail, got %v", err)
+	}
+
+	//the peer can still send
+	recvChan <- makeReqMsg(MakeUID(), TCP_DATA, CT_RAW, []byte("hello"), FLAG_TCP|FLAG_STREAM_END)
+	b := make([]byte, 10)
+	if n, _ := conn.Read(b); string(b[:n]) != "hello" {
+		t.Errorf("read after CloseWrite fail, got %q", b[:n])
+	}
+
+	conn, recvChan, _ = makeTestConn()
+	conn.CloseRead()
+	if _, err := conn.Read(b); err != io.EOF {
+		t.Errorf("read after CloseRead should be EOF, got %v", err)
+	}
+	//the rest is dropped, not left in the channel
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 20; i++ {
+			recvChan <- makeReqMsg(MakeUID(), TCP_DATA, CT_RAW, []byte("hello"), FLAG_TCP)
+		}
+		recvChan <- makeReqMsg(MakeUID(), TCP_DATA, CT_RAW, []byte(""), FLAG_TCP|FLAG_STREAM_END)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("stream should be drained after CloseRead")
+	}
+}
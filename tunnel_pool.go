@@ -0,0 +1,404 @@
+package dtunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//how a TunnelPool spreads new streams, see SetBalance
+const (
+	BALANCE_ROUND_ROBIN   = "round-robin"
+	BALANCE_LEAST_STREAMS = "least-streams"
+	//http streams go to the server by their cache key, so the server
+	//which knows our cached version handles the next fetch of an url.
+	//Others go round robin
+	BALANCE_CACHE_KEY = "cache-key"
+)
+
+var (
+	ErrorNoBackend     = errors.New("NoBackend")
+	ErrorBackendExists = errors.New("BackendExists")
+)
+
+// TunnelPool is a client of several tunnel servers. Each new stream goes
+// to a healthy one and stays there, each server has its own cache state
+type TunnelPool struct {
+	mu      sync.RWMutex
+	clients []*TunnelClient
+	ring    *hashRing
+	balance string
+	next    uint32
+
+	//to make clients of backends added later
+	serverPub   string
+	pub         string
+	secret      string
+	cache       Cache
+	id          string
+	heartbeat   time.Duration
+	timeout     time.Duration
+	gracePeriod time.Duration
+	//public to local address of the services exposed, see Expose
+	services map[string]string
+
+	running bool
+	//the clients run till it's done
+	ctx       context.Context
+	live      int
+	wg        sync.WaitGroup
+	stopped   chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewTunnelPool(backends []string) (*TunnelPool, error) {
+	return NewTunnelPoolKeyPair(backends, "", "", "")
+}
+
+func NewTunnelPoolKeyPair(backends []string, server_pub string, pub string, secret string) (*TunnelPool, error) {
+	if len(backends) == 0 {
+		return nil, ErrorNoBackend
+	}
+	p := &TunnelPool{
+		ring:      newHashRing(),
+		balance:   BALANCE_ROUND_ROBIN,
+		serverPub: server_pub,
+		pub:       pub,
+		secret:    secret,
+		services:  make(map[string]string),
+		stopped:   make(chan error, 1),
+		done:      make(chan struct{}),
+	}
+	for _, backend := range backends {
+		if err := p.AddBackend(backend); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// AddBackend starts using another server, only the cache keys
+// the new one takes from the others move to it
+func (p *TunnelPool) AddBackend(backend string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.find(backend) != nil {
+		return ErrorBackendExists
+	}
+	c, err := NewTunnelClientKeyPair(backend, p.serverPub, p.pub, p.secret)
+	if err != nil {
+		return err
+	}
+	if p.cache != nil {
+		//the client took over the eviction callback
+		c.SetCache(p.cache)
+		p.notifyEvict()
+	}
+	if p.id != "" {
+		c.SetClientId(p.id)
+	}
+	if p.heartbeat > 0 {
+		c.SetHeartbeat(p.heartbeat, p.timeout)
+	}
+	if p.gracePeriod > 0 {
+		c.SetGracePeriod(p.gracePeriod)
+	}
+	p.clients = append(p.clients, c)
+	p.ring.Add(backend)
+	if p.running {
+		p.start(c)
+		for public, local := range p.services {
+			go p.expose(c, public, local)
+		}
+	}
+	logger.Printf("[pool]add backend %s", backend)
+	return nil
+}
+
+// RemoveBackend stops using a server, its streams fail and its cache keys
+// move to the others
+func (p *TunnelPool) RemoveBackend(backend string) error {
+	p.mu.Lock()
+	c := p.find(backend)
+	if c == nil {
+		p.mu.Unlock()
+		return fmt.Errorf("unknown backend %s", backend)
+	}
+	clients := make([]*TunnelClient, 0, len(p.clients))
+	for _, other := range p.clients {
+		if other != c {
+			clients = append(clients, other)
+		}
+	}
+	p.clients = clients
+	p.ring.Remove(backend)
+	p.mu.Unlock()
+	logger.Printf("[pool]remove backend %s", backend)
+	return c.Close()
+}
+
+func (p *TunnelPool) find(backend string) *TunnelClient {
+	for _, c := range p.clients {
+		if c.endpoint == backend {
+			return c
+		}
+	}
+	return nil
+}
+
+// SetCache share the local cache among all servers, should be called before Run
+func (p *TunnelPool) SetCache(cache Cache) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cache = cache
+	for _, c := range p.clients {
+		c.SetCache(cache)
+	}
+	p.notifyEvict()
+}
+
+// notifyEvict takes the eviction callback of the shared cache back from the clients
+func (p *TunnelPool) notifyEvict() {
+	//the cache tells one of us about evictions, every server has to know
+	if n, ok := p.cache.(EvictNotifier); ok {
+		n.NotifyEvict(func(key []byte) {
+			p.mu.RLock()
+			clients := p.clients
+			p.mu.RUnlock()
+			for _, c := range clients {
+				c.cm.evicted(key)
+			}
+		})
+	}
+}
+
+// SetClientId see TunnelClient.SetClientId
+func (p *TunnelPool) SetClientId(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.id = id
+	for _, c := range p.clients {
+		c.SetClientId(id)
+	}
+}
+
+// SetHeartbeat see TunnelClient.SetHeartbeat, it's also how fast
+// a dead server is found
+func (p *TunnelPool) SetHeartbeat(interval time.Duration, timeout time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.heartbeat, p.timeout = interval, timeout
+	for _, c := range p.clients {
+		c.SetHeartbeat(interval, timeout)
+	}
+}
+
+// SetGracePeriod see TunnelClient.SetGracePeriod
+func (p *TunnelPool) SetGracePeriod(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.gracePeriod = d
+	for _, c := range p.clients {
+		c.SetGracePeriod(d)
+	}
+}
+
+// SetBalance set how new streams are spread, should be called before Run
+func (p *TunnelPool) SetBalance(balance string) error {
+	switch balance {
+	case BALANCE_ROUND_ROBIN, BALANCE_LEAST_STREAMS, BALANCE_CACHE_KEY:
+		p.balance = balance
+		return nil
+	}
+	return fmt.Errorf("unknown balance %s", balance)
+}
+
+// Run all clients, returns once Close is called or all of them failed
+func (p *TunnelPool) Run() error {
+	return p.RunContext(context.Background())
+}
+
+// RunContext is Run till ctx is done, then it returns once
+// every client has shut down, see TunnelClient.RunContext
+func (p *TunnelPool) RunContext(ctx context.Context) error {
+	p.mu.Lock()
+	p.running = true
+	p.ctx = ctx
+	for _, c := range p.clients {
+		p.start(c)
+	}
+	p.mu.Unlock()
+	select {
+	case err := <-p.stopped:
+		return err
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		p.wg.Wait()
+		return nil
+	}
+}
+
+// start runs c, p.mu should be held
+func (p *TunnelPool) start(c *TunnelClient) {
+	p.live += 1
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		err := c.RunContext(p.ctx)
+		if err != nil {
+			logger.Printf("[pool]backend %s stopped: %s", c.endpoint, err)
+		}
+		p.mu.Lock()
+		p.live -= 1
+		last := p.live == 0
+		p.mu.Unlock()
+		if last && err != nil {
+			select {
+			case p.stopped <- err:
+			default:
+			}
+		}
+	}()
+}
+
+// Expose a local service through every server, returns where they listen.
+// Servers added later expose it too. Should be called after Run
+func (p *TunnelPool) Expose(public string, local string) ([]string, error) {
+	p.mu.Lock()
+	p.services[public] = local
+	clients := p.clients
+	p.mu.Unlock()
+	addrs := make([]string, 0, len(clients))
+	for _, c := range clients {
+		addr, err := c.Expose(public, local)
+		if err != nil {
+			return addrs, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+func (p *TunnelPool) expose(c *TunnelClient, public string, local string) {
+	if _, err := c.Expose(public, local); err != nil {
+		logger.Printf("[pool]fail to expose %s on %s: %s", local, c.endpoint, err)
+	}
+}
+
+// candidates for a new stream, the healthy clients. Before any server
+// answered it's those which didn't reject us
+func (p *TunnelPool) candidates() ([]*TunnelClient, error) {
+	p.mu.RLock()
+	clients := p.clients
+	p.mu.RUnlock()
+	if len(clients) == 0 {
+		return nil, ErrorNoBackend
+	}
+	candidates := make([]*TunnelClient, 0, len(clients))
+	for _, c := range clients {
+		if c.Healthy() {
+			candidates = append(candidates, c)
+		}
+	}
+	if len(candidates) == 0 {
+		for _, c := range clients {
+			if c.Err() == nil {
+				candidates = append(candidates, c)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, clients[0].Err()
+	}
+	return candidates, nil
+}
+
+// pick the client for a new stream
+func (p *TunnelPool) pick() (*TunnelClient, error) {
+	candidates, err := p.candidates()
+	if err != nil {
+		return nil, err
+	}
+	if p.balance == BALANCE_LEAST_STREAMS {
+		best := candidates[0]
+		for _, c := range candidates[1:] {
+			if c.streamCount() < best.streamCount() {
+				best = c
+			}
+		}
+		return best, nil
+	}
+	n := atomic.AddUint32(&p.next, 1)
+	return candidates[int(n)%len(candidates)], nil
+}
+
+// pickByKey the client on the ring for key, passing over the unhealthy ones
+func (p *TunnelPool) pickByKey(key []byte) (*TunnelClient, error) {
+	candidates, err := p.candidates()
+	if err != nil {
+		return nil, err
+	}
+	byEndpoint := make(map[string]*TunnelClient, len(candidates))
+	for _, c := range candidates {
+		byEndpoint[c.endpoint] = c
+	}
+	p.mu.RLock()
+	backend := p.ring.Get(key, func(node string) bool {
+		return byEndpoint[node] != nil
+	})
+	p.mu.RUnlock()
+	if c, ok := byEndpoint[backend]; ok {
+		return c, nil
+	}
+	return p.pick()
+}
+
+func (p *TunnelPool) ConnectTcp(host string) (net.Conn, error) {
+	c, err := p.pick()
+	if err != nil {
+		return nil, err
+	}
+	return c.ConnectTcp(host)
+}
+
+func (p *TunnelPool) ListenUdp() (net.PacketConn, error) {
+	c, err := p.pick()
+	if err != nil {
+		return nil, err
+	}
+	return c.ListenUdp()
+}
+
+func (p *TunnelPool) RoundTrip(r *http.Request) (io.ReadCloser, error) {
+	var c *TunnelClient
+	var err error
+	if p.balance == BALANCE_CACHE_KEY {
+		c, err = p.pickByKey(makeCacheKey(r))
+	} else {
+		c, err = p.pick()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.RoundTrip(r)
+}
+
+func (p *TunnelPool) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.done)
+		p.mu.RLock()
+		defer p.mu.RUnlock()
+		for _, c := range p.clients {
+			c.Close()
+		}
+	})
+	return nil
+}
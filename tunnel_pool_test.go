@@ -0,0 +1,201 @@
+package dtunnel
+
+import (
+	"fmt"
+	zmq "github.com/pebbe/zmq4"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// a server which does the handshake and answers pings until it dies
+func fakeBackend(addr string, dead chan struct{}) {
+	socket, _ := zmq.NewSocket(zmq.ROUTER)
+	defer socket.Close()
+	socket.Bind(addr)
+	socket.SetRcvtimeo(10 * time.Millisecond)
+	for {
+		select {
+		case <-dead:
+			return
+		default:
+		}
+		frames, err := socket.RecvMessageBytes(0)
+		if err != nil {
+			continue
+		}
+		msg, _ := fromFrames(frames)
+		switch msg.GetMsgType() {
+		case HELLO:
+			frames, _ = toFrames(makeHelloMsg(HELLO_REP, msg.Envelope, makeHelloData("")))
+		case PING:
+			frames, _ = toFrames(NewMsgBuilderFromMsg(msg).MakeMsg(PONG, CT_RAW, []byte(""), 0))
+		default:
+			continue
+		}
+		socket.SendMessage(frames)
+	}
+}
+
+func waitHealthy(t *testing.T, p *TunnelPool) {
+	for wait := 0; wait < 100; wait++ {
+		healthy := true
+		for _, c := range p.clients {
+			healthy = healthy && c.Healthy()
+		}
+		if healthy {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("backends should be healthy")
+}
+
+func TestTunnelPoolFailover(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s", r.URL.Path)
+	}))
+	defer ts.Close()
+
+	server, _ := NewTunnelServer("inproc://test-pool-alive")
+	go server.Run()
+	dead := make(chan struct{})
+	go fakeBackend("inproc://test-pool-dead", dead)
+
+	pool, _ := NewTunnelPool([]string{"inproc://test-pool-alive", "inproc://test-pool-dead"})
+	pool.SetHeartbeat(50*time.Millisecond, time.Second)
+	go pool.Run()
+	defer pool.Close()
+	waitHealthy(t, pool)
+
+	picked := make(map[*TunnelClient]bool)
+	for i := 0; i < 4; i++ {
+		c, _ := pool.pick()
+		picked[c] = true
+	}
+	if len(picked) != 2 {
+		t.Errorf("streams should be spread over both backends, got %d", len(picked))
+	}
+
+	close(dead)
+	for wait := 0; wait < 100 && pool.clients[1].Healthy(); wait++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	proxy := NewHttpProxyServer(pool)
+	for i := 0; i < 4; i++ {
+		done := make(chan string, 1)
+		go func() {
+			req, _ := http.NewRequest("GET", fmt.Sprintf("%s/%d", ts.URL, i), nil)
+			rec := httptest.NewRecorder()
+			proxy.ServeHTTP(rec, req)
+			done <- rec.Body.String()
+		}()
+		select {
+		case body := <-done:
+			if body != fmt.Sprintf("hello /%d", i) {
+				t.Errorf("response not right, got %s", body)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("streams should fail over to the live backend")
+		}
+	}
+}
+
+func TestTunnelPoolLeastStreams(t *testing.T) {
+	dead := make(chan struct{})
+	defer close(dead)
+	go fakeBackend("inproc://test-pool-least-a", dead)
+	go fakeBackend("inproc://test-pool-least-b", dead)
+
+	pool, _ := NewTunnelPool([]string{"inproc://test-pool-least-a", "inproc://test-pool-least-b"})
+	if err := pool.SetBalance("random"); err == nil {
+		t.Error("unknown balance should fail")
+	}
+	pool.SetBalance(BALANCE_LEAST_STREAMS)
+	pool.SetHeartbeat(50*time.Millisecond, time.Second)
+	go pool.Run()
+	defer pool.Close()
+	waitHealthy(t, pool)
+
+	busy := pool.clients[0]
+	busy.addStream(MakeUID(), FLAG_TCP)
+	for i := 0; i < 3; i++ {
+		if c, _ := pool.pick(); c == busy {
+			t.Error("should pick the backend with less streams")
+		}
+	}
+	//closed again by defer
+	pool.Close()
+}
+
+func TestTunnelPoolCacheKey(t *testing.T) {
+	dead := make(chan struct{})
+	defer close(dead)
+	backends := []string{"inproc://test-pool-key-a", "inproc://test-pool-key-b", "inproc://test-pool-key-c"}
+	for _, backend := range backends {
+		go fakeBackend(backend, dead)
+	}
+	pool, _ := NewTunnelPool(backends[:2])
+	pool.SetBalance(BALANCE_CACHE_KEY)
+	pool.SetHeartbeat(50*time.Millisecond, time.Second)
+	cache := NewLRUCache(0, 1)
+	pool.SetCache(cache)
+	go pool.Run()
+	defer pool.Close()
+	waitHealthy(t, pool)
+
+	keys := make([][]byte, 20)
+	owners := make(map[string]*TunnelClient)
+	for i := range keys {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://www.example.com/%d", i), nil)
+		keys[i] = makeCacheKey(req)
+		c, _ := pool.pickByKey(keys[i])
+		owners[string(keys[i])] = c
+		if again, _ := pool.pickByKey(keys[i]); again != c {
+			t.Errorf("same url should go to the same backend")
+		}
+	}
+
+	//an added backend only takes keys from the others
+	if err := pool.AddBackend(backends[2]); err != nil {
+		t.Fatalf("AddBackend fail %v", err)
+	}
+	if err := pool.AddBackend(backends[2]); err != ErrorBackendExists {
+		t.Errorf("expect BackendExists, got %v", err)
+	}
+	waitHealthy(t, pool)
+	added := pool.clients[2]
+	moved := 0
+	for _, key := range keys {
+		c, _ := pool.pickByKey(key)
+		if c != owners[string(key)] {
+			moved += 1
+			if c != added {
+				t.Errorf("key moved to an old backend")
+			}
+		}
+	}
+	if moved == 0 {
+		t.Error("added backend should take some keys")
+	}
+
+	//every server still hears about evictions
+	notified := 0
+	for _, c := range pool.clients {
+		c.cm.OnEvict = func(key []byte) { notified += 1 }
+	}
+	cache.Set([]byte("a"), []byte("1"))
+	cache.Set([]byte("b"), []byte("2"))
+	if notified != len(backends) {
+		t.Errorf("eviction should reach %d backends, got %d", len(backends), notified)
+	}
+
+	//the keys of a removed one go back to the others
+	pool.RemoveBackend(backends[2])
+	for _, key := range keys {
+		if c, _ := pool.pickByKey(key); c != owners[string(key)] {
+			t.Errorf("key should go back to its old backend")
+		}
+	}
+}
@@ -1,84 +1,259 @@
 package dtunnel
 
 import (
+	"context"
 	zmq "github.com/pebbe/zmq4"
-	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	//how long the recv loop waits for a msg before it checks if the server is closed
+	SERVER_RECV_TIMEOUT = 100 * time.Millisecond
 )
 
 type TunnelServer struct {
-	socket      *zmq.Socket
+	socket *zmq.Socket
+	//the recv loop closes the socket once done is closed, not Close,
+	//as zmq sockets are not thread safe
+	sockMu     sync.Mutex
+	sockClosed bool
+	running    bool
+	//closed once RunContext is done with the socket
+	stopped     chan struct{}
 	repChan     chan *Msg
 	httpWorker  Worker
 	tcpWorker   Worker
-	cacheWorker Worker
+	udpWorker   Worker
+	cacheWorker *CacheWorker
+	//what WithDialer and WithTransport set, SetACL wraps them
+	dial          dialFunc
+	transport     http.RoundTripper
+	bestEffortACL bool
+	//to tune the stream workers, see SetHttpConfig and SetACL
+	httpFactory *HttpWorkerFactory
+	tcpFactory  *TcpWorkerFactory
+	udpFactory  *UdpWorkerFactory
+	cm          *CacheManager
+	sched       *scheduler
+	reverse     *reverseServer
+	hooks       *Hooks
+	gracePeriod time.Duration
+	//address we are bound to, to label metrics
+	endpoint string
+	//set once RunContext is shutting down
+	draining  int32
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 func NewTunnelServer(bind string) (*TunnelServer, error) {
-	cm := makeCacheManager()
-	socket, _ := zmq.NewSocket(zmq.ROUTER)
-	socket.Bind(bind)
-	repChan := make(chan *Msg, 10)
-	return &TunnelServer{
-		socket, repChan,
-		NewMultiStreamHttpWorker(cm),
-		NewMultiStreamTcpWorker(),
-		NewCacheWorker(cm),
-	}, nil
+	return NewServer(bind)
 }
 
 func NewTunnelServerKeyPair(bind string, pub string, secret string) (*TunnelServer, error) {
 	if len(pub) == 0 || len(secret) == 0 {
 		return NewTunnelServer(bind)
 	}
-	zmq.AuthCurveAdd("global", zmq.CURVE_ALLOW_ANY)
+	return NewServer(bind, WithServerKeys(pub, secret))
+}
+
+// NewServer makes a server bound to bind, see Option for what it takes
+func NewServer(bind string, opts ...Option) (*TunnelServer, error) {
+	o := makeOptions(opts)
+	socket, err := o.serverSocket(bind)
+	if err != nil {
+		return nil, err
+	}
+	s := newTunnelServer(socket)
+	s.endpoint = bind
+	if o.cache != nil {
+		s.SetCache(o.cache)
+	}
+	s.dial, s.transport, s.bestEffortACL = o.dial, o.transport, o.bestEffortACL
+	if s.dial != nil || s.transport != nil {
+		//as they are till SetACL wraps them
+		s.SetACL(nil)
+	}
+	s.hooks = joinHooks(metricsHooks("server"), o.hooks)
+	for _, w := range s.streamWorkers() {
+		w.hooks = s.hooks
+	}
+	return s, nil
+}
+
+func newTunnelServer(socket *zmq.Socket) *TunnelServer {
 	cm := makeCacheManager()
-	socket, _ := zmq.NewSocket(zmq.ROUTER)
-	socket.ServerAuthCurve("global", secret)
-	socket.Bind(bind)
-	repChan := make(chan *Msg, 10)
-	zmq.AuthStart()
-	zmq.AuthCurveAdd(zmq.CURVE_ALLOW_ANY)
-	return &TunnelServer{
-		socket, repChan,
-		NewMultiStreamHttpWorker(cm),
-		NewMultiStreamTcpWorker(),
-		NewCacheWorker(cm),
-	}, nil
+	s := &TunnelServer{
+		socket:      socket,
+		repChan:     make(chan *Msg, 10),
+		cacheWorker: NewCacheWorker(cm),
+		httpFactory: newHttpWorkerFactory(cm),
+		tcpFactory:  &TcpWorkerFactory{cm: cm},
+		udpFactory:  &UdpWorkerFactory{idleTimeout: UDP_IDLE_TIMEOUT},
+		cm:          cm,
+		gracePeriod: GRACE_PERIOD,
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	s.httpWorker = newMultiStreamHttpWorker(s.httpFactory)
+	s.tcpWorker = newMultiStreamTcpWorker(s.tcpFactory)
+	s.udpWorker = NewMultiStreamUdpWorker(s.udpFactory)
+	s.sched = newScheduler(func(msg *Msg) bool {
+		return cm.GetPeerJoinFragments(msg.GetPeerId())
+	})
+	s.reverse = newReverseServer(cm, s.repChan)
+	cm.OnExpire = s.reapPeer
+	return s
+}
+
+// SetCache replace the local cache, should be called before Run
+func (s *TunnelServer) SetCache(cache Cache) {
+	s.cm.SetLocal(cache)
+}
+
+// SetPeerTimeout set how long a client may stay silent before its streams
+// and cache state are dropped, should be called before Run
+func (s *TunnelServer) SetPeerTimeout(timeout time.Duration) {
+	s.cacheWorker.idleTimeout = timeout
+}
+
+// SetUdpIdleTimeout set how long a udp stream lives without datagrams,
+// should be called before Run
+func (s *TunnelServer) SetUdpIdleTimeout(timeout time.Duration) {
+	s.udpFactory.idleTimeout = timeout
+}
+
+// SetHttpConfig tune how responses are sent, should be called before Run
+func (s *TunnelServer) SetHttpConfig(config HttpConfig) {
+	s.httpFactory.config = config
+}
+
+// SetACL limit where streams of clients may connect to, the dials of
+// WithDialer and WithTransport are checked. A transport which goes through
+// a proxy or is not an *http.Transport can't be checked, it's an
+// ErrorUncheckedTransport without WithBestEffortACL.
+// It doesn't cover where clients expose services, see SetExposeACL.
+// Should be called before Run
+func (s *TunnelServer) SetACL(acl *ACL) error {
+	ht, err := acl.wrapTransport(s.transport, s.dial, s.bestEffortACL)
+	if err != nil {
+		return err
+	}
+	s.tcpFactory.dial = acl.wrapDial(s.dial)
+	s.httpFactory.ht = ht
+	s.udpFactory.acl = acl
+	return nil
+}
+
+// SetExposeACL let clients expose services only on the addresses acl
+// allows, reverse mode is off while it's nil. Should be called before Run
+func (s *TunnelServer) SetExposeACL(acl *ExposeACL) {
+	s.reverse.allow = acl
 }
 
 func (s *TunnelServer) Run() error {
+	return s.RunContext(context.Background())
+}
+
+// RunContext runs till ctx is done or Close is called, see shutdown
+func (s *TunnelServer) RunContext(ctx context.Context) error {
+	s.sockMu.Lock()
+	if s.sockClosed {
+		s.sockMu.Unlock()
+		return nil
+	}
+	s.running = true
+	s.socket.SetRcvtimeo(SERVER_RECV_TIMEOUT)
+	s.sockMu.Unlock()
+	defer close(s.stopped)
+	defer s.closeSocket()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.shutdown()
+		case <-s.done:
+		}
+	}()
+	s.exportGauges(true)
+	defer s.exportGauges(false)
+
 	go s.httpWorker.Run(s.repChan)
 	go s.tcpWorker.Run(s.repChan)
+	go s.udpWorker.Run(s.repChan)
 	go s.cacheWorker.Run(s.repChan)
 
+	//streams take turns on the socket
+	go handOff(s.repChan, s.sched, s.reverse.streams.sent)
 	go func() {
-		for msg := range s.repChan {
+		for msg := s.sched.Pop(); msg != nil; msg = s.sched.Pop() {
 			frames, _ := toFrames(msg)
-			log.Printf("[ts]send msg %s", msg)
+			logger.Printf("[ts]send msg %s", msg)
 			if msg.GetMsgType() == ERROR {
-				log.Printf("error msg:%s", msg.Body.(*ErrorData).String())
+				logger.Printf("error msg:%s", msg.Body.(*ErrorData).String())
 			}
-			s.socket.SendMessage(frames)
+			s.sockMu.Lock()
+			if !s.sockClosed {
+				s.socket.SendMessage(frames)
+			}
+			s.sockMu.Unlock()
+			s.sched.Sent()
+			s.hooks.msgSent(msg, frames)
 		}
 	}()
 
 	for {
 		frames, err := s.socket.RecvMessageBytes(0)
+		select {
+		case <-s.done:
+			return nil
+		default:
+		}
 		if err != nil {
 			continue
 		}
 		msg, err := fromFrames(frames)
 		if err != nil {
-			log.Printf("[ts]invalid frames %s", err.Error())
+			logger.Printf("[ts]invalid frames %s", err.Error())
 			continue
 		}
-		log.Printf("[ts]recv msg %s", msg)
+		logger.Printf("[ts]recv msg %s", msg)
+		s.hooks.msgReceived(msg, frames)
+		if !compatibleVersion(msg.Header.Version) {
+			s.reject(msg, versionError(msg.Header.Version))
+			continue
+		}
+		s.cm.TouchPeer(msg.GetPeerId())
 
+		if msg.GetMsgType() == HELLO {
+			s.handleHello(msg)
+			continue
+		}
+		if msg.GetMsgType() == PING {
+			s.handlePing(msg)
+			continue
+		}
+		if msg.GetMsgType() == BIND {
+			if atomic.LoadInt32(&s.draining) == 1 {
+				s.reject(msg, ErrorShuttingDown)
+				continue
+			}
+			s.reverse.bind(msg)
+			continue
+		}
+		if s.reverse.dispatch(msg) {
+			continue
+		}
 		if msg.GetMsgType() == CACHE_SHARE {
 			s.cacheWorker.GetReqChannel() <- msg
 			continue
 		}
-		if msg.TestFlag(FLAG_HTTP) {
+		if msg.TestFlag(FLAG_UDP) {
+			s.udpWorker.GetReqChannel() <- msg
+		} else if msg.TestFlag(FLAG_HTTP) {
 			s.httpWorker.GetReqChannel() <- msg
 		} else {
 			s.tcpWorker.GetReqChannel() <- msg
@@ -88,7 +263,69 @@ func (s *TunnelServer) Run() error {
 	return nil
 }
 
+func (s *TunnelServer) handleHello(msg *Msg) {
+	hello := msg.Body.(*HelloData)
+	agreed, err := negotiate(hello, msg.Header.Version)
+	if err != nil {
+		logger.Printf("[ts]reject hello from %s: %s", hello.ClientId, err)
+		s.reject(msg, err)
+		return
+	}
+	logger.Printf("[ts]hello from %s, agreed on %s", hello.ClientId, agreed)
+	s.cm.SetPeerHello(msg.GetPeerId(), agreed)
+	s.repChan <- makeHelloMsg(HELLO_REP, msg.Envelope, agreed)
+}
+
+// a client we hold no state for must have been reaped, or we restarted,
+// ask it to say hello again
+func (s *TunnelServer) handlePing(msg *Msg) {
+	if _, ok := s.cm.GetPeer(msg.GetPeerId()); !ok {
+		logger.Printf("[ts]ping from unknown peer %s, ask for hello", msg.GetPeerId())
+		s.repChan <- makeHelloMsg(HELLO, msg.Envelope, makeHelloData(""))
+		return
+	}
+	s.repChan <- NewMsgBuilderFromMsg(msg).MakeMsg(PONG, CT_RAW, []byte(""), 0)
+}
+
+// end all streams of a client which stopped responding
+func (s *TunnelServer) reapPeer(pid string) {
+	for _, w := range []Worker{s.httpWorker, s.tcpWorker, s.udpWorker} {
+		if mw, ok := w.(*MultiStreamWorker); ok {
+			mw.Reap(pid)
+		}
+	}
+	s.reverse.reap(pid)
+	s.httpFactory.retained.dropPeer(pid)
+}
+
+// reply an ERROR on the stream of msg
+func (s *TunnelServer) reject(msg *Msg, err error) {
+	s.repChan <- NewMsgBuilderFromMsg(msg).MakeErrorMsg(err, 0)
+}
+
 func (s *TunnelServer) Close() error {
-	s.socket.Close()
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.sched.Close()
+		s.reverse.Close()
+		s.sockMu.Lock()
+		running := s.running
+		s.sockMu.Unlock()
+		if running {
+			<-s.stopped
+		} else {
+			s.closeSocket()
+		}
+	})
 	return nil
 }
+
+// closeSocket closes the socket once, not while a msg is being sent
+func (s *TunnelServer) closeSocket() {
+	s.sockMu.Lock()
+	defer s.sockMu.Unlock()
+	if !s.sockClosed {
+		s.sockClosed = true
+		s.socket.Close()
+	}
+}
@@ -0,0 +1,280 @@
+package dtunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	//a udp stream nobody sent or received on for this long is closed
+	UDP_IDLE_TIMEOUT = 60 * time.Second
+	//bytes of datagrams of a stream waiting either way, more are dropped
+	UDP_QUEUE_SIZE = 256 * 1024
+)
+
+var ErrorIdleTimeout = errors.New("IdleTimeout")
+
+// UdpWorker relays the datagrams of a stream from a socket of its own,
+// the first UDP_DATA opens it
+type UdpWorker struct {
+	reqChan     chan *Msg
+	idleTimeout time.Duration
+	acl         *ACL
+	//canceled when the peer resets the stream, closes the socket
+	ctx    context.Context
+	cancel context.CancelFunc
+	//unix nano of the last datagram either way
+	lastActive int64
+}
+
+func newUdpWorker(reqChan chan *Msg, idleTimeout time.Duration, acl *ACL) *UdpWorker {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &UdpWorker{reqChan: reqChan, idleTimeout: idleTimeout, acl: acl, ctx: ctx, cancel: cancel}
+}
+
+func (w *UdpWorker) Cancel() {
+	w.cancel()
+}
+
+func (w *UdpWorker) GetReqChannel() chan *Msg {
+	return w.reqChan
+}
+
+func (w *UdpWorker) Run(repChan chan *Msg) error {
+	first := <-w.reqChan
+	if first.GetMsgType() != UDP_DATA {
+		return errors.New("invalid first msg")
+	}
+
+	defer w.cancel()
+	msgMaker := NewMsgBuilderFromMsg(first)
+	conn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		repChan <- msgMaker.MakeErrorMsg(err, 0)
+		return err
+	}
+	defer conn.Close()
+	go func() {
+		<-w.ctx.Done()
+		conn.Close()
+	}()
+	w.touch()
+	go w.relayBack(conn, repChan, first)
+	w.send(conn, first)
+
+	idle := time.NewTimer(w.idleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case msg := <-w.reqChan:
+			if msg.GetMsgType() == UDP_DATA {
+				w.send(conn, msg)
+			}
+			if msg.IsEndOfStream() {
+				return nil
+			}
+		case <-idle.C:
+			left := w.idleTimeout - time.Since(time.Unix(0, atomic.LoadInt64(&w.lastActive)))
+			if left > 0 {
+				idle.Reset(left)
+				continue
+			}
+			logger.Printf("[%x] udp stream idle for %s", first.GetStreamId(), w.idleTimeout)
+			repChan <- msgMaker.MakeErrorMsg(ErrorIdleTimeout, 0)
+			return nil
+		case <-w.ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (w *UdpWorker) touch() {
+	atomic.StoreInt64(&w.lastActive, time.Now().UnixNano())
+}
+
+// send the datagram of msg, names are resolved here
+func (w *UdpWorker) send(conn net.PacketConn, msg *Msg) {
+	data := msg.Body.(*UdpData)
+	addr, err := net.ResolveUDPAddr("udp", data.Addr)
+	if err == nil {
+		host, _, _ := net.SplitHostPort(data.Addr)
+		err = w.acl.Check(host, addr.IP)
+	}
+	if err != nil {
+		logger.Printf("[%x] drop datagram to %s: %s", msg.GetStreamId(), data.Addr, err)
+		return
+	}
+	w.touch()
+	if _, err := conn.WriteTo(data.Payload, addr); err != nil {
+		logger.Printf("[%x] fail to send datagram to %s: %s", msg.GetStreamId(), addr, err)
+	}
+}
+
+// relayBack sends what the socket gets to the peer, till it's closed.
+// Datagrams wait in a queue of the stream, those which don't fit are dropped,
+// so a flood neither stalls the other streams nor loses their datagrams
+func (w *UdpWorker) relayBack(conn net.PacketConn, repChan chan *Msg, first *Msg) {
+	queue := newLossyRecvQueue(UDP_QUEUE_SIZE, "out")
+	defer func() {
+		queue.close()
+		if n := queue.Dropped(); n > 0 {
+			logger.Printf("[%x] udp stream dropped %d datagrams to the peer", first.GetStreamId(), n)
+		}
+	}()
+	go queue.pump(repChan, w.ctx.Done(), nil)
+	buf := make([]byte, MAX_DATAGRAM_SIZE)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		w.touch()
+		payload := make([]byte, n)
+		copy(payload, buf[:n])
+		queue.push(makeUdpMsg(first.GetStreamId(), first.Envelope, UDP_DATA_REP, from.String(), payload, 0))
+	}
+}
+
+type UdpWorkerFactory struct {
+	idleTimeout time.Duration
+	acl         *ACL
+}
+
+func (f *UdpWorkerFactory) MakeStreamWorker(sid UID) Worker {
+	return newUdpWorker(make(chan *Msg), f.idleTimeout, f.acl)
+}
+
+// datagrams are not flow controlled, so the worker knows no window and
+// drops what the streams can't keep up with
+func NewMultiStreamUdpWorker(factory *UdpWorkerFactory) Worker {
+	return newMultiStreamWorker(factory)
+}
+
+// tunnelPacketConn is a udp association over a stream, the server
+// relays its datagrams from a socket of its own
+type tunnelPacketConn struct {
+	st       *clientStream
+	streams  *streamTable
+	sendChan chan *Msg
+	cancel   func()
+	local    net.Addr
+	//the first datagram begins the stream
+	begun         int32
+	readDeadline  *connDeadline
+	writeDeadline *connDeadline
+}
+
+// ListenUdp opens a udp association through the server,
+// it's closed after UDP_IDLE_TIMEOUT without datagrams
+func (c *TunnelClient) ListenUdp() (net.PacketConn, error) {
+	if err := c.usable(); err != nil {
+		return nil, err
+	}
+	sid := MakeUID()
+	msgMaker := NewMsgBuilder(sid, [][]byte{[]byte("")}, FLAG_UDP)
+	st := newClientStream(sid, FLAG_UDP, 0, 0, c.reqChan, msgMaker)
+	c.streams.add(st)
+	return &tunnelPacketConn{
+		st:            st,
+		streams:       c.streams,
+		sendChan:      c.reqChan,
+		cancel:        c.canceler(st),
+		local:         tunnelAddr(c.endpoint),
+		readDeadline:  newConnDeadline(),
+		writeDeadline: newConnDeadline(),
+	}, nil
+}
+
+func (c *tunnelPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case msg, ok := <-c.st.ch:
+		if !ok {
+			return 0, nil, io.EOF
+		}
+		switch msg.GetMsgType() {
+		case UDP_DATA_REP:
+			data := msg.Body.(*UdpData)
+			return copy(p, data.Payload), parseUdpAddr(data.Addr), nil
+		case ERROR:
+			return 0, nil, fmt.Errorf("Udp Error : %s", msg.Body)
+		default:
+			return 0, nil, ErrorStreamReset
+		}
+	case <-c.st.done:
+		return 0, nil, net.ErrClosed
+	case <-c.readDeadline.wait():
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *tunnelPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if isClosedChan(c.st.done) {
+		return 0, net.ErrClosed
+	}
+	//the server ended the stream
+	if _, ok := c.streams.get(c.st.sid); !ok {
+		return 0, ErrorStreamReset
+	}
+	if len(addr.String()) > 255 {
+		return 0, InvalidBody
+	}
+	var flag uint16
+	if atomic.CompareAndSwapInt32(&c.begun, 0, 1) {
+		flag = FLAG_STREAM_BEGIN
+	}
+	payload := make([]byte, len(p))
+	copy(payload, p)
+	select {
+	case c.sendChan <- makeUdpMsg(c.st.sid, [][]byte{[]byte("")}, UDP_DATA, addr.String(), payload, flag):
+		return len(p), nil
+	case <-c.st.done:
+		return 0, net.ErrClosed
+	case <-c.writeDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *tunnelPacketConn) Close() error {
+	c.cancel()
+	return nil
+}
+
+func (c *tunnelPacketConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *tunnelPacketConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *tunnelPacketConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *tunnelPacketConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// parseUdpAddr the addr a datagram came from
+func parseUdpAddr(addr string) net.Addr {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return tunnelAddr(addr)
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return tunnelAddr(addr)
+	}
+	return makeUdpAddr(host, n)
+}
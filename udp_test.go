@@ -0,0 +1,140 @@
+package dtunnel
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUdpTunnel(t *testing.T) {
+	service, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen fail %v", err)
+	}
+	defer service.Close()
+	go func() {
+		buf := make([]byte, MAX_DATAGRAM_SIZE)
+		for {
+			n, from, err := service.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			service.WriteTo(bytes.ToUpper(buf[:n]), from)
+		}
+	}()
+
+	server, _ := NewTunnelServer("inproc://test-udp")
+	server.SetUdpIdleTimeout(300 * time.Millisecond)
+	go server.Run()
+	defer server.Close()
+	tc, _ := NewTunnelClient("inproc://test-udp")
+	go tc.Run()
+	defer tc.Close()
+
+	pc, err := tc.ListenUdp()
+	if err != nil {
+		t.Fatalf("ListenUdp fail %v", err)
+	}
+	defer pc.Close()
+	//the name is resolved by the tunnel server
+	_, port, _ := net.SplitHostPort(service.LocalAddr().String())
+	target := tunnelAddr(net.JoinHostPort("localhost", port))
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, word := range []string{"hello", "world"} {
+		if _, err := pc.WriteTo([]byte(word), target); err != nil {
+			t.Fatalf("WriteTo fail %v", err)
+		}
+		buf := make([]byte, MAX_DATAGRAM_SIZE)
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil || string(buf[:n]) != string(bytes.ToUpper([]byte(word))) {
+			t.Fatalf("reply not right %q %v", buf[:n], err)
+		}
+		if from.String() != service.LocalAddr().String() {
+			t.Errorf("reply should come from the service, got %s", from)
+		}
+	}
+
+	//the server closes it once idle
+	if _, _, err := pc.ReadFrom(make([]byte, 10)); err == nil {
+		t.Error("idle udp stream should be closed")
+	}
+	if _, err := pc.WriteTo([]byte("late"), target); err == nil {
+		t.Error("write after the server closed the stream should fail")
+	}
+	workers := server.udpWorker.(*MultiStreamWorker)
+	for wait := 0; wait < 100 && (workers.Len() > 0 || tc.streamCount() > 0); wait++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if workers.Len() != 0 || tc.streamCount() != 0 {
+		t.Errorf("streams leak: server %d, client %d", workers.Len(), tc.streamCount())
+	}
+
+	//closing it ends the worker on the server too
+	pc, _ = tc.ListenUdp()
+	pc.WriteTo([]byte("hello"), target)
+	pc.Close()
+	for wait := 0; wait < 100 && workers.Len() > 0; wait++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if workers.Len() != 0 {
+		t.Errorf("closed udp stream should end its worker, got %d", workers.Len())
+	}
+}
+
+func TestUdpWorkerDropsWhenFull(t *testing.T) {
+	//the server queues datagrams of the peer in a bounded queue
+	workers := NewMultiStreamUdpWorker(&UdpWorkerFactory{idleTimeout: time.Minute}).(*MultiStreamWorker)
+	first := makeUdpMsg(MakeUID(), nil, UDP_DATA, "127.0.0.1:9", []byte("hello"), FLAG_STREAM_BEGIN)
+	entry := workers.startWorker(first, make(chan *Msg, 10))
+	defer cancelWorker(entry.worker)
+	if !entry.queue.lossy || entry.queue.limit != UDP_QUEUE_SIZE {
+		t.Error("recv queue of a udp stream should be bounded and lossy")
+	}
+
+	//a lossy queue counts what it drops
+	queue := newLossyRecvQueue(8, "out")
+	dropped := metricUdpDropped.get("out")
+	for i := 0; i < 3; i++ {
+		queue.push(makeUdpMsg(MakeUID(), nil, UDP_DATA_REP, "127.0.0.1:9", []byte("flood"), 0))
+	}
+	if queue.Dropped() != 2 || metricUdpDropped.get("out") != dropped+2 {
+		t.Errorf("drops not counted, got %d", queue.Dropped())
+	}
+
+	//nobody takes what it relays back for a while
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen fail %v", err)
+	}
+	w := newUdpWorker(make(chan *Msg), time.Minute, nil)
+	defer w.Cancel()
+	repChan := make(chan *Msg)
+	stopped := make(chan struct{})
+	go func() {
+		w.relayBack(conn, repChan, first)
+		close(stopped)
+	}()
+	sender, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	defer sender.Close()
+	for i := 0; i < 3; i++ {
+		sender.WriteTo([]byte("flood"), conn.LocalAddr())
+	}
+	//the stream's own queue keeps them
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-repChan:
+			if string(msg.Body.(*UdpData).Payload) != "flood" {
+				t.Errorf("relayed datagram not right, got %s", msg.Body)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("queued datagrams should be relayed")
+		}
+	}
+	conn.Close()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("relayBack should not block on repChan")
+	}
+}
@@ -1,22 +1,64 @@
 package dtunnel
 
 import (
-	_ "log"
+	"sync/atomic"
+	"time"
 )
 
+//late msgs of a finished stream are dropped for at least this long
+const FINISHED_STREAM_TTL = time.Minute
+
 type Worker interface {
 	GetReqChannel() chan *Msg
 	Run(repChan chan *Msg) error
 }
 
+// a stream worker the peer can abort with RESET
+type Canceler interface {
+	Cancel()
+}
+
+// a stream worker whose sending is flow controlled by the peer
+type WindowUpdater interface {
+	UpdateWindow(n int)
+}
+
 type StreamWorkerMaker interface {
 	MakeStreamWorker(sid UID) Worker
 }
 
+// a running stream worker, done is closed when its Run returns
+type streamEntry struct {
+	worker Worker
+	pid    string
+	flags  uint16
+	begun  time.Time
+	done   chan struct{}
+	//msgs waiting for the worker, so a slow one doesn't block the others
+	queue *recvQueue
+}
+
 type MultiStreamWorker struct {
 	factory StreamWorkerMaker
-	workers map[UID]Worker
-	reqChan chan *Msg
+	//knows the flow control window of peers, nil for none
+	cm       *CacheManager
+	workers  map[UID]*streamEntry
+	active   int64
+	reqChan  chan *Msg
+	reapChan chan string
+	doneChan chan UID
+	//streams are ended with it, see Abort
+	abortChan chan error
+	//new streams are refused once set, see Drain
+	draining int32
+	//called when the worker of a stream is gone, may be nil
+	onDone func(sid UID)
+	hooks  *Hooks
+	//streams whose worker is gone, so a late msg doesn't start another,
+	//the old set is dropped every FINISHED_STREAM_TTL
+	finished    map[UID]struct{}
+	finishedOld map[UID]struct{}
+	rotatedAt   time.Time
 }
 
 func (w *MultiStreamWorker) GetReqChannel() chan *Msg {
@@ -24,19 +66,171 @@ func (w *MultiStreamWorker) GetReqChannel() chan *Msg {
 }
 
 func (w *MultiStreamWorker) Run(repChan chan *Msg) error {
-	for msg := range w.reqChan {
-		w.handleMsg(msg, repChan)
+	for {
+		select {
+		case msg, ok := <-w.reqChan:
+			if !ok {
+				return nil
+			}
+			w.handleMsg(msg, repChan)
+		case pid := <-w.reapChan:
+			w.reap(pid)
+		case err := <-w.abortChan:
+			w.abort(func(*streamEntry) bool { return true }, err)
+		case sid := <-w.doneChan:
+			if entry, ok := w.workers[sid]; ok {
+				w.hooks.streamEnd(sid, entry.flags, time.Since(entry.begun))
+			}
+			delete(w.workers, sid)
+			w.markFinished(sid)
+			atomic.AddInt64(&w.active, -1)
+			if w.onDone != nil {
+				w.onDone(sid)
+			}
+		}
+	}
+}
+
+func (w *MultiStreamWorker) markFinished(sid UID) {
+	if now := time.Now(); now.Sub(w.rotatedAt) > FINISHED_STREAM_TTL {
+		w.finishedOld, w.finished, w.rotatedAt = w.finished, make(map[UID]struct{}), now
+	}
+	w.finished[sid] = struct{}{}
+}
+
+func (w *MultiStreamWorker) isFinished(sid UID) bool {
+	_, ok := w.finished[sid]
+	if !ok {
+		_, ok = w.finishedOld[sid]
 	}
-	return nil
+	return ok
+}
+
+// Reap ends all streams of a peer which stopped responding
+func (w *MultiStreamWorker) Reap(pid string) {
+	w.reapChan <- pid
+}
+
+// Drain refuses new streams with ErrorShuttingDown, the running ones go on
+func (w *MultiStreamWorker) Drain() {
+	atomic.StoreInt32(&w.draining, 1)
+}
+
+// Abort ends all running streams with err
+func (w *MultiStreamWorker) Abort(err error) {
+	w.abortChan <- err
+}
+
+// Len returns the number of running streams
+func (w *MultiStreamWorker) Len() int {
+	return int(atomic.LoadInt64(&w.active))
 }
 
 func (w *MultiStreamWorker) handleMsg(msg *Msg, repChan chan *Msg) {
 	sid := msg.GetStreamId()
-	worker, ok := w.workers[sid]
+	entry, ok := w.workers[sid]
+	if ok && msg.GetMsgType() == RESET {
+		logger.Printf("[%x] stream reset by peer", sid)
+		cancelWorker(entry.worker)
+		return
+	}
+	if ok && msg.GetMsgType() == WINDOW_UPDATE {
+		if u, ok := entry.worker.(WindowUpdater); ok {
+			u.UpdateWindow(windowIncrement(msg))
+		}
+		return
+	}
 	if !ok {
-		worker = w.factory.MakeStreamWorker(sid)
-		w.workers[sid] = worker
-		go worker.Run(repChan)
+		//the tail of a stream whose worker is already gone
+		if msg.IsEndOfStream() || msg.GetMsgType() == ERROR || msg.GetMsgType() == WINDOW_UPDATE || w.isFinished(sid) {
+			logger.Printf("[%x] drop msg of finished stream", sid)
+			return
+		}
+		if atomic.LoadInt32(&w.draining) == 1 {
+			logger.Printf("[%x] refuse new stream, shutting down", sid)
+			repChan <- NewMsgBuilderFromMsg(msg).MakeErrorMsg(ErrorShuttingDown, 0)
+			return
+		}
+		entry = w.startWorker(msg, repChan)
+	}
+	if err := entry.queue.push(msg); err != nil {
+		logger.Printf("[%x] peer %s: %s", sid, entry.pid, err)
+		cancelWorker(entry.worker)
+	}
+}
+
+func (w *MultiStreamWorker) startWorker(msg *Msg, repChan chan *Msg) *streamEntry {
+	sid, pid := msg.GetStreamId(), msg.GetPeerId()
+	var window int
+	var credit func(n int)
+	if w.cm != nil {
+		window = w.cm.GetPeerWindow(pid)
+		msgMaker := NewMsgBuilderFromMsg(msg)
+		credit = windowUpdater(window, func(n int) {
+			repChan <- msgMaker.MakeMsg(WINDOW_UPDATE, CT_RAW, encodeWindowUpdate(n), 0)
+		})
+	}
+	limit := 0
+	if window > 0 {
+		limit = window + w.cm.GetPeerMaxFrameSize(pid)
+	}
+	flags := msg.Flag & (FLAG_TCP | FLAG_UDP | FLAG_HTTP)
+	queue := newRecvQueue(limit)
+	if flags&FLAG_UDP != 0 {
+		//datagrams are not flow controlled, those the worker can't keep up with are dropped
+		queue = newLossyRecvQueue(UDP_QUEUE_SIZE, "in")
+	}
+	entry := &streamEntry{w.factory.MakeStreamWorker(sid), pid, flags, time.Now(), make(chan struct{}), queue}
+	w.workers[sid] = entry
+	w.hooks.streamBegin(sid, entry.flags)
+	atomic.AddInt64(&w.active, 1)
+	go w.runWorker(sid, entry, repChan)
+	go entry.queue.pump(entry.worker.GetReqChannel(), entry.done, credit)
+	return entry
+}
+
+func (w *MultiStreamWorker) runWorker(sid UID, entry *streamEntry, repChan chan *Msg) {
+	err := entry.worker.Run(repChan)
+	if err != nil {
+		logger.Printf("[%x] stream worker end with error %s", sid, err)
+	}
+	close(entry.done)
+	entry.queue.close()
+	w.doneChan <- sid
+}
+
+func cancelWorker(worker Worker) {
+	if c, ok := worker.(Canceler); ok {
+		c.Cancel()
+	}
+}
+
+func (w *MultiStreamWorker) reap(pid string) {
+	logger.Printf("reap streams of dead peer %s", pid)
+	w.abort(func(entry *streamEntry) bool { return entry.pid == pid }, ErrorPeerTimeout)
+}
+
+// abort the streams which match with err
+func (w *MultiStreamWorker) abort(match func(*streamEntry) bool, err error) {
+	for sid, entry := range w.workers {
+		if !match(entry) {
+			continue
+		}
+		logger.Printf("[%x] abort stream of peer %s: %s", sid, entry.pid, err)
+		entry.queue.push(NewMsgBuilder(sid, nil, 0).MakeErrorMsg(err, 0))
+		//a worker waiting for credit would never hear from the peer
+		cancelWorker(entry.worker)
+	}
+}
+
+func newMultiStreamWorker(factory StreamWorkerMaker) *MultiStreamWorker {
+	return &MultiStreamWorker{
+		factory:   factory,
+		workers:   make(map[UID]*streamEntry),
+		finished:  make(map[UID]struct{}),
+		reqChan:   make(chan *Msg),
+		reapChan:  make(chan string, 10),
+		doneChan:  make(chan UID, 10),
+		abortChan: make(chan error, 1),
 	}
-	worker.GetReqChannel() <- msg
 }